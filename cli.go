@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"gateway/web"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: gateway [command]
+
+Commands:
+  serve                                   run the gateway (default)
+  grants list                             list stored grants
+  grants add <ip> [--ttl 24h] [--user u]  grant an IP (ttl defaults to IP_EXPIRATION_DAYS)
+  grants revoke <ip>                      remove the grant for an IP
+  grants prune                            remove expired and removed-user grants
+  persist verify                          check PERSIST_FILE for problems
+  audit verify [--tail SEQ:HASH]          check the AUDIT_LOG HMAC chain (AUDIT_KEY) and
+                                          that it still reaches a tail noted earlier
+  config check [--config file]            validate the config and print it, secrets redacted
+  password hash                           read a password from stdin, check it against the
+                                          policy and print an argon2id hash for GATEWAY_PASSWORD
+
+Settings come from the YAML or TOML file named by CONFIG_FILE (if set), with
+environment variables overriding it. Secrets can instead be read from files,
+e.g. GATEWAY_PASSWORD_FILE or password_file for GATEWAY_PASSWORD. SIGHUP (or,
+with CONFIG_POLL_SECONDS, a change to the config, users or a secret file)
+reloads the settings that allow it; the rest are logged as needing a restart.
+
+The grants and persist commands edit the configured storage (STORAGE_BACKEND)
+directly. Stop the server first: it keeps grants in memory and overwrites the
+stored copy on its next save.
+`
+
+// run dispatches a command line and returns the process exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "serve" {
+		return serve(stderr)
+	}
+
+	switch strings.Join(args[:min(2, len(args))], " ") {
+	case "grants list":
+		return grantsList(args[2:], stdout, stderr)
+	case "grants add":
+		return grantsAdd(args[2:], stdout, stderr)
+	case "grants revoke":
+		return grantsRevoke(args[2:], stdout, stderr)
+	case "grants prune":
+		return grantsPrune(args[2:], stdout, stderr)
+	case "persist verify":
+		return persistVerify(args[2:], stdout, stderr)
+	case "audit verify":
+		return auditVerify(args[2:], stdout, stderr)
+	case "config check":
+		return configCheck(args[2:], stdout, stderr)
+	case "password hash":
+		return passwordHash(args[2:], stdin, stdout, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "unknown command %q\n\n%s", strings.Join(args, " "), usage)
+	return 2
+}
+
+// parseArgs parses flags that may appear before or after the positional
+// arguments, e.g. "grants add 1.2.3.4 --ttl 1h".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// loadConfig loads the config from CONFIG_FILE and the environment and sets up
+// logging from it. It reports errors to stderr and returns nil.
+func loadConfig(stderr io.Writer) *web.Config {
+	cfg, err := web.LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Fprintf(stderr, "error: invalid configuration:\n%v\n", err)
+		return nil
+	}
+	web.ConfigureLogging(cfg.Log)
+	return cfg
+}
+
+// openGrantFile opens the configured grant storage; callers must Close it.
+func openGrantFile(stderr io.Writer) *web.GrantFile {
+	cfg := loadConfig(stderr)
+	if cfg == nil {
+		return nil
+	}
+	f, err := web.OpenGrantFile(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return nil
+	}
+	return f
+}
+
+func saveGrantFile(f *web.GrantFile, stderr io.Writer) bool {
+	if err := f.Save(); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func grantsList(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("grants list", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	f := openGrantFile(stderr)
+	if f == nil {
+		return 1
+	}
+	defer f.Close()
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tUSER\tAUTHED\tEXPIRES\tSESSION")
+	for _, g := range f.List() {
+		expires := g.ExpiresAt.Format(time.RFC3339)
+		if g.Expired {
+			expires += " (expired)"
+		}
+		user := g.User
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", g.IP, user, g.AuthedTime.Format(time.RFC3339), expires, g.SessionFingerprint)
+	}
+	tw.Flush()
+	return 0
+}
+
+func grantsAdd(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("grants add", stderr)
+	ttl := fs.Duration("ttl", 0, "how long the grant lasts (default IP_EXPIRATION_DAYS)")
+	user := fs.String("user", "", "user to attribute the grant to")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	f := openGrantFile(stderr)
+	if f == nil {
+		return 1
+	}
+	defer f.Close()
+
+	g, err := f.Add(rest[0], *user, *ttl)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	if !saveGrantFile(f, stderr) {
+		return 1
+	}
+	fmt.Fprintf(stdout, "Granted %s until %s\n", g.IP, g.ExpiresAt.Format(time.RFC3339))
+	return 0
+}
+
+func grantsRevoke(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("grants revoke", stderr)
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	f := openGrantFile(stderr)
+	if f == nil {
+		return 1
+	}
+	defer f.Close()
+
+	if !f.Revoke(rest[0]) {
+		fmt.Fprintf(stderr, "no grant for %s\n", rest[0])
+		return 1
+	}
+	if !saveGrantFile(f, stderr) {
+		return 1
+	}
+	fmt.Fprintf(stdout, "Revoked %s\n", rest[0])
+	return 0
+}
+
+func grantsPrune(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("grants prune", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	f := openGrantFile(stderr)
+	if f == nil {
+		return 1
+	}
+	defer f.Close()
+
+	removed := f.Prune()
+	if !saveGrantFile(f, stderr) {
+		return 1
+	}
+	fmt.Fprintf(stdout, "Pruned %d grant(s)\n", len(removed))
+	for _, key := range removed {
+		fmt.Fprintf(stdout, "  %s\n", key)
+	}
+	return 0
+}
+
+func persistVerify(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("persist verify", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	f := openGrantFile(stderr)
+	if f == nil {
+		return 1
+	}
+	defer f.Close()
+
+	r := f.Verify()
+	fmt.Fprintf(stdout, "%s: %d grant(s)\n", f.Path(), r.Records)
+	for _, problem := range []struct {
+		what string
+		ips  []string
+	}{
+		{"invalid record(s)", r.Invalid},
+		{"duplicate IP(s)", r.Duplicates},
+		{"record(s) missing a session", r.MissingSessions},
+		{"expired grant(s)", r.Expired},
+		{"grant(s) for removed users", r.RemovedUsers},
+	} {
+		if len(problem.ips) > 0 {
+			fmt.Fprintf(stdout, "%d %s: %s\n", len(problem.ips), problem.what, strings.Join(problem.ips, ", "))
+		}
+	}
+	if !r.OK() {
+		fmt.Fprintln(stdout, "Problems found; the server repairs these on its next start, or run \"gateway grants prune\".")
+		return 1
+	}
+	fmt.Fprintln(stdout, "OK")
+	return 0
+}
+
+func auditVerify(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("audit verify", stderr)
+	tail := fs.String("tail", "", "SEQ:HASH of a record the log must still reach, from an earlier verify")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cfg := loadConfig(stderr)
+	if cfg == nil {
+		return 1
+	}
+	path := cfg.Audit.File
+	if path == "" {
+		fmt.Fprintln(stderr, "error: AUDIT_LOG is not set")
+		return 1
+	}
+
+	n, last, err := web.VerifyAuditLog(path, []byte(cfg.Audit.Key), cfg.Audit.Keep, *tail)
+	if err != nil {
+		fmt.Fprintf(stderr, "error after %d good record(s): %v\n", n, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: %d record(s), chain OK, tail %s\n", path, n, last)
+	return 0
+}
+
+func configCheck(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("config check", stderr)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "config file (YAML or TOML)")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	cfg, err := web.LoadConfig(*path)
+	if err == nil {
+		err = cfg.CheckPassword()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	source := *path
+	if source == "" {
+		source = "(none, defaults and environment only)"
+	}
+	fmt.Fprintf(stdout, "# config file: %s\n", source)
+	if err := cfg.Redacted().WriteYAML(stdout); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func passwordHash(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("password hash", stderr)
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cfg := loadConfig(stderr)
+	if cfg == nil {
+		return 1
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	// Check the policy the server would apply to this password in plaintext.
+	cfg.Auth.Password = strings.TrimRight(line, "\r\n")
+	cfg.Auth.UsersFile = ""
+	if cfg.Auth.Password == "" {
+		fmt.Fprintln(stderr, "error: no password on stdin")
+		return 1
+	}
+	if strings.TrimSpace(cfg.Auth.Password) != cfg.Auth.Password {
+		// The unlock form trims what's typed, so the hash could never match.
+		fmt.Fprintln(stderr, "error: the password must not start or end with whitespace")
+		return 1
+	}
+	if err := cfg.CheckPassword(); err != nil {
+		fmt.Fprintf(stderr, "error: weak password:\n%v\n", err)
+		return 1
+	}
+
+	hash, err := web.HashPassword(cfg.Auth.Password)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, hash)
+	return 0
+}
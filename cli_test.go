@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runTestCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+
+	return runTestCLIWithInput(t, "", args...)
+}
+
+func runTestCLIWithInput(t *testing.T, input string, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(input), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeTestPersistFile(t *testing.T, records string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "granted.json")
+	if err := os.WriteFile(path, []byte(records), 0600); err != nil {
+		t.Fatalf("write persist file: %v", err)
+	}
+	t.Setenv("PERSIST_FILE", path)
+	t.Setenv("IP_EXPIRATION_DAYS", "30")
+	t.Setenv("USERS_FILE", "")
+	return path
+}
+
+func readTestPersistFile(t *testing.T, path string) []map[string]any {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read persist file: %v", err)
+	}
+	var envelope struct {
+		Grants []map[string]any `json:"grants"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("decode persist file: %v", err)
+	}
+	return envelope.Grants
+}
+
+func TestGrantsAddRevokeAndList(t *testing.T) {
+	path := writeTestPersistFile(t, "[]")
+
+	if code, out, errOut := runTestCLI(t, "grants", "add", "203.0.113.5", "--ttl", "2h", "--user", "alice"); code != 0 || !strings.Contains(out, "Granted 203.0.113.5") {
+		t.Fatalf("expected add to succeed, got %d %q %q", code, out, errOut)
+	}
+	records := readTestPersistFile(t, path)
+	if len(records) != 1 || records[0]["ip"] != "203.0.113.5" || records[0]["user"] != "alice" || records[0]["session_hash"] == nil {
+		t.Fatalf("expected one saved grant with a session, got %#v", records)
+	}
+	authed, _ := time.Parse(time.RFC3339Nano, records[0]["authed_time"].(string))
+	if remaining := authed.Add(30 * 24 * time.Hour).Sub(time.Now()); remaining > 2*time.Hour || remaining < 2*time.Hour-time.Minute {
+		t.Fatalf("expected the grant to expire in 2h, got %v", remaining)
+	}
+
+	code, out, _ := runTestCLI(t, "grants", "list")
+	if code != 0 || !strings.Contains(out, "203.0.113.5") || !strings.Contains(out, "alice") {
+		t.Fatalf("expected the grant to be listed, got %d %q", code, out)
+	}
+	if strings.Contains(out, records[0]["session_hash"].(string)) {
+		t.Fatal("expected only the session fingerprint to be shown")
+	}
+
+	if code, _, _ := runTestCLI(t, "grants", "revoke", "203.0.113.5"); code != 0 {
+		t.Fatalf("expected revoke to succeed, got %d", code)
+	}
+	if code, _, _ := runTestCLI(t, "grants", "revoke", "203.0.113.5"); code != 1 {
+		t.Fatalf("expected revoking a missing grant to fail, got %d", code)
+	}
+	if records := readTestPersistFile(t, path); len(records) != 0 {
+		t.Fatalf("expected the grant to be removed, got %#v", records)
+	}
+}
+
+func TestGrantsAddRejectsBadInput(t *testing.T) {
+	writeTestPersistFile(t, "[]")
+
+	if code, _, _ := runTestCLI(t, "grants", "add", "not-an-ip"); code != 1 {
+		t.Fatalf("expected an invalid IP to be rejected, got %d", code)
+	}
+	if code, _, _ := runTestCLI(t, "grants", "add", "203.0.113.5", "--ttl", "1000h"); code != 1 {
+		t.Fatalf("expected a ttl beyond IP_EXPIRATION_DAYS to be rejected, got %d", code)
+	}
+	if code, _, _ := runTestCLI(t, "grants", "add"); code != 2 {
+		t.Fatalf("expected usage error without an IP, got %d", code)
+	}
+	if code, _, _ := runTestCLI(t, "grants", "frobnicate"); code != 2 {
+		t.Fatalf("expected usage error for an unknown command, got %d", code)
+	}
+}
+
+func TestPersistVerifyAndPrune(t *testing.T) {
+	old := time.Now().Add(-40 * 24 * time.Hour).Format(time.RFC3339)
+	now := time.Now().Format(time.RFC3339)
+	path := writeTestPersistFile(t, `[
+		{"ip":"203.0.113.1","authed_time":"`+now+`","session":"a"},
+		{"ip":"203.0.113.1","authed_time":"`+now+`","session":"b"},
+		{"ip":"203.0.113.2","authed_time":"`+old+`","session":"c"},
+		{"ip":"203.0.113.3","authed_time":"`+now+`","session":""}
+	]`)
+
+	code, out, _ := runTestCLI(t, "persist", "verify")
+	if code != 1 {
+		t.Fatalf("expected verify to report problems, got %d %q", code, out)
+	}
+	for _, want := range []string{"1 duplicate IP(s): 203.0.113.1", "1 expired grant(s): 203.0.113.2", "1 record(s) missing a session: 203.0.113.3"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in verify output, got %q", want, out)
+		}
+	}
+
+	if code, out, _ := runTestCLI(t, "grants", "prune"); code != 0 || !strings.Contains(out, "Pruned 1 grant(s)") {
+		t.Fatalf("expected one grant pruned, got %d %q", code, out)
+	}
+	if records := readTestPersistFile(t, path); len(records) != 2 {
+		t.Fatalf("expected two grants left, got %#v", records)
+	}
+	if code, out, _ := runTestCLI(t, "persist", "verify"); code != 0 || !strings.Contains(out, "OK") {
+		t.Fatalf("expected a clean file after prune, got %d %q", code, out)
+	}
+}
+
+func TestPersistVerifyRejectsCorruptFile(t *testing.T) {
+	writeTestPersistFile(t, "[{")
+
+	if code, _, errOut := runTestCLI(t, "persist", "verify"); code != 1 || !strings.Contains(errOut, "persist file") {
+		t.Fatalf("expected a corrupt file to fail, got %d %q", code, errOut)
+	}
+}
+
+func TestGrantsCommandsUseSQLiteBackend(t *testing.T) {
+	writeTestPersistFile(t, "[]")
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "gateway.db"))
+
+	if code, _, errOut := runTestCLI(t, "grants", "add", "203.0.113.5"); code != 0 {
+		t.Fatalf("expected add to succeed, got %d %q", code, errOut)
+	}
+	if code, out, _ := runTestCLI(t, "grants", "list"); code != 0 || !strings.Contains(out, "203.0.113.5") {
+		t.Fatalf("expected the grant to be read back from sqlite, got %d %q", code, out)
+	}
+}
+
+func TestConfigCheckPrintsRedactedConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.toml")
+	if err := os.WriteFile(path, []byte("[auth]\npassword = \"correct-horse-battery\"\n[server]\nport = \"8081\"\n"), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	t.Setenv("GATEWAY_PASSWORD", "")
+	t.Setenv("PORT", "")
+
+	code, stdout, stderr := runTestCLI(t, "config", "check", "--config", path)
+	if code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stderr)
+	}
+	if strings.Contains(stdout, "correct-horse-battery") || !strings.Contains(stdout, "REDACTED") || !strings.Contains(stdout, `"8081"`) {
+		t.Fatalf("expected the effective config with the password redacted, got:\n%s", stdout)
+	}
+
+	t.Setenv("GATEWAY_PASSWORD", "hunter2")
+	if code, _, stderr := runTestCLI(t, "config", "check", "--config", path); code != 1 || !strings.Contains(stderr, "PASSWORD_MIN_LENGTH") {
+		t.Fatalf("expected a weak password to fail the check, got %d: %s", code, stderr)
+	}
+	t.Setenv("GATEWAY_PASSWORD", "")
+
+	t.Setenv("MAX_LOGIN_FAILURES", "0")
+	if code, _, stderr := runTestCLI(t, "config", "check", "--config", path); code != 1 || !strings.Contains(stderr, "MAX_LOGIN_FAILURES") {
+		t.Fatalf("expected an invalid value to fail the check, got %d: %s", code, stderr)
+	}
+	t.Setenv("MAX_LOGIN_FAILURES", "")
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1,not-a-proxy")
+	if code, _, stderr := runTestCLI(t, "config", "check", "--config", path); code != 1 || !strings.Contains(stderr, "TRUSTED_PROXIES") {
+		t.Fatalf("expected an invalid trusted proxy to fail the check, got %d: %s", code, stderr)
+	}
+}
+
+func TestPasswordHashChecksPolicy(t *testing.T) {
+	t.Setenv("GATEWAY_PASSWORD", "")
+
+	if code, _, stderr := runTestCLIWithInput(t, "hunter2\n", "password", "hash"); code != 1 || !strings.Contains(stderr, "weak password") {
+		t.Fatalf("expected a weak password to be refused, got %d: %s", code, stderr)
+	}
+
+	if code, _, stderr := runTestCLIWithInput(t, " correct-horse-battery\r\n", "password", "hash"); code != 1 || !strings.Contains(stderr, "whitespace") {
+		t.Fatalf("expected a padded password to be refused, got %d: %s", code, stderr)
+	}
+
+	code, stdout, stderr := runTestCLIWithInput(t, "correct-horse-battery\n", "password", "hash")
+	if code != 0 || !strings.HasPrefix(stdout, "$argon2id$") {
+		t.Fatalf("expected an argon2id hash, got %d: %s%s", code, stdout, stderr)
+	}
+	t.Setenv("GATEWAY_PASSWORD", strings.TrimSpace(stdout))
+	if code, _, stderr := runTestCLI(t, "config", "check"); code != 0 {
+		t.Fatalf("expected the hash to be accepted as GATEWAY_PASSWORD, got %d: %s", code, stderr)
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gateway/web"
-	"log"
-	"net"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/didip/tollbooth/v7"
@@ -34,54 +37,217 @@ var defaultTrustedProxies = []string{
 }
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// shutdownTimeout bounds how long in-flight requests get to finish after
+// SIGINT/SIGTERM before the listeners are closed under them.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the gateway server until SIGINT/SIGTERM or a listener fails, then
+// shuts down gracefully and returns the exit code.
+func serve(stderr io.Writer) int {
+	cfg := loadConfig(stderr)
+	if cfg == nil {
+		return 1
+	}
+	if err := cfg.CheckPassword(); err != nil {
+		fmt.Fprintf(stderr, "error: refusing to start:\n%v\n", err)
+		return 1
+	}
 	configureGinMode()
 
-	handlers := web.SetupHandlers()
-	router := newRouter()
+	handlers := web.SetupHandlers(cfg)
+	lim := newLimiters(handlers)
+	router, err := newGatewayRouter(cfg, handlers, lim)
+	if err != nil {
+		// Config.Validate checks TRUSTED_PROXIES, so this is only a backstop.
+		fmt.Fprintf(stderr, "error: refusing to start: %v\n", err)
+		if err := handlers.Close(); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return 1
+	}
+	routes := &routerSwitch{}
+	routes.set(router)
+
+	var servers []*http.Server
 
-	trustedProxies := getTrustedProxies()
-	if len(trustedProxies) > 0 {
-		if err := router.SetTrustedProxies(trustedProxies); err != nil {
-			log.Fatalf("invalid TRUSTED_PROXIES configuration: %v", err)
+	// ADMIN_ADDR moves the admin API to its own listener (e.g. 127.0.0.1:9091)
+	// so it isn't reachable through the public proxy at all. Otherwise
+	// newGatewayRouter mounts it on the main router. The listener is only
+	// started if ADMIN_TOKEN is set at startup.
+	if adminAddr := cfg.Admin.Addr; adminAddr != "" && cfg.AdminEnabled() {
+		adminRouter := newRouter()
+		registerAdminRoutes(adminRouter, handlers, lim.admin)
+		adminServer := &http.Server{
+			Addr:              adminAddr,
+			ReadHeaderTimeout: 3 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			Handler:           adminRouter,
 		}
+		servers = append(servers, adminServer)
 	}
 
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("X-Content-Type-Options", "nosniff")
-		c.Writer.Header().Set("X-Frame-Options", "DENY")
-		c.Writer.Header().Set("Content-Security-Policy", "default-src 'self'")
-		c.Next()
-	})
+	// Metrics go on METRICS_ADDR when set (still checking METRICS_TOKEN if
+	// that is also set), otherwise newGatewayRouter mounts them on the main
+	// router behind METRICS_TOKEN.
+	if metricsAddr := cfg.Metrics.Addr; metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", handlers.MetricsHandler())
+		metricsServer := &http.Server{
+			Addr:              metricsAddr,
+			ReadHeaderTimeout: 3 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			Handler:           mux,
+		}
+		servers = append(servers, metricsServer)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Server.Port,
+		ReadHeaderTimeout: 3 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		Handler:           routes,
+	}
+
+	servers = append(servers, server)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := &reloader{path: os.Getenv("CONFIG_FILE"), cfg: cfg, handlers: handlers, limiters: lim, routes: routes}
+	go r.run(ctx)
+	return runServers(ctx, servers, handlers)
+}
+
+// runServers serves until ctx is done or a listener fails. It then stops the
+// listeners, lets in-flight requests finish, and closes handlers so pending
+// state is written before the process exits.
+func runServers(ctx context.Context, servers []*http.Server, handlers *web.Handlers) int {
+	failed := make(chan error, len(servers))
+	for _, s := range servers {
+		go func() {
+			if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("%s: %w", s.Addr, err)
+			}
+		}()
+	}
+
+	code := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down", "event", "shutdown")
+	case err := <-failed:
+		slog.Error("Server failed, shutting down", "event", "shutdown", "err", err)
+		code = 1
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down server", "event", "shutdown", "addr", s.Addr, "err", err)
+		}
+	}
 
+	if err := handlers.Close(); err != nil {
+		slog.Error("Error closing gateway state", "event", "shutdown", "err", err)
+		code = 1
+	}
+	return code
+}
+
+// limiters are the request throttles. They are shared by every router a
+// reload builds so clients don't get a fresh allowance from a SIGHUP.
+type limiters struct {
+	auth, access, admin *limiter.Limiter
+}
+
+func newLimiters(handlers *web.Handlers) *limiters {
 	// Coarse throttle on the auth endpoints. The real brute-force defense is the
 	// per-IP lockout in the web package (keyed on the resolved client IP); this
 	// just smooths bursts.
 	authLim := tollbooth.NewLimiter(2, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
 	authLim.SetBurst(5)
+	authLim.SetOnLimitReached(handlers.RateLimited("auth"))
 
 	// Higher limit for access checks (nginx calls this per request)
 	accessLim := tollbooth.NewLimiter(50, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
+	accessLim.SetOnLimitReached(handlers.RateLimited("access"))
+
+	adminLim := tollbooth.NewLimiter(5, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
+	adminLim.SetOnLimitReached(handlers.RateLimited("admin"))
+
+	return &limiters{auth: authLim, access: accessLim, admin: adminLim}
+}
+
+// newGatewayRouter builds the public router from cfg, which decides the
+// optional routes. Reloads build a new one rather than changing the serving router,
+// which gin doesn't allow.
+func newGatewayRouter(cfg *web.Config, handlers *web.Handlers, lim *limiters) (*gin.Engine, error) {
+	router := newRouter()
+	if err := router.SetTrustedProxies(getTrustedProxies(cfg.Server.TrustedProxies)); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	router.Use(func(c *gin.Context) {
+		c.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+		c.Writer.Header().Set("X-Frame-Options", "DENY")
+		c.Writer.Header().Set("Content-Security-Policy", "default-src 'self'")
+		c.Next()
+	})
 
-	router.POST("/unlock", tollbooth_gin.LimitHandler(authLim), handlers.UnlockPage)
-	router.GET("/unlock", tollbooth_gin.LimitHandler(authLim), handlers.UnlockPage)
-	router.GET("/access", tollbooth_gin.LimitHandler(accessLim), handlers.AccessPage)
+	authLim := tollbooth_gin.LimitHandler(lim.auth)
+	router.POST("/unlock", authLim, handlers.UnlockPage)
+	router.GET("/unlock", authLim, handlers.UnlockPage)
+	router.POST("/unlock/webauthn/begin", authLim, handlers.WebAuthnBegin)
+	router.POST("/unlock/webauthn/finish", authLim, handlers.WebAuthnFinish)
+	router.POST("/unlock/webauthn/register/begin", authLim, handlers.WebAuthnRegisterBegin)
+	router.POST("/unlock/webauthn/register/finish", authLim, handlers.WebAuthnRegisterFinish)
+	router.GET("/unlock/oidc", authLim, handlers.OIDCLogin)
+	router.GET("/unlock/oidc/callback", authLim, handlers.OIDCCallback)
+	router.GET("/access", tollbooth_gin.LimitHandler(lim.access), handlers.AccessPage)
 	router.Static("/css", "web/src/css")
+	router.Static("/js", "web/src/js")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9090"
+	// The dashboard lives on the public router so ADMIN_USERS can reach it
+	// with their normal unlock session.
+	if cfg.DashboardEnabled() {
+		router.GET("/admin", authLim, handlers.AdminDashboard)
+		router.POST("/admin/login", authLim, handlers.AdminLogin)
+		router.POST("/admin/logout", authLim, handlers.AdminLogout)
+		router.POST("/admin/grants/revoke", authLim, handlers.AdminDashboardRevoke)
+		router.POST("/admin/lockouts/clear", authLim, handlers.AdminDashboardUnlock)
 	}
 
-	server := &http.Server{
-		Addr:              ":" + port,
-		ReadHeaderTimeout: 3 * time.Second,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       60 * time.Second,
-		Handler:           router,
+	// The admin API is only mounted when ADMIN_TOKEN is set.
+	if cfg.Admin.Addr == "" && cfg.AdminEnabled() {
+		registerAdminRoutes(router, handlers, lim.admin)
+	}
+	if cfg.Metrics.Addr == "" && cfg.MetricsEnabled() {
+		router.GET("/metrics", gin.WrapH(handlers.MetricsHandler()))
 	}
+	return router, nil
+}
 
-	log.Fatal(server.ListenAndServe())
+func registerAdminRoutes(router gin.IRouter, handlers *web.Handlers, adminLim *limiter.Limiter) {
+	admin := router.Group("/admin/api", tollbooth_gin.LimitHandler(adminLim), handlers.AdminAuth)
+	admin.GET("/grants", handlers.AdminListGrants)
+	admin.GET("/grants/:ip", handlers.AdminGetGrant)
+	admin.DELETE("/grants/:ip", handlers.AdminRevokeGrant)
+	admin.POST("/grants/:ip/extend", handlers.AdminExtendGrant)
+	admin.DELETE("/sessions/:fingerprint", handlers.AdminRevokeSession)
+	admin.DELETE("/users/:user/grants", handlers.AdminRevokeUser)
+	admin.GET("/lockouts", handlers.AdminListLockouts)
+	admin.DELETE("/lockouts", handlers.AdminClearLockouts)
+	admin.DELETE("/lockouts/:ip", handlers.AdminClearLockout)
 }
 
 func configureGinMode() {
@@ -98,60 +264,42 @@ func newRouter() *gin.Engine {
 	return router
 }
 
-func safeGinLogFormatter(param gin.LogFormatterParams) string {
-	path := "/"
-	if param.Request != nil && param.Request.URL != nil && param.Request.URL.EscapedPath() != "" {
-		path = param.Request.URL.EscapedPath()
-	}
-
-	// Prefer the real client IP (from CLIENT_IP_HEADER) so logs show the
-	// per-visitor address rather than a Railway edge / proxy. Falls back to
-	// Gin's computed ClientIP (which may be the direct peer when the header
-	// is absent or invalid). The same preference+validation logic lives in
-	// web.RealClientIP and is used by the unlock/access handlers.
-	clientIP := param.ClientIP
-	if param.Request != nil {
-		hdr := os.Getenv("CLIENT_IP_HEADER")
-		if hdr == "" {
-			hdr = "X-Gateway-Client-IP"
+// safeGinLogFormatter returns a Gin log formatter that drops query strings
+// and logs the client IP read from clientIPHeader (cfg.Server.ClientIPHeader).
+func safeGinLogFormatter(clientIPHeader string) gin.LogFormatter {
+	return func(param gin.LogFormatterParams) string {
+		path := "/"
+		if param.Request != nil && param.Request.URL != nil && param.Request.URL.EscapedPath() != "" {
+			path = param.Request.URL.EscapedPath()
 		}
-		if real := web.RealClientIP(param.Request, hdr); real != "" {
+
+		// Prefer the real client IP (from the configured header) so logs show
+		// the per-visitor address rather than a Railway edge / proxy. Falls
+		// back to Gin's computed ClientIP (which may be the direct peer when
+		// the header is absent or invalid). The same preference+validation
+		// logic lives in web.RealClientIP and is used by the unlock/access
+		// handlers.
+		clientIP := param.ClientIP
+		if real := web.RealClientIP(param.Request, clientIPHeader); real != "" {
 			clientIP = real
 		}
-	}
-
-	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %q\n",
-		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-		param.StatusCode,
-		param.Latency,
-		clientIP,
-		param.Method,
-		path,
-	)
-}
 
-func getTrustedProxies() []string {
-	proxies := os.Getenv("TRUSTED_PROXIES")
-	if proxies == "" {
-		return append([]string(nil), defaultTrustedProxies...)
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %q\n",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			clientIP,
+			param.Method,
+			path,
+		)
 	}
-	var valid []string
-	for _, p := range strings.Split(proxies, ",") {
-		p = strings.TrimSpace(p)
-		if isTrustedProxyValue(p) {
-			valid = append(valid, p)
-		} else {
-			log.Printf("Ignoring invalid trusted proxy value: %q", p)
-		}
-	}
-	return valid
 }
 
-func isTrustedProxyValue(proxy string) bool {
-	if net.ParseIP(proxy) != nil {
-		return true
+// getTrustedProxies returns the configured TRUSTED_PROXIES (already
+// validated), or the defaults if there are none.
+func getTrustedProxies(configured []string) []string {
+	if len(configured) == 0 {
+		return append([]string(nil), defaultTrustedProxies...)
 	}
-
-	_, _, err := net.ParseCIDR(proxy)
-	return err == nil
+	return configured
 }
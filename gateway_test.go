@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"gateway/web"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func TestSafeGinLogFormatterDropsQuery(t *testing.T) {
 	request := httptest.NewRequest("GET", "/access?access_token=secret-token", nil)
-	output := safeGinLogFormatter(gin.LogFormatterParams{
+	output := safeGinLogFormatter("X-Gateway-Client-IP")(gin.LogFormatterParams{
 		Request: request,
 		Method:  request.Method,
 		Path:    request.URL.RequestURI(),
@@ -30,9 +36,12 @@ func TestSafeGinLogFormatterUsesClientIPHeader(t *testing.T) {
 	// internally for grants and access checks).
 	req := httptest.NewRequest("GET", "/access", nil)
 	req.RemoteAddr = "79.127.178.82:54321" // the edge we do NOT want to log
-	req.Header.Set("X-Gateway-Client-IP", "203.0.113.77")
+	req.Header.Set("X-Real-Client", "203.0.113.77")
+	req.Header.Set("X-Gateway-Client-IP", "198.51.100.9")
+	// The configured header wins; the environment is not consulted.
+	t.Setenv("CLIENT_IP_HEADER", "X-Gateway-Client-IP")
 
-	output := safeGinLogFormatter(gin.LogFormatterParams{
+	output := safeGinLogFormatter("X-Real-Client")(gin.LogFormatterParams{
 		Request:  req,
 		Method:   req.Method,
 		Path:     req.URL.RequestURI(),
@@ -42,30 +51,23 @@ func TestSafeGinLogFormatterUsesClientIPHeader(t *testing.T) {
 	if !strings.Contains(output, "203.0.113.77") {
 		t.Fatalf("expected real client IP from header in log, got %q", output)
 	}
-	if strings.Contains(output, "79.127.178.82") {
-		t.Fatalf("did not expect edge IP to appear in log output, got %q", output)
+	if strings.Contains(output, "79.127.178.82") || strings.Contains(output, "198.51.100.9") {
+		t.Fatalf("did not expect the edge IP or an unconfigured header in log output, got %q", output)
 	}
 	if !strings.Contains(output, `"/access"`) {
 		t.Fatalf("expected path to remain in log output, got %q", output)
 	}
 }
 
-func TestGetTrustedProxiesAcceptsIPsAndCIDRs(t *testing.T) {
-	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 100.64.0.0/10, invalid")
-
-	proxies := getTrustedProxies()
-	if len(proxies) != 2 {
-		t.Fatalf("expected two valid trusted proxies, got %#v", proxies)
-	}
-	if proxies[0] != "10.0.0.1" || proxies[1] != "100.64.0.0/10" {
+func TestGetTrustedProxiesUsesConfigured(t *testing.T) {
+	proxies := getTrustedProxies([]string{"10.0.0.1", "100.64.0.0/10"})
+	if len(proxies) != 2 || proxies[0] != "10.0.0.1" || proxies[1] != "100.64.0.0/10" {
 		t.Fatalf("unexpected trusted proxies: %#v", proxies)
 	}
 }
 
 func TestGetTrustedProxiesDefaultsToPrivateRanges(t *testing.T) {
-	t.Setenv("TRUSTED_PROXIES", "")
-
-	proxies := getTrustedProxies()
+	proxies := getTrustedProxies(nil)
 	if len(proxies) == 0 {
 		t.Fatal("expected default trusted proxy ranges")
 	}
@@ -73,3 +75,88 @@ func TestGetTrustedProxiesDefaultsToPrivateRanges(t *testing.T) {
 		t.Fatalf("unexpected first default proxy range: %#v", proxies)
 	}
 }
+
+func newTestServeHandlers(t *testing.T) (*web.Handlers, string) {
+	t.Helper()
+
+	persistFile := filepath.Join(t.TempDir(), "granted.json")
+	t.Setenv("PERSIST_FILE", persistFile)
+	t.Setenv("GATEWAY_PASSWORD", "test-password")
+	cfg, err := web.LoadConfig("")
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return web.SetupHandlers(cfg), persistFile
+}
+
+func TestRunServersShutsDownOnSignal(t *testing.T) {
+	handlers, persistFile := newTestServeHandlers(t)
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if code := runServers(ctx, []*http.Server{server}, handlers); code != 0 {
+		t.Fatalf("expected a clean exit, got %d", code)
+	}
+	if _, err := os.Stat(persistFile); err != nil {
+		t.Fatalf("expected the persist file written on shutdown: %v", err)
+	}
+}
+
+func TestRunServersFailsWhenListenerFails(t *testing.T) {
+	handlers, _ := newTestServeHandlers(t)
+	server := &http.Server{Addr: "127.0.0.1:-1", Handler: http.NotFoundHandler()}
+
+	if code := runServers(context.Background(), []*http.Server{server}, handlers); code != 1 {
+		t.Fatalf("expected a failed listener to exit 1, got %d", code)
+	}
+}
+
+func TestReloaderSwapsRouterAndKeepsBadConfigOut(t *testing.T) {
+	handlers, _ := newTestServeHandlers(t)
+	defer handlers.Close()
+	configFile := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(configFile, []byte("metrics:\n  token: scrape-token\n"), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := web.LoadConfig("")
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	lim := newLimiters(handlers)
+	router, err := newGatewayRouter(cfg, handlers, lim)
+	if err != nil {
+		t.Fatalf("build router: %v", err)
+	}
+	routes := &routerSwitch{}
+	routes.set(router)
+	r := &reloader{path: configFile, cfg: cfg, handlers: handlers, limiters: lim, routes: routes}
+
+	scrape := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer scrape-token")
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := scrape(); code != http.StatusNotFound {
+		t.Fatalf("expected no /metrics route before the reload, got %d", code)
+	}
+	if !r.reload() {
+		t.Fatal("expected the reload to apply")
+	}
+	if code := scrape(); code != http.StatusOK {
+		t.Fatalf("expected /metrics after reloading METRICS_TOKEN, got %d", code)
+	}
+
+	if err := os.WriteFile(configFile, []byte("lockout:\n  max_failures: 0\n"), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if r.reload() {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	if code := scrape(); code != http.StatusOK {
+		t.Fatalf("expected the previous router kept after a failed reload, got %d", code)
+	}
+}
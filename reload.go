@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gateway/web"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routerSwitch serves through whichever router was set last, so a reload can
+// swap in a rebuilt router without touching the listener. Requests already
+// inside the old router finish there.
+type routerSwitch struct {
+	current atomic.Pointer[gin.Engine]
+}
+
+func (s *routerSwitch) set(router *gin.Engine) {
+	s.current.Store(router)
+}
+
+func (s *routerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().ServeHTTP(w, r)
+}
+
+// reloader re-reads the configuration on SIGHUP, and when
+// CONFIG_POLL_SECONDS is set, whenever the config file, users file or a
+// secret file changes.
+type reloader struct {
+	path     string      // CONFIG_FILE; "" for environment only
+	cfg      *web.Config // the settings in effect
+	handlers *web.Handlers
+	limiters *limiters
+	routes   *routerSwitch
+}
+
+// run reloads until ctx is done.
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if secs := r.cfg.Server.ConfigPollSeconds; secs > 0 {
+		ticker := time.NewTicker(time.Duration(secs) * time.Second)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	stamp := r.fileStamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration", "event", "reload")
+			r.reload()
+			stamp = r.fileStamp()
+		case <-poll:
+			if next := r.fileStamp(); next != stamp {
+				stamp = next
+				slog.Info("Configuration files changed, reloading", "event", "reload")
+				r.reload()
+			}
+		}
+	}
+}
+
+// fileStamp summarizes the size and modification time of the watched files;
+// it changes when any of them does.
+func (r *reloader) fileStamp() string {
+	var b strings.Builder
+	for _, path := range append([]string{r.path, r.cfg.Auth.UsersFile}, r.cfg.SecretFiles()...) {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&b, "%s:missing;", path)
+		}
+	}
+	return b.String()
+}
+
+// reload loads the configuration and applies its reloadable settings: the
+// handlers' settings and users file, the router (for TRUSTED_PROXIES and the
+// optional routes) and logging. Grants, lockouts and in-flight requests are
+// kept. If the new configuration is invalid, its password fails the policy or
+// the router or users file can't be rebuilt, nothing changes. It logs what
+// changed and reports whether the reload was applied.
+func (r *reloader) reload() bool {
+	next, err := web.LoadConfig(r.path)
+	if err == nil {
+		err = next.CheckPassword()
+	}
+	if err != nil {
+		slog.Error("Reload failed, keeping the current configuration", "event", "reload", "err", err)
+		return false
+	}
+
+	// Build the router first so a bad one leaves the handlers untouched too;
+	// the new settings and routes then go live together.
+	applied := r.cfg.WithReloadable(next)
+	router, err := newGatewayRouter(applied, r.handlers, r.limiters)
+	if err != nil {
+		slog.Error("Reload failed, keeping the current configuration", "event", "reload", "err", err)
+		return false
+	}
+	if err := r.handlers.Reload(applied); err != nil {
+		slog.Error("Reload failed, keeping the current configuration", "event", "reload", "err", err)
+		return false
+	}
+	r.routes.set(router)
+	web.ConfigureLogging(applied.Log)
+
+	changes := r.cfg.Changes(next)
+	r.cfg = applied
+	for _, c := range changes {
+		if c.Reload {
+			slog.Info("Reloaded setting", "event", "reload", "setting", c.Setting, "from", c.From, "to", c.To)
+		} else {
+			slog.Warn("Setting needs a restart", "event", "reload", "setting", c.Setting, "from", c.From, "to", c.To)
+		}
+	}
+	if len(changes) == 0 {
+		slog.Info("Reloaded configuration, no settings changed", "event", "reload")
+	}
+	return true
+}
@@ -1,10 +1,9 @@
 package web
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -14,48 +13,60 @@ import (
 func (h *Handlers) AccessPage(g *gin.Context) {
 	connectorIP := h.clientIP(g)
 
-	if session, err := g.Cookie(h.cookieName); err == nil {
+	session, err := g.Cookie(h.cookieName)
+	if err != nil {
+		session = ""
+	}
+	h.refreshFromShared(session, connectorIP)
+
+	if session != "" {
 		if authRecord := h.findGrantedBySession(session); authRecord != nil {
 			if h.isExpired(authRecord) {
-				log.Printf("Session for IP %s has expired (authed %v)", authRecord.IP, authRecord.AuthedTime)
+				slog.Info("Session expired", "event", "access", "ip", connectorIP, "host", g.Request.Host, "decision", "continue", "reason", accessExpired, "grant_ip", authRecord.IP, "session", sessionFingerprint(session))
 				h.clearSessionCookie(g)
 			} else {
+				h.metrics.accessAllowed(accessCookie)
 				g.Status(http.StatusOK)
 				return
 			}
 		}
 	}
 
-	h.grantedLock.Lock()
-	authRecord := h.granted[connectorIP]
-	h.grantedLock.Unlock()
-
-	if authRecord != nil {
+	if authRecord := h.lookupGrant(connectorIP); authRecord != nil {
 		// Check if IP has expired
 		if h.isExpired(authRecord) {
-			log.Printf("IP %s has expired (authed %v)", connectorIP, authRecord.AuthedTime)
-			g.Status(http.StatusUnauthorized)
+			slog.Debug("Access denied", "event", "access", "ip", connectorIP, "host", g.Request.Host, "decision", "deny", "reason", accessExpired)
+			h.metrics.accessDenied(accessExpired)
+			h.denyAccess(g)
 			return
 		}
-		h.setSessionCookie(g, authRecord)
+		// A user's session is only handed to the browser that unlocked as
+		// them; anyone else behind the IP gets in on the IP alone.
+		if authRecord.User == "" {
+			h.setSessionCookie(g, *authRecord)
+		}
+		h.metrics.accessAllowed(accessIPGrant)
 		g.Status(http.StatusOK)
 		return
 	}
 
 	local, record := h.checkLocalIP(connectorIP)
 	if local {
-		h.setSessionCookie(g, record)
+		h.issueSessionCookie(g, connectorIP, accessLocalBypass, record.view())
+		h.metrics.accessAllowed(accessLocalBypass)
 		g.Status(http.StatusOK)
 		return
 	}
 
-	log.Printf("Rejecting access for %s (trying to access %s)", connectorIP, g.Request.Host)
-	g.Status(http.StatusUnauthorized)
+	slog.Debug("Access denied", "event", "access", "ip", connectorIP, "host", g.Request.Host, "decision", "deny", "reason", accessNoGrant)
+	h.events.add("access_denied", connectorIP, "", g.Request.Host)
+	h.metrics.accessDenied(accessNoGrant)
+	h.denyAccess(g)
 }
 
 func (h *Handlers) checkLocalIP(ip string) (bool, *authed) {
-	// Only allow local IP bypass if explicitly enabled via environment variable
-	if os.Getenv("ALLOW_LOCAL_BYPASS") != "true" {
+	// Only allow local IP bypass if explicitly enabled (ALLOW_LOCAL_BYPASS)
+	if !h.live().allowLocalBypass {
 		return false, nil
 	}
 
@@ -65,17 +76,19 @@ func (h *Handlers) checkLocalIP(ip string) (bool, *authed) {
 	}
 	localDigit, err := strconv.Atoi(ipSplit[2])
 	if err != nil {
-		log.Printf("could not read digit, %v", err)
+		slog.Debug("Could not parse IP for local bypass", "ip", ip, "err", err)
 		return false, nil
 	}
 
 	if ipSplit[0] == "192" && ipSplit[1] == "168" && localDigit < 30 {
-		log.Printf("Local IP bypass enabled: adding %s to allowed list", ip)
-		record, err := h.addGranted(ip)
+		slog.Info("Local IP bypass", "event", "grant_added", "ip", ip, "reason", accessLocalBypass)
+		record, err := h.addGranted(ip, "", "")
 		if err != nil {
-			log.Printf("could not create local bypass auth for %s: %v", ip, err)
+			slog.Error("Could not create local bypass grant", "ip", ip, "err", err)
 			return false, nil
 		}
+		h.events.add("local_bypass", ip, "", "")
+		h.audit.add("local_bypass", ip, "", sessionFingerprintOfHash(record.view().SessionHash), "")
 		return true, record
 	}
 	return false, nil
@@ -86,9 +99,26 @@ func (h *Handlers) clearSessionCookie(g *gin.Context) {
 	g.SetCookie(h.cookieName, "", -1, "/", h.cookieDomain, true, true)
 }
 
-func (h *Handlers) setSessionCookie(g *gin.Context, authRecord *authed) {
+// setSessionCookie hands out the grant's session to the browser. Grants loaded
+// from storage only have its hash, so their IP access keeps working without a
+// cookie. It reports whether a cookie was set.
+func (h *Handlers) setSessionCookie(g *gin.Context, authRecord grantView) bool {
+	if authRecord.Session == "" {
+		return false
+	}
 	g.SetSameSite(http.SameSiteLaxMode)
 	g.SetCookie(h.cookieName, authRecord.Session, h.cookieMaxAgeSeconds(), "/", h.cookieDomain, true, true)
+	return true
+}
+
+// issueSessionCookie is setSessionCookie for a grant just created or reused
+// (an unlock or a local bypass), audited with why it was handed out. Access
+// checks against an existing grant don't audit: proxies rarely pass the
+// cookie back, so that would be one record per proxied request.
+func (h *Handlers) issueSessionCookie(g *gin.Context, ip, reason string, authRecord grantView) {
+	if h.setSessionCookie(g, authRecord) {
+		h.audit.add("session_cookie_issued", ip, authRecord.User, sessionFingerprintOfHash(authRecord.SessionHash), reason)
+	}
 }
 
 // RealClientIP returns the per-visitor client IP from the given header name
@@ -120,7 +150,7 @@ func (h *Handlers) clientIP(g *gin.Context) string {
 	}
 	if h.clientIPHeader != "" {
 		if v := strings.TrimSpace(g.GetHeader(h.clientIPHeader)); v != "" {
-			log.Printf("Ignoring invalid %s header %q from %v", h.clientIPHeader, v, g.ClientIP())
+			slog.Warn("Ignoring invalid client IP header", "header", h.clientIPHeader, "value", v, "peer", g.ClientIP())
 		}
 	}
 	return g.ClientIP()
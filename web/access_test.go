@@ -1,13 +1,18 @@
 package web
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,11 +32,12 @@ func TestAccessPageSetsSessionCookieForAuthorizedIP(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers()
-	h.granted["203.0.113.10"] = &authed{
-		IP:         "203.0.113.10",
-		AuthedTime: time.Now(),
-		Session:    "session-token",
-	}
+	putTestGrant(&h, &authed{
+		IP:          "203.0.113.10",
+		AuthedTime:  time.Now(),
+		Session:     "session-token",
+		SessionHash: hashSession("session-token"),
+	})
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -54,11 +60,12 @@ func TestAccessPageDoesNotSetSessionCookieForExistingValidSession(t *testing.T)
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers()
-	h.granted["203.0.113.10"] = &authed{
-		IP:         "203.0.113.10",
-		AuthedTime: time.Now(),
-		Session:    "session-token",
-	}
+	putTestGrant(&h, &authed{
+		IP:          "203.0.113.10",
+		AuthedTime:  time.Now(),
+		Session:     "session-token",
+		SessionHash: hashSession("session-token"),
+	})
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -100,7 +107,7 @@ func TestAddGrantedReusesExistingSessionForIP(t *testing.T) {
 	h := newTestHandlers()
 	h.persistFile = filepath.Join(t.TempDir(), "missing", "granted.json")
 
-	first, err := h.addGranted("203.0.113.10")
+	first, err := h.addGranted("203.0.113.10", "", "")
 	if err != nil {
 		t.Fatalf("first addGranted failed: %v", err)
 	}
@@ -109,7 +116,7 @@ func TestAddGrantedReusesExistingSessionForIP(t *testing.T) {
 
 	time.Sleep(time.Millisecond)
 
-	second, err := h.addGranted("203.0.113.10")
+	second, err := h.addGranted("203.0.113.10", "", "")
 	if err != nil {
 		t.Fatalf("second addGranted failed: %v", err)
 	}
@@ -128,6 +135,49 @@ func TestAddGrantedReusesExistingSessionForIP(t *testing.T) {
 	}
 }
 
+func TestUnlockAfterReloadIssuesNewSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	persistFile := filepath.Join(t.TempDir(), "granted.json")
+	h := newTestHandlers()
+	h.settings.unlockPasswd = testPassword
+	h.persistFile = persistFile
+	if _, err := h.addGranted("203.0.113.10", "", ""); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if err := h.saveGranted(); err != nil {
+		t.Fatalf("save grants: %v", err)
+	}
+
+	// After a restart only the session's hash is known.
+	restarted := newTestHandlers()
+	restarted.settings.unlockPasswd = testPassword
+	restarted.persistFile = persistFile
+	restarted.loadGranted()
+	oldHash := findTestGrant(&restarted, "203.0.113.10").SessionHash
+
+	status, w := postUnlock(&restarted, "203.0.113.10", testPassword)
+	session := sessionCookie(w, "gateway_session")
+	if status != http.StatusOK || session == "" {
+		t.Fatalf("expected the unlock to set a session cookie, got %d %q", status, w.Header().Get("Set-Cookie"))
+	}
+	if v := restarted.findGrantedBySession(session); v == nil || v.IP != "203.0.113.10" {
+		t.Fatal("expected the new session to match the grant")
+	}
+	if restarted.grantSnapshot().bySession[oldHash] != nil {
+		t.Fatal("expected the old session to be replaced")
+	}
+
+	restarted.writer.close()
+	if err := restarted.saveGranted(); err != nil {
+		t.Fatalf("save grants: %v", err)
+	}
+	persisted, err := readPersisted(persistFile, nil)
+	if err != nil || len(persisted) != 1 || persisted[0].SessionHash != hashSession(session) {
+		t.Fatalf("expected the new session's hash to be persisted, got %#v (%v)", persisted, err)
+	}
+}
+
 func TestLoadGrantedDedupesByIPAndPreservesFirstSession(t *testing.T) {
 	now := time.Now().UTC().Truncate(time.Second)
 	firstAuthedAt := now.Add(-2 * time.Hour)
@@ -181,8 +231,8 @@ func TestLoadGrantedDedupesByIPAndPreservesFirstSession(t *testing.T) {
 	if deduped == nil {
 		t.Fatal("expected deduped grant for 203.0.113.10")
 	}
-	if deduped.Session != "first-session" {
-		t.Fatalf("expected first session to be preserved, got %q", deduped.Session)
+	if deduped.SessionHash != hashSession("first-session") {
+		t.Fatalf("expected first session to be preserved, got %q", deduped.SessionHash)
 	}
 	if !deduped.AuthedTime.Equal(secondAuthedAt) {
 		t.Fatalf("expected newest auth time to be retained, got %v", deduped.AuthedTime)
@@ -192,18 +242,20 @@ func TestLoadGrantedDedupesByIPAndPreservesFirstSession(t *testing.T) {
 	if err != nil {
 		t.Fatalf("read cleaned persist file: %v", err)
 	}
-	var saved []persistedAuthed
+	var saved persistEnvelope
 	if err := json.Unmarshal(savedData, &saved); err != nil {
 		t.Fatalf("unmarshal cleaned persist file: %v", err)
 	}
-	if len(saved) != 2 {
-		t.Fatalf("expected cleaned persist file to have two records, got %d", len(saved))
+	if len(saved.Grants) != 2 {
+		t.Fatalf("expected cleaned persist file to have two records, got %d", len(saved.Grants))
+	}
+	var rawSaved struct {
+		Grants []map[string]interface{} `json:"grants"`
 	}
-	var rawSaved []map[string]interface{}
 	if err := json.Unmarshal(savedData, &rawSaved); err != nil {
 		t.Fatalf("unmarshal raw cleaned persist file: %v", err)
 	}
-	for _, record := range rawSaved {
+	for _, record := range rawSaved.Grants {
 		for _, removedField := range []string{"last_access", "domains_accessed", "requests"} {
 			if _, ok := record[removedField]; ok {
 				t.Fatalf("expected saved record to omit %q, got %#v", removedField, record)
@@ -216,11 +268,12 @@ func TestAccessPagePrefersClientIPHeader(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers()
-	h.granted["203.0.113.50"] = &authed{
-		IP:         "203.0.113.50",
-		AuthedTime: time.Now(),
-		Session:    "session-token",
-	}
+	putTestGrant(&h, &authed{
+		IP:          "203.0.113.50",
+		AuthedTime:  time.Now(),
+		Session:     "session-token",
+		SessionHash: hashSession("session-token"),
+	})
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -241,11 +294,12 @@ func TestAccessPageClientIPHeaderOverridesProxyAddr(t *testing.T) {
 	// Regression guard for the core bug: a stranger sharing the granted
 	// proxy/PoP address must NOT be authorized off that shared address.
 	h := newTestHandlers()
-	h.granted["198.51.100.1"] = &authed{
-		IP:         "198.51.100.1",
-		AuthedTime: time.Now(),
-		Session:    "session-token",
-	}
+	putTestGrant(&h, &authed{
+		IP:          "198.51.100.1",
+		AuthedTime:  time.Now(),
+		Session:     "session-token",
+		SessionHash: hashSession("session-token"),
+	})
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -271,13 +325,266 @@ func findTestGrant(h *Handlers, ip string) *authed {
 
 func newTestHandlers() Handlers {
 	return Handlers{
-		Templates:        template.Must(template.New("unlock").Parse("unlock")),
-		expirationDays:   30,
-		cookieName:       "gateway_session",
-		clientIPHeader:   "X-Gateway-Client-IP",
-		granted:          make(map[string]*authed),
-		loginAttempts:    make(map[string]*loginAttempt),
-		maxLoginFailures: 3,
-		lockoutDuration:  time.Minute,
+		Templates:      template.Must(template.New("unlock").Parse("unlock")),
+		expirationDays: 30,
+		cookieName:     "gateway_session",
+		clientIPHeader: "X-Gateway-Client-IP",
+		granted:        make(map[string]*authed),
+		loginAttempts:  make(map[string]*loginAttempt),
+		settings:       liveSettings{maxLoginFailures: 3, lockoutDuration: time.Minute},
 	}
 }
+
+func TestAccessPageMatchesStoredSessionHash(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Loaded from storage: only the hash is known.
+	h := newTestHandlers()
+	putTestGrant(&h, &authed{IP: "203.0.113.10", AuthedTime: time.Now(), SessionHash: hashSession("session-token")})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.RemoteAddr = "203.0.113.10:12345"
+	h.AccessPage(c)
+	if c.Writer.Status() != http.StatusOK || w.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("expected IP access without a cookie, got %d %q", c.Writer.Status(), w.Header().Get("Set-Cookie"))
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.RemoteAddr = "198.51.100.20:12345"
+	c.Request.AddCookie(&http.Cookie{Name: "gateway_session", Value: "session-token"})
+	h.AccessPage(c)
+	if c.Writer.Status() != http.StatusOK {
+		t.Fatalf("expected the existing cookie to match the stored hash, got %d", c.Writer.Status())
+	}
+}
+
+func putTestGrant(h *Handlers, a *authed) {
+	h.grantedLock.Lock()
+	defer h.grantedLock.Unlock()
+	h.putGrantedLocked(a)
+	h.publishGrantsLocked()
+}
+
+func TestSessionIndexFollowsGrants(t *testing.T) {
+	h := newTestHandlers()
+
+	first, err := h.addGranted("203.0.113.10", "", "")
+	if err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if v := h.findGrantedBySession(first.Session); v == nil || v.IP != "203.0.113.10" {
+		t.Fatal("expected a new grant to be indexed")
+	}
+
+	// Replacing the IP's grant drops the old session.
+	replacement, _ := newAuthed("203.0.113.10", "", time.Now())
+	putTestGrant(&h, replacement)
+	if v := h.findGrantedBySession(replacement.Session); h.findGrantedBySession(first.Session) != nil || v == nil || v.SessionHash != replacement.SessionHash {
+		t.Fatal("expected the index to follow the replacement")
+	}
+
+	h.revokeGrants(func(a *authed) bool { return a.IP == "203.0.113.10" })
+	if h.findGrantedBySession(replacement.Session) != nil || len(h.grantSnapshot().bySession) != 0 {
+		t.Fatal("expected revocation to clear the index")
+	}
+
+	expired, _ := newAuthed("203.0.113.11", "", time.Now().Add(-40*24*time.Hour))
+	putTestGrant(&h, expired)
+	h.grantedLock.Lock()
+	h.compactGrantedLocked(time.Now())
+	h.publishGrantsLocked()
+	h.grantedLock.Unlock()
+	if h.findGrantedBySession(expired.Session) != nil || len(h.grantSnapshot().bySession) != 0 {
+		t.Fatal("expected expiry to clear the index")
+	}
+}
+
+func TestPublishGrantsUpdatesOnlyChangedEntries(t *testing.T) {
+	h := newTestHandlers()
+
+	kept, _ := newAuthed("203.0.113.20", "", time.Now())
+	putTestGrant(&h, kept)
+	edited, _ := newAuthed("203.0.113.21", "", time.Now().Add(-time.Hour))
+	putTestGrant(&h, edited)
+	before := h.grantSnapshot()
+
+	now := time.Now()
+	h.grantedLock.Lock()
+	refreshAuthRecord(edited, now)
+	h.markGrantLocked(edited.IP)
+	h.publishGrantsLocked()
+	h.grantedLock.Unlock()
+
+	after := h.grantSnapshot()
+	if after.byKey[kept.key()] != before.byKey[kept.key()] || after.bySession[kept.SessionHash] != before.bySession[kept.SessionHash] {
+		t.Fatal("expected an unchanged grant's entries to be carried over")
+	}
+	if v := h.lookupGrant(edited.IP); v == nil || !v.AuthedTime.Equal(now) || h.findGrantedBySession(edited.Session) != v {
+		t.Fatal("expected the edited grant's entries to be updated")
+	}
+	if v := before.byKey[edited.key()]; v.AuthedTime.Equal(now) {
+		t.Fatal("expected the previous snapshot to be left alone")
+	}
+}
+
+// benchmarkGrants fills h with n grants and returns the session of one of
+// them.
+func benchmarkGrants(b *testing.B, n int) (*Handlers, string) {
+	b.Helper()
+
+	h := newTestHandlers()
+	var session string
+	h.grantedLock.Lock()
+	for i := 0; i < n; i++ {
+		a, err := newAuthed(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff), "", time.Now())
+		if err != nil {
+			b.Fatalf("new grant: %v", err)
+		}
+		h.putGrantedLocked(a)
+		if i == n/2 {
+			session = a.Session
+		}
+	}
+	h.publishGrantsLocked()
+	h.grantedLock.Unlock()
+	return &h, session
+}
+
+func BenchmarkFindGrantedBySession10k(b *testing.B) {
+	h, session := benchmarkGrants(b, 10000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if h.findGrantedBySession(session) == nil {
+			b.Fatal("expected a match")
+		}
+	}
+}
+
+// BenchmarkFindGrantedBySessionScan10k is the lookup before the index: copy
+// every grant and constant-time compare each one.
+func BenchmarkFindGrantedBySessionScan10k(b *testing.B) {
+	h, session := benchmarkGrants(b, 10000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		hash := hashSession(session)
+		h.grantedLock.Lock()
+		copied := make([]*authed, 0, len(h.granted))
+		for _, a := range h.granted {
+			copied = append(copied, a)
+		}
+		h.grantedLock.Unlock()
+
+		var found *authed
+		for _, a := range copied {
+			a.recordEditLock.Lock()
+			matches := subtle.ConstantTimeCompare([]byte(a.SessionHash), []byte(hash)) == 1
+			a.recordEditLock.Unlock()
+			if matches {
+				found = a
+			}
+		}
+		if found == nil {
+			b.Fatal("expected a match")
+		}
+	}
+}
+
+// nopStore discards writes, so benchmarks measure the grant maps rather than
+// the disk.
+type nopStore struct{}
+
+func (nopStore) loadGrants() ([]persistedAuthed, error)        { return nil, nil }
+func (nopStore) putGrant(persistedAuthed) error                { return nil }
+func (nopStore) deleteGrant(string) error                      { return nil }
+func (nopStore) applyGrants([]persistedAuthed, []string) error { return nil }
+func (nopStore) replaceGrants([]persistedAuthed) error         { return nil }
+func (nopStore) loadLockouts() ([]persistedLockout, error)     { return nil, nil }
+func (nopStore) putLockout(persistedLockout) error             { return nil }
+func (nopStore) deleteLockout(string) error                    { return nil }
+func (nopStore) close() error                                  { return nil }
+
+// benchmarkMixedLoad runs check in parallel against 10k grants while a
+// background goroutine keeps unlocking fresh IPs, the way forward-auth checks
+// interleave with unlocks in production. Only the checks are counted.
+func benchmarkMixedLoad(b *testing.B, check func(h *Handlers, ip string)) {
+	h, _ := benchmarkGrants(b, 10000)
+	h.store = nopStore{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := h.addGranted(fmt.Sprintf("172.16.%d.%d", n>>8&0xff, n&0xff), "", ""); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			check(h, fmt.Sprintf("10.0.%d.%d", i>>8&0x1f, i&0xff))
+		}
+	})
+}
+
+func BenchmarkAccessPageParallelMixed(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	benchmarkMixedLoad(b, func(h *Handlers, ip string) {
+		if testAccess(h, ip) != http.StatusOK {
+			b.Error("expected access")
+		}
+	})
+}
+
+// BenchmarkGrantCheckParallelMixed and BenchmarkGrantCheckParallelMixedLocked
+// compare the /access grant check itself: the snapshot read against the
+// grantedLock + recordEditLock read it replaced.
+func BenchmarkGrantCheckParallelMixed(b *testing.B) {
+	benchmarkMixedLoad(b, func(h *Handlers, ip string) {
+		if a := h.lookupGrant(ip); a == nil || h.isExpired(a) {
+			b.Error("expected a grant")
+		}
+	})
+}
+
+func BenchmarkGrantCheckParallelMixedLocked(b *testing.B) {
+	benchmarkMixedLoad(b, func(h *Handlers, ip string) {
+		h.grantedLock.Lock()
+		a := h.granted[ip]
+		h.grantedLock.Unlock()
+		if a == nil {
+			b.Error("expected a grant")
+			return
+		}
+		a.recordEditLock.Lock()
+		authedTime := a.AuthedTime
+		a.recordEditLock.Unlock()
+		if time.Since(authedTime) > h.expirationDuration() {
+			b.Error("expected an unexpired grant")
+		}
+	})
+}
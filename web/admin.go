@@ -0,0 +1,264 @@
+package web
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minAdminTokenLength keeps ADMIN_TOKEN out of guessing range: without
+// ADMIN_ADDR the admin API is reachable through the public listener.
+const minAdminTokenLength = 32
+
+// adminGrant is the admin API view of a grant. The session token itself is
+// never returned, only a short fingerprint that can be used to revoke it.
+type adminGrant struct {
+	IP                 string    `json:"ip"`
+	User               string    `json:"user,omitempty"`
+	AuthedTime         time.Time `json:"authed_time"`
+	AgeSeconds         int64     `json:"age_seconds"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	SessionFingerprint string    `json:"session_fingerprint"`
+	PasswordGeneration string    `json:"password_generation,omitempty"`
+}
+
+type adminLockout struct {
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// sessionFingerprint identifies a session without revealing it.
+func sessionFingerprint(session string) string {
+	return sessionFingerprintOfHash(hashSession(session))
+}
+
+// sessionFingerprintOfHash is sessionFingerprint for a stored session hash.
+func sessionFingerprintOfHash(hash string) string {
+	if len(hash) < 16 {
+		return hash
+	}
+	return hash[:16]
+}
+
+// AdminAuth requires "Authorization: Bearer <ADMIN_TOKEN>".
+func (h *Handlers) AdminAuth(g *gin.Context) {
+	token, ok := strings.CutPrefix(g.GetHeader("Authorization"), "Bearer ")
+	adminToken := h.live().adminToken
+	if !ok || adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		slog.Warn("Rejecting admin request", "event", "admin_api", "ip", h.clientIP(g), "decision", "deny", "reason", "bad_token")
+		g.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	g.Next()
+}
+
+func (h *Handlers) adminView(a *authed, now time.Time) adminGrant {
+	p := snapshotPersisted(a)
+	return adminGrant{
+		IP:                 p.IP,
+		User:               p.User,
+		AuthedTime:         p.AuthedTime,
+		AgeSeconds:         int64(now.Sub(p.AuthedTime).Seconds()),
+		ExpiresAt:          p.AuthedTime.Add(h.expirationDuration()),
+		SessionFingerprint: sessionFingerprintOfHash(p.SessionHash),
+		PasswordGeneration: p.Generation,
+	}
+}
+
+// AdminListGrants returns every unexpired grant, oldest first, including ones
+// other replicas made with a shared store.
+func (h *Handlers) AdminListGrants(g *gin.Context) {
+	h.refreshAllFromShared()
+	now := time.Now()
+
+	h.grantedLock.Lock()
+	grants := make([]adminGrant, 0, len(h.granted))
+	for _, a := range h.granted {
+		if !h.recordExpiredAt(a, now) {
+			grants = append(grants, h.adminView(a, now))
+		}
+	}
+	h.grantedLock.Unlock()
+
+	sort.Slice(grants, func(i, j int) bool { return grants[i].AuthedTime.Before(grants[j].AuthedTime) })
+	g.JSON(http.StatusOK, grants)
+}
+
+// AdminGetGrant returns the grant for one IP: the shared password's, or the
+// one of the user named by ?user=.
+func (h *Handlers) AdminGetGrant(g *gin.Context) {
+	h.grantedLock.Lock()
+	a := h.granted[grantKey(g.Param("ip"), g.Query("user"))]
+	h.grantedLock.Unlock()
+
+	if a == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+	g.JSON(http.StatusOK, h.adminView(a, time.Now()))
+}
+
+// AdminRevokeGrant removes every grant on one IP. Their session cookies stop
+// working immediately.
+func (h *Handlers) AdminRevokeGrant(g *gin.Context) {
+	ip := g.Param("ip")
+	removed := h.revokeGrants(func(a *authed) bool { return a.IP == ip })
+	h.finishRevoke(g, removed, "IP "+ip)
+}
+
+// AdminRevokeSession removes the grant whose session has the given
+// fingerprint, leaving other users' grants on its IP alone.
+func (h *Handlers) AdminRevokeSession(g *gin.Context) {
+	fp := g.Param("fingerprint")
+	removed := h.revokeGrants(func(a *authed) bool {
+		return subtle.ConstantTimeCompare([]byte(sessionFingerprintOfHash(a.SessionHash)), []byte(fp)) == 1
+	})
+	h.finishRevoke(g, removed, "session "+fp)
+}
+
+// AdminRevokeUser removes every grant attributed to a user and ends their user
+// sessions.
+func (h *Handlers) AdminRevokeUser(g *gin.Context) {
+	user := g.Param("user")
+	h.endUserSessions(user)
+	removed := h.revokeGrants(func(a *authed) bool { return a.User == user })
+	h.finishRevoke(g, removed, "user "+user)
+}
+
+func (h *Handlers) finishRevoke(g *gin.Context, removed []persistedAuthed, what string) {
+	if len(removed) == 0 {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ips := grantIPs(removed)
+	slog.Info("Admin revoked grants", "event", "admin_revoked", "target", what, "ips", ips)
+	for _, p := range removed {
+		h.events.add("revoked", p.IP, p.User, "via admin API")
+		h.audit.add("admin_revoked", p.IP, p.User, sessionFingerprintOfHash(p.SessionHash), "via admin API: "+what)
+		h.syncGrant(p.key())
+	}
+	g.JSON(http.StatusOK, gin.H{"revoked": ips})
+}
+
+// revokeGrants deletes every grant matching and returns them, sorted by IP
+// and user.
+func (h *Handlers) revokeGrants(match func(*authed) bool) []persistedAuthed {
+	h.grantedLock.Lock()
+	defer h.grantedLock.Unlock()
+	defer h.publishGrantsLocked()
+
+	var removed []persistedAuthed
+	for key, a := range h.granted {
+		a.recordEditLock.Lock()
+		hit := match(a)
+		a.recordEditLock.Unlock()
+		if hit {
+			removed = append(removed, snapshotPersisted(a))
+			h.deleteGrantedLocked(key)
+		}
+	}
+	sortPersisted(removed)
+	return removed
+}
+
+// grantIPs lists the IPs of grants sorted by IP, once each.
+func grantIPs(grants []persistedAuthed) []string {
+	ips := make([]string, 0, len(grants))
+	for _, p := range grants {
+		if len(ips) == 0 || ips[len(ips)-1] != p.IP {
+			ips = append(ips, p.IP)
+		}
+	}
+	return ips
+}
+
+// AdminExtendGrant renews a grant (selected as in AdminGetGrant) for a full
+// expiration period from now, keeping its session.
+func (h *Handlers) AdminExtendGrant(g *gin.Context) {
+	now := time.Now()
+	key := grantKey(g.Param("ip"), g.Query("user"))
+
+	h.grantedLock.Lock()
+	a := h.granted[key]
+	if a != nil {
+		refreshAuthRecord(a, now)
+		h.markGrantLocked(key)
+		h.publishGrantsLocked()
+	}
+	h.grantedLock.Unlock()
+
+	if a == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Admin extended grant", "event", "admin_extended", "ip", a.IP, "user", a.User)
+	h.audit.add("admin_extended", a.IP, a.User, "", "via admin API")
+	h.syncGrant(key)
+	g.JSON(http.StatusOK, h.adminView(a, now))
+}
+
+// AdminListLockouts returns the IPs with recorded failed unlocks, on any
+// replica with a shared store.
+func (h *Handlers) AdminListLockouts(g *gin.Context) {
+	h.refreshAllFromShared()
+	h.loginLock.Lock()
+	lockouts := make([]adminLockout, 0, len(h.loginAttempts))
+	for ip, a := range h.loginAttempts {
+		lockouts = append(lockouts, adminLockout{IP: ip, Failures: a.failures, LockedUntil: a.lockedUntil, LastSeen: a.lastSeen})
+	}
+	h.loginLock.Unlock()
+
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].IP < lockouts[j].IP })
+	g.JSON(http.StatusOK, lockouts)
+}
+
+// AdminClearLockout forgets failures and any lockout for one IP.
+func (h *Handlers) AdminClearLockout(g *gin.Context) {
+	ip := g.Param("ip")
+	h.refreshLockoutFromShared(ip)
+
+	h.loginLock.Lock()
+	_, found := h.loginAttempts[ip]
+	h.loginLock.Unlock()
+
+	if !found {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	h.clearLoginAttempts(ip)
+	slog.Info("Admin cleared lockout", "event", "admin_lockout_cleared", "ip", ip)
+	h.audit.add("admin_lockout_cleared", ip, "", "", "via admin API")
+	g.Status(http.StatusNoContent)
+}
+
+// AdminClearLockouts forgets every failure and lockout. With a shared store
+// that includes the ones other replicas recorded.
+func (h *Handlers) AdminClearLockouts(g *gin.Context) {
+	h.refreshAllFromShared()
+	h.loginLock.Lock()
+	ips := make([]string, 0, len(h.loginAttempts))
+	for ip := range h.loginAttempts {
+		ips = append(ips, ip)
+	}
+	h.loginAttempts = make(map[string]*loginAttempt)
+	h.loginLock.Unlock()
+
+	for _, ip := range ips {
+		h.syncLockout(ip)
+	}
+	n := len(ips)
+
+	slog.Info("Admin cleared all lockouts", "event", "admin_lockout_cleared", "count", n)
+	h.audit.add("admin_lockout_cleared", "", "", "", "all via admin API")
+	g.Status(http.StatusNoContent)
+}
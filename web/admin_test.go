@@ -0,0 +1,181 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testAdminToken = "admin-token"
+
+func newTestAdminRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	admin := r.Group("/admin/api", h.AdminAuth)
+	admin.GET("/grants", h.AdminListGrants)
+	admin.GET("/grants/:ip", h.AdminGetGrant)
+	admin.DELETE("/grants/:ip", h.AdminRevokeGrant)
+	admin.POST("/grants/:ip/extend", h.AdminExtendGrant)
+	admin.DELETE("/sessions/:fingerprint", h.AdminRevokeSession)
+	admin.DELETE("/users/:user/grants", h.AdminRevokeUser)
+	admin.GET("/lockouts", h.AdminListLockouts)
+	admin.DELETE("/lockouts/:ip", h.AdminClearLockout)
+	return r
+}
+
+func adminRequest(r *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newTestAdminHandlers(t *testing.T) *Handlers {
+	t.Helper()
+
+	h := newTestHandlers()
+	h.settings.adminToken = testAdminToken
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	now := time.Now()
+	putTestGrant(&h, &authed{IP: "203.0.113.10", AuthedTime: now.Add(-time.Hour), Session: "alice-session", SessionHash: hashSession("alice-session"), User: "alice"})
+	putTestGrant(&h, &authed{IP: "203.0.113.11", AuthedTime: now.Add(-2 * time.Hour), Session: "alice-phone", SessionHash: hashSession("alice-phone"), User: "alice"})
+	putTestGrant(&h, &authed{IP: "203.0.113.12", AuthedTime: now, Session: "bob-session", SessionHash: hashSession("bob-session"), User: "bob"})
+	return &h
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestAdminHandlers(t)
+	r := newTestAdminRouter(h)
+
+	if w := adminRequest(r, http.MethodGet, "/admin/api/grants", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/api/grants", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", w.Code)
+	}
+
+	h.settings.adminToken = ""
+	if w := adminRequest(r, http.MethodGet, "/admin/api/grants", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 when no admin token is configured, got %d", w.Code)
+	}
+}
+
+func TestAdminListGrantsHidesSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestAdminHandlers(t)
+	r := newTestAdminRouter(h)
+
+	w := adminRequest(r, http.MethodGet, "/admin/api/grants", testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var grants []adminGrant
+	if err := json.Unmarshal(w.Body.Bytes(), &grants); err != nil {
+		t.Fatalf("decode grants: %v", err)
+	}
+	if len(grants) != 3 || grants[0].IP != "203.0.113.11" {
+		t.Fatalf("expected three grants oldest first, got %#v", grants)
+	}
+	if grants[0].SessionFingerprint != sessionFingerprint("alice-phone") || grants[0].AgeSeconds < 7199 {
+		t.Fatalf("unexpected grant view %#v", grants[0])
+	}
+	for _, secret := range []string{"alice-session", "alice-phone", "bob-session"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Fatalf("expected raw session %q to be hidden, got %s", secret, w.Body.String())
+		}
+	}
+}
+
+func TestAdminRevokeBySessionUserAndIPPersists(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestAdminHandlers(t)
+	r := newTestAdminRouter(h)
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/api/sessions/"+sessionFingerprint("bob-session"), testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 revoking by session, got %d", w.Code)
+	}
+	if findTestGrant(h, "203.0.113.12") != nil {
+		t.Fatal("expected bob's grant to be revoked")
+	}
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/api/users/alice/grants", testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 revoking alice, got %d", w.Code)
+	}
+	if len(h.granted) != 0 {
+		t.Fatalf("expected all of alice's grants to be revoked, got %d left", len(h.granted))
+	}
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/api/grants/203.0.113.10", testAdminToken); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 revoking a missing grant, got %d", w.Code)
+	}
+
+	data, err := os.ReadFile(h.persistFile)
+	if err != nil {
+		t.Fatalf("read persist file: %v", err)
+	}
+	var saved persistEnvelope
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved.Grants) != 0 {
+		t.Fatalf("expected revocations to be persisted, got %s (%v)", data, err)
+	}
+}
+
+func TestAdminExtendGrantRenewsExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestAdminHandlers(t)
+	r := newTestAdminRouter(h)
+
+	w := adminRequest(r, http.MethodPost, "/admin/api/grants/203.0.113.11/extend?user=alice", testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var grant adminGrant
+	if err := json.Unmarshal(w.Body.Bytes(), &grant); err != nil {
+		t.Fatalf("decode grant: %v", err)
+	}
+	if time.Until(grant.ExpiresAt) < h.expirationDuration()-time.Minute {
+		t.Fatalf("expected a full expiration period from now, got %v", grant.ExpiresAt)
+	}
+	if findTestGrant(h, "203.0.113.11").Session != "alice-phone" {
+		t.Fatal("expected the session to be kept when extending")
+	}
+}
+
+func TestAdminClearLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestAdminHandlers(t)
+	r := newTestAdminRouter(h)
+	for i := 0; i < h.settings.maxLoginFailures; i++ {
+		h.registerFailedLogin("198.51.100.7", "")
+	}
+	if locked, _ := h.isLockedOut("198.51.100.7"); !locked {
+		t.Fatal("expected the IP to be locked out")
+	}
+
+	w := adminRequest(r, http.MethodGet, "/admin/api/lockouts", testAdminToken)
+	var lockouts []adminLockout
+	if err := json.Unmarshal(w.Body.Bytes(), &lockouts); err != nil || len(lockouts) != 1 || lockouts[0].IP != "198.51.100.7" {
+		t.Fatalf("expected the lockout to be listed, got %s (%v)", w.Body.String(), err)
+	}
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/api/lockouts/198.51.100.7", testAdminToken); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 clearing the lockout, got %d", w.Code)
+	}
+	if locked, _ := h.isLockedOut("198.51.100.7"); locked {
+		t.Fatal("expected the lockout to be cleared")
+	}
+}
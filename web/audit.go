@@ -0,0 +1,383 @@
+package web
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditMaxBytes = 10 << 20
+	defaultAuditKeep     = 5
+	minAuditKeyLength    = 32
+)
+
+// auditRecord is one line of the audit file. Hash is an HMAC over Prev and
+// every other field, so editing, dropping or reordering lines breaks the
+// chain, and without AUDIT_KEY it can't be rewritten to match.
+type auditRecord struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	IP      string    `json:"ip,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Session string    `json:"session,omitempty"` // fingerprint, never the session itself
+	Detail  string    `json:"detail,omitempty"`
+	Pruned  uint64    `json:"pruned,omitempty"` // audit_pruned: last record rotation deleted
+	Prev    string    `json:"prev"`
+	Hash    string    `json:"hash"`
+}
+
+// computeHash returns the record's HMAC-SHA256 under key, with Hash left
+// empty.
+func (r auditRecord) computeHash(key []byte) string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLog appends security events to AUDIT_LOG as HMAC-chained JSON lines.
+// When the file passes maxBytes it is rotated to .1 (older ones shift up to
+// .keep) and the chain carries on in the new file, which starts by recording
+// where the deleted oldest file ended. A nil *auditLog is a valid no-op.
+type auditLog struct {
+	lock     sync.Mutex
+	path     string
+	key      []byte
+	file     *os.File
+	size     int64
+	maxBytes int64
+	keep     int
+	seq      uint64
+	prev     string
+}
+
+var errAuditNoKey = errors.New("audit log needs a key")
+
+func openAuditLog(path string, key []byte, maxBytes int64, keep int) (*auditLog, error) {
+	if len(key) == 0 {
+		return nil, errAuditNoKey
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultAuditMaxBytes
+	}
+	if keep <= 0 {
+		keep = defaultAuditKeep
+	}
+	l := &auditLog{path: path, key: key, maxBytes: maxBytes, keep: keep}
+
+	// Continue the chain from the newest file that has records.
+	for _, p := range l.files() {
+		last, end, size, err := lastAuditRecord(p)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			l.seq, l.prev = last.Seq, last.Hash
+		}
+		if p == l.path && end < size {
+			if err := cutAuditTail(p, end, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if l.seq > 0 {
+		// Note the tail so `audit verify -tail` can later tell whether
+		// records were cut off the end.
+		slog.Info("Audit log opened", "event", "audit_opened", "file", path, "tail", auditTail(l.seq, l.prev))
+	}
+	return l, nil
+}
+
+// auditTail formats a record's position as SEQ:HASH, the form
+// `audit verify -tail` takes.
+func auditTail(seq uint64, hash string) string {
+	return strconv.FormatUint(seq, 10) + ":" + hash
+}
+
+// cutAuditTail removes what follows the last complete record in the current
+// file, typically a line torn by a crash or full disk, so the next record
+// starts on a line of its own. The removed bytes are kept in path.torn.
+func cutAuditTail(path string, end, size int64) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	slog.Warn("Truncating partial audit record", "event", "audit_truncated", "file", path, "bytes", size-end, "saved_to", path+".torn")
+	if err := os.WriteFile(path+".torn", data[end:], 0600); err != nil {
+		return err
+	}
+	return os.Truncate(path, end)
+}
+
+// setupAuditLog opens AUDIT_LOG if set.
+func setupAuditLog(c *AuditConfig) *auditLog {
+	if c.File == "" {
+		return nil
+	}
+
+	l, err := openAuditLog(c.File, []byte(c.Key), c.MaxBytes, c.Keep)
+	if err != nil {
+		fatal("Error opening audit log", "file", c.File, "err", err)
+	}
+	return l
+}
+
+// files returns the audit files oldest first, skipping ones that don't exist.
+func (l *auditLog) files() []string {
+	var files []string
+	for i := l.keep; i >= 1; i-- {
+		p := l.path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(p); err == nil {
+			files = append(files, p)
+		}
+	}
+	if _, err := os.Stat(l.path); err == nil {
+		files = append(files, l.path)
+	}
+	return files
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// rotate starts a new file and returns the seq of the last record in the
+// file the rotation deleted, or 0 if none was.
+func (l *auditLog) rotate() (uint64, error) {
+	var pruned uint64
+	if last, _, _, err := lastAuditRecord(l.path + "." + strconv.Itoa(l.keep)); err == nil && last != nil {
+		pruned = last.Seq
+	}
+	if err := l.file.Close(); err != nil {
+		return 0, err
+	}
+	for i := l.keep - 1; i >= 1; i-- {
+		from := l.path + "." + strconv.Itoa(i)
+		if err := os.Rename(from, l.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return 0, err
+	}
+	return pruned, l.open()
+}
+
+// add appends an event. Failures are logged rather than returned so a full
+// disk can't take unlocking down with it.
+func (l *auditLog) add(event, ip, user, fingerprint, detail string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.appendLocked(auditRecord{Time: time.Now().UTC(), Event: event, IP: ip, User: user, Session: fingerprint, Detail: detail})
+}
+
+// appendLocked chains r onto the log and writes it, rotating first if it
+// wouldn't fit. The caller holds l.lock.
+func (l *auditLog) appendLocked(r auditRecord) {
+	line, err := l.seal(&r)
+	if err != nil {
+		slog.Error("Failed to encode audit record", "err", err)
+		return
+	}
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		pruned, err := l.rotate()
+		if err != nil {
+			slog.Error("Failed to rotate audit log", "file", l.path, "err", err)
+			return
+		}
+		if pruned != 0 {
+			// Anchor the new head: verify accepts a chain that starts
+			// mid-way only right after a record rotation deleted.
+			l.appendLocked(auditRecord{Time: r.Time, Event: "audit_pruned", Pruned: pruned})
+		}
+		if line, err = l.seal(&r); err != nil {
+			slog.Error("Failed to encode audit record", "err", err)
+			return
+		}
+	}
+	if _, err := l.file.Write(line); err != nil {
+		slog.Error("Failed to write audit log", "file", l.path, "err", err)
+		// Drop whatever part of the line made it, so the next record
+		// doesn't land after a fragment.
+		if err := l.file.Truncate(l.size); err != nil {
+			slog.Error("Failed to truncate partial audit record", "file", l.path, "err", err)
+		}
+		return
+	}
+	l.size += int64(len(line))
+	l.seq, l.prev = r.Seq, r.Hash
+}
+
+// seal links r to the end of the chain and returns its line.
+func (l *auditLog) seal(r *auditRecord) ([]byte, error) {
+	r.Seq, r.Prev = l.seq+1, l.prev
+	r.Hash = r.computeHash(l.key)
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// lastAuditRecord returns the last complete record in path, the offset just
+// past its line and the file's size. A line that doesn't parse is skipped
+// rather than failing, so one torn write can't stop the gateway starting;
+// VerifyAuditLog still reports it.
+func lastAuditRecord(path string) (*auditRecord, int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	var (
+		last        *auditRecord
+		offset, end int64
+	)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var r auditRecord
+			if json.Unmarshal(line, &r) == nil {
+				last, end = &r, offset
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return last, end, offset, nil
+		}
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
+
+var errAuditChainBroken = errors.New("audit chain broken")
+
+// VerifyAuditLog checks the HMAC chain across path and its rotated files
+// (path.1 ... path.keep, oldest first) and returns the number of records and
+// the tail (SEQ:HASH of the last one). The chain must start at record 1, or
+// right after the last record rotation deleted. If wantTail is set, that
+// record must still be in the log, or have been rotated away, so records cut
+// off the end are caught too.
+func VerifyAuditLog(path string, key []byte, keep int, wantTail string) (int, string, error) {
+	if len(key) == 0 {
+		return 0, "", errAuditNoKey
+	}
+	if keep <= 0 {
+		keep = defaultAuditKeep
+	}
+	var wantSeq uint64
+	var wantHash string
+	if wantTail != "" {
+		seq, hash, ok := strings.Cut(wantTail, ":")
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if !ok || err != nil || n == 0 || hash == "" {
+			return 0, "", fmt.Errorf("tail %q is not SEQ:HASH", wantTail)
+		}
+		wantSeq, wantHash = n, hash
+	}
+	l := &auditLog{path: path, keep: keep}
+	files := l.files()
+	if len(files) == 0 {
+		return 0, "", fmt.Errorf("no audit log at %s", path)
+	}
+
+	var (
+		count         int
+		first, prev   *auditRecord
+		pruned        uint64
+		sawWantedTail bool
+	)
+	for _, p := range files {
+		f, err := os.Open(p)
+		if err != nil {
+			return count, "", err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		line := 0
+		for scanner.Scan() {
+			line++
+			var r auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				f.Close()
+				return count, "", fmt.Errorf("%s:%d: %w", p, line, err)
+			}
+			if !hmac.Equal([]byte(r.computeHash(key)), []byte(r.Hash)) {
+				f.Close()
+				return count, "", fmt.Errorf("%s:%d: record %d was modified: %w", p, line, r.Seq, errAuditChainBroken)
+			}
+			if prev != nil && (r.Prev != prev.Hash || r.Seq != prev.Seq+1) {
+				f.Close()
+				return count, "", fmt.Errorf("%s:%d: record %d doesn't follow record %d: %w", p, line, r.Seq, prev.Seq, errAuditChainBroken)
+			}
+			if first == nil {
+				first = &r
+			}
+			if r.Event == "audit_pruned" {
+				pruned = max(pruned, r.Pruned)
+			}
+			if r.Seq == wantSeq {
+				if r.Hash != wantHash {
+					f.Close()
+					return count, "", fmt.Errorf("%s:%d: record %d doesn't match the expected tail: %w", p, line, r.Seq, errAuditChainBroken)
+				}
+				sawWantedTail = true
+			}
+			prev = &r
+			count++
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return count, "", err
+		}
+	}
+	if first == nil {
+		return 0, "", fmt.Errorf("no audit records at %s", path)
+	}
+
+	if !(first.Seq == 1 && first.Prev == "") && first.Seq != pruned+1 {
+		return count, "", fmt.Errorf("records before %d are missing: %w", first.Seq, errAuditChainBroken)
+	}
+	if wantSeq != 0 && !sawWantedTail && wantSeq >= first.Seq {
+		return count, "", fmt.Errorf("log ends at record %d, before the expected tail %d: %w", prev.Seq, wantSeq, errAuditChainBroken)
+	}
+	return count, auditTail(prev.Seq, prev.Hash), nil
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestAuditLogChainsAcrossRotationAndRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, testAuditKey, 400, 10)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		l.add("unlock_failed", "198.51.100.7", "", "", "")
+	}
+	l.file.Close()
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("expected the log to rotate: %v", err)
+	}
+
+	// Reopening continues the chain rather than starting a new one.
+	l, err = openAuditLog(path, testAuditKey, 400, 10)
+	if err != nil {
+		t.Fatalf("reopen audit log: %v", err)
+	}
+	l.add("grant_created", "203.0.113.5", "alice", sessionFingerprint("secret-session"), "")
+	l.file.Close()
+
+	n, _, err := VerifyAuditLog(path, testAuditKey, 10, "")
+	if err != nil || n != 6 {
+		t.Fatalf("expected 6 chained records, got %d (%v)", n, err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "secret-session") || !strings.Contains(string(data), sessionFingerprint("secret-session")) {
+		t.Fatalf("expected only the session fingerprint to be logged, got %s", data)
+	}
+}
+
+func TestAuditLogRecoversFromTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, testAuditKey, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	l.add("unlock_failed", "198.51.100.7", "", "", "")
+	l.add("unlock_failed", "198.51.100.7", "", "", "")
+	l.file.Close()
+
+	// A crash mid-write leaves half a line.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":3,"time":"2026-`)
+	f.Close()
+
+	l, err = openAuditLog(path, testAuditKey, 0, 0)
+	if err != nil {
+		t.Fatalf("expected a torn record not to stop the log opening, got %v", err)
+	}
+	l.add("grant_created", "203.0.113.5", "alice", "", "")
+	l.file.Close()
+
+	if n, _, err := VerifyAuditLog(path, testAuditKey, 0, ""); err != nil || n != 3 {
+		t.Fatalf("expected the chain to carry on past the torn record, got %d (%v)", n, err)
+	}
+	if torn, err := os.ReadFile(path + ".torn"); err != nil || string(torn) != `{"seq":3,"time":"2026-` {
+		t.Fatalf("expected the torn bytes to be kept aside, got %q (%v)", torn, err)
+	}
+}
+
+func TestAuditLogDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, testAuditKey, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	l.add("unlock_failed", "198.51.100.7", "", "", "")
+	l.add("lockout", "198.51.100.7", "", "", "")
+	l.add("grant_created", "203.0.113.5", "alice", "s", "")
+	l.file.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	edited := strings.Replace(string(data), "198.51.100.7", "198.51.100.8", 1)
+	os.WriteFile(path, []byte(edited), 0600)
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, ""); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected an edited record to be detected, got %v", err)
+	}
+
+	dropped := lines[0] + lines[2]
+	os.WriteFile(path, []byte(dropped), 0600)
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, ""); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected a dropped record to be detected, got %v", err)
+	}
+
+	os.WriteFile(path, []byte(lines[1]+lines[2]), 0600)
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, ""); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected records dropped from the head to be detected, got %v", err)
+	}
+
+	// Without the key the whole file can't be rewritten to match.
+	forged := filepath.Join(t.TempDir(), "forged.log")
+	l, err = openAuditLog(forged, []byte("another key that is long enough!"), 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	l.add("unlock_failed", "198.51.100.8", "", "", "")
+	l.file.Close()
+	if _, _, err := VerifyAuditLog(forged, testAuditKey, 0, ""); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected a log chained under another key to be rejected, got %v", err)
+	}
+}
+
+func TestAuditLogVerifiesExpectedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, testAuditKey, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	l.add("unlock_failed", "198.51.100.7", "", "", "")
+	l.add("lockout", "198.51.100.7", "", "", "")
+	l.file.Close()
+
+	_, tail, err := VerifyAuditLog(path, testAuditKey, 0, "")
+	if err != nil || !strings.HasPrefix(tail, "2:") {
+		t.Fatalf("expected the tail to be record 2, got %q (%v)", tail, err)
+	}
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, tail); err != nil {
+		t.Fatalf("expected the log to match its own tail, got %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(data), "\n")
+	os.WriteFile(path, []byte(lines[0]), 0600)
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, tail); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected records dropped from the tail to be detected, got %v", err)
+	}
+}
+
+func TestAuditLogAnchorsHeadAfterRotationDeletesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, testAuditKey, 300, 2)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	for i := 0; i < 12; i++ {
+		l.add("unlock_failed", "198.51.100.7", "", "", "")
+	}
+	l.file.Close()
+
+	n, tail, err := VerifyAuditLog(path, testAuditKey, 2, "")
+	if err != nil {
+		t.Fatalf("expected the chain to start right after the pruned records, got %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"event":"audit_pruned"`) {
+		t.Fatalf("expected rotation to record what it deleted, got %s", data)
+	}
+
+	// Deleting the oldest remaining file leaves a gap the anchor exposes.
+	os.Remove(path + ".2")
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 2, tail); !errors.Is(err, errAuditChainBroken) {
+		t.Fatalf("expected a deleted rotated file to be detected (had %d records), got %v", n, err)
+	}
+}
+
+func TestUnlockAndLockoutAreAudited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	h := newTestHandlers()
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	l, err := openAuditLog(path, testAuditKey, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	h.audit = l
+	// Set before the first unlock: its notification reads them in the background.
+	h.settings.unlockPasswd = testPassword
+	h.settings.allowLocalBypass = true
+
+	for i := 0; i < h.settings.maxLoginFailures; i++ {
+		h.registerFailedLogin("198.51.100.7", "mallory")
+	}
+	if _, err := h.addGranted("203.0.113.5", "alice", ""); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	if _, err := h.addGranted("203.0.113.5", "alice", ""); err != nil {
+		t.Fatalf("reuse grant: %v", err)
+	}
+
+	_, w := postUnlockForm(&h, "203.0.113.6", url.Values{"pass": {testPassword}})
+	if sessionCookie(w, h.cookieName) == "" {
+		t.Fatal("expected the unlock to set a session cookie")
+	}
+	if code := testAccess(&h, "192.168.1.20"); code != http.StatusOK {
+		t.Fatalf("expected the local bypass to allow access, got %d", code)
+	}
+
+	// Later access checks against the grants hand out the cookie again but
+	// aren't audited: proxies rarely pass it back.
+	for i := 0; i < 3; i++ {
+		testAccess(&h, "203.0.113.6")
+		testAccess(&h, "192.168.1.20")
+	}
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), `"event":"session_cookie_issued"`); n != 2 {
+		t.Fatalf("expected a cookie issuance audited for the unlock and the local bypass only, got %d in %s", n, data)
+	}
+	for _, want := range []string{`"event":"unlock_failed"`, `"event":"lockout"`, `"event":"grant_created"`, `"event":"grant_reused"`, `"event":"session_cookie_issued"`, `"event":"local_bypass"`, `"user":"mallory"`} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected %s in the audit log, got %s", want, data)
+		}
+	}
+	if _, _, err := VerifyAuditLog(path, testAuditKey, 0, ""); err != nil {
+		t.Fatalf("expected a valid chain, got %v", err)
+	}
+}
@@ -0,0 +1,556 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Config is every gateway setting. LoadConfig builds it from the defaults,
+// then the config file, then environment variables, which win. Each field's
+// env tag names its variable; fields tagged secret are redacted when the
+// config is printed, and fields tagged reload can change without a restart
+// (see Handlers.Reload). A field tagged file names a file to read the secret
+// field it names from, so secrets can come from Docker or Kubernetes secret
+// mounts rather than the environment.
+type Config struct {
+	Server      ServerConfig      `yaml:"server" toml:"server"`
+	Cookie      CookieConfig      `yaml:"cookie" toml:"cookie"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	Lockout     LockoutConfig     `yaml:"lockout" toml:"lockout"`
+	Storage     StorageConfig     `yaml:"storage" toml:"storage"`
+	WebAuthn    WebAuthnConfig    `yaml:"webauthn" toml:"webauthn"`
+	OIDC        OIDCConfig        `yaml:"oidc" toml:"oidc"`
+	Admin       AdminConfig       `yaml:"admin" toml:"admin"`
+	Metrics     MetricsConfig     `yaml:"metrics" toml:"metrics"`
+	Audit       AuditConfig       `yaml:"audit" toml:"audit"`
+	Notify      NotifyConfig      `yaml:"notify" toml:"notify"`
+	ForwardAuth ForwardAuthConfig `yaml:"forward_auth" toml:"forward_auth"`
+	Log         LogConfig         `yaml:"log" toml:"log"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port" toml:"port" env:"PORT"`
+	// TrustedProxies are the hops allowed to set forwarding headers; empty
+	// means the private and Tailscale ranges.
+	TrustedProxies   []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES" reload:"true"`
+	ClientIPHeader   string   `yaml:"client_ip_header" toml:"client_ip_header" env:"CLIENT_IP_HEADER"`
+	AllowLocalBypass bool     `yaml:"allow_local_bypass" toml:"allow_local_bypass" env:"ALLOW_LOCAL_BYPASS" reload:"true"`
+	// ConfigPollSeconds checks the config and users files for changes this
+	// often and reloads them; 0 reloads only on SIGHUP.
+	ConfigPollSeconds int `yaml:"config_poll_seconds" toml:"config_poll_seconds" env:"CONFIG_POLL_SECONDS"`
+}
+
+type CookieConfig struct {
+	Domain string `yaml:"domain" toml:"domain" env:"COOKIE_DOMAIN"`
+	Name   string `yaml:"name" toml:"name" env:"COOKIE_NAME"`
+}
+
+type AuthConfig struct {
+	Password     string `yaml:"password" toml:"password" env:"GATEWAY_PASSWORD" reload:"true" secret:"true"`
+	PasswordFile string `yaml:"password_file" toml:"password_file" env:"GATEWAY_PASSWORD_FILE" reload:"true" file:"Password"`
+	// PreviousPassword still unlocks for PasswordGraceHours after
+	// PasswordRotatedAt (RFC 3339), so a rotation doesn't lock out people who
+	// haven't heard yet. The grace period is anchored to the configured time
+	// rather than process start, so restarts don't extend it and replicas
+	// agree on when it ends. RevokeRetiredGrants revokes grants made with any
+	// other password.
+	PreviousPassword     string `yaml:"previous_password" toml:"previous_password" env:"GATEWAY_PASSWORD_PREVIOUS" reload:"true" secret:"true"`
+	PreviousPasswordFile string `yaml:"previous_password_file" toml:"previous_password_file" env:"GATEWAY_PASSWORD_PREVIOUS_FILE" reload:"true" file:"PreviousPassword"`
+	PasswordRotatedAt    string `yaml:"password_rotated_at" toml:"password_rotated_at" env:"PASSWORD_ROTATED_AT" reload:"true"`
+	PasswordGraceHours   int    `yaml:"password_grace_hours" toml:"password_grace_hours" env:"PASSWORD_GRACE_HOURS" reload:"true"`
+	RevokeRetiredGrants  bool   `yaml:"revoke_retired_grants" toml:"revoke_retired_grants" env:"REVOKE_RETIRED_GRANTS" reload:"true"`
+	// The policy CheckPassword applies to a plaintext GATEWAY_PASSWORD.
+	PasswordMinLength      int    `yaml:"password_min_length" toml:"password_min_length" env:"PASSWORD_MIN_LENGTH" reload:"true"`
+	PasswordMinEntropyBits int    `yaml:"password_min_entropy_bits" toml:"password_min_entropy_bits" env:"PASSWORD_MIN_ENTROPY_BITS" reload:"true"`
+	BreachedPasswordsFile  string `yaml:"breached_passwords_file" toml:"breached_passwords_file" env:"BREACHED_PASSWORDS_FILE" reload:"true"`
+	UsersFile              string `yaml:"users_file" toml:"users_file" env:"USERS_FILE"`
+	TOTPEnabled            bool   `yaml:"totp_enabled" toml:"totp_enabled" env:"TOTP_ENABLED"`
+	TOTPIssuer             string `yaml:"totp_issuer" toml:"totp_issuer" env:"TOTP_ISSUER"`
+	ExpirationDays         int    `yaml:"ip_expiration_days" toml:"ip_expiration_days" env:"IP_EXPIRATION_DAYS"`
+}
+
+type LockoutConfig struct {
+	MaxFailures int `yaml:"max_failures" toml:"max_failures" env:"MAX_LOGIN_FAILURES" reload:"true"`
+	Minutes     int `yaml:"minutes" toml:"minutes" env:"LOCKOUT_MINUTES" reload:"true"`
+}
+
+type StorageConfig struct {
+	Backend        string `yaml:"backend" toml:"backend" env:"STORAGE_BACKEND"`
+	PersistFile    string `yaml:"persist_file" toml:"persist_file" env:"PERSIST_FILE"`
+	PersistKey     string `yaml:"persist_key" toml:"persist_key" env:"PERSIST_KEY" secret:"true"`
+	PersistKeyFile string `yaml:"persist_key_file" toml:"persist_key_file" env:"PERSIST_KEY_FILE"`
+	DebounceMS     int    `yaml:"debounce_ms" toml:"debounce_ms" env:"PERSIST_DEBOUNCE_MS"`
+	LockoutFile    string `yaml:"lockout_file" toml:"lockout_file" env:"LOCKOUT_FILE"`
+	SQLitePath     string `yaml:"sqlite_path" toml:"sqlite_path" env:"SQLITE_PATH"`
+	RedisURL       string `yaml:"redis_url" toml:"redis_url" env:"REDIS_URL" secret:"true"` // may carry a password
+	RedisURLFile   string `yaml:"redis_url_file" toml:"redis_url_file" env:"REDIS_URL_FILE" file:"RedisURL"`
+	RedisPrefix    string `yaml:"redis_prefix" toml:"redis_prefix" env:"REDIS_PREFIX"`
+}
+
+type WebAuthnConfig struct {
+	RPID            string   `yaml:"rp_id" toml:"rp_id" env:"WEBAUTHN_RP_ID"`
+	RPOrigins       []string `yaml:"rp_origins" toml:"rp_origins" env:"WEBAUTHN_RP_ORIGINS"`
+	RPName          string   `yaml:"rp_name" toml:"rp_name" env:"WEBAUTHN_RP_NAME"`
+	CredentialsFile string   `yaml:"credentials_file" toml:"credentials_file" env:"WEBAUTHN_CREDENTIALS_FILE"`
+}
+
+type OIDCConfig struct {
+	Issuer           string   `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER"`
+	ClientID         string   `yaml:"client_id" toml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret     string   `yaml:"client_secret" toml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	ClientSecretFile string   `yaml:"client_secret_file" toml:"client_secret_file" env:"OIDC_CLIENT_SECRET_FILE" file:"ClientSecret"`
+	RedirectURL      string   `yaml:"redirect_url" toml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes           []string `yaml:"scopes" toml:"scopes" env:"OIDC_SCOPES"`
+	AllowedSubjects  []string `yaml:"allowed_subjects" toml:"allowed_subjects" env:"OIDC_ALLOWED_SUBJECTS"`
+	AllowedEmails    []string `yaml:"allowed_emails" toml:"allowed_emails" env:"OIDC_ALLOWED_EMAILS"`
+	AllowedGroups    []string `yaml:"allowed_groups" toml:"allowed_groups" env:"OIDC_ALLOWED_GROUPS"`
+	GroupsClaim      string   `yaml:"groups_claim" toml:"groups_claim" env:"OIDC_GROUPS_CLAIM"`
+}
+
+type AdminConfig struct {
+	Token     string   `yaml:"token" toml:"token" env:"ADMIN_TOKEN" reload:"true" secret:"true"`
+	TokenFile string   `yaml:"token_file" toml:"token_file" env:"ADMIN_TOKEN_FILE" reload:"true" file:"Token"`
+	Users     []string `yaml:"users" toml:"users" env:"ADMIN_USERS" reload:"true"`
+	Addr      string   `yaml:"addr" toml:"addr" env:"ADMIN_ADDR"`
+}
+
+type MetricsConfig struct {
+	Token     string `yaml:"token" toml:"token" env:"METRICS_TOKEN" reload:"true" secret:"true"`
+	TokenFile string `yaml:"token_file" toml:"token_file" env:"METRICS_TOKEN_FILE" reload:"true" file:"Token"`
+	Addr      string `yaml:"addr" toml:"addr" env:"METRICS_ADDR"`
+}
+
+type AuditConfig struct {
+	File     string `yaml:"file" toml:"file" env:"AUDIT_LOG"`
+	Key      string `yaml:"key" toml:"key" env:"AUDIT_KEY" secret:"true"`
+	KeyFile  string `yaml:"key_file" toml:"key_file" env:"AUDIT_KEY_FILE" file:"Key"`
+	MaxBytes int64  `yaml:"max_bytes" toml:"max_bytes" env:"AUDIT_MAX_BYTES"`
+	Keep     int    `yaml:"keep" toml:"keep" env:"AUDIT_KEEP"`
+}
+
+// ForwardAuthConfig makes denied access checks redirect to the unlock page,
+// for Traefik ForwardAuth and Caddy forward_auth.
+type ForwardAuthConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled" env:"FORWARD_AUTH"`
+	// UnlockURL is the unlock page as browsers reach it, e.g.
+	// https://gateway.example.com/unlock.
+	UnlockURL    string   `yaml:"unlock_url" toml:"unlock_url" env:"FORWARD_AUTH_UNLOCK_URL"`
+	AllowedHosts []string `yaml:"allowed_hosts" toml:"allowed_hosts" env:"FORWARD_AUTH_ALLOWED_HOSTS"`
+}
+
+type NotifyConfig struct {
+	SlackWebhook     string `yaml:"slack_webhook" toml:"slack_webhook" env:"SLACK_WEBHOOK_URL" reload:"true" secret:"true"` // the URL is the credential
+	SlackWebhookFile string `yaml:"slack_webhook_file" toml:"slack_webhook_file" env:"SLACK_WEBHOOK_URL_FILE" reload:"true" file:"SlackWebhook"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT" reload:"true"`
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL" reload:"true"`
+}
+
+// redacted replaces set secrets in printed configs.
+const redacted = "REDACTED"
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Server:   ServerConfig{Port: "9090", ClientIPHeader: "X-Gateway-Client-IP"},
+		Cookie:   CookieConfig{Name: "gateway_session"},
+		Auth:     AuthConfig{TOTPIssuer: "Gateway", ExpirationDays: 30, PasswordMinLength: 12, PasswordMinEntropyBits: 50, PasswordGraceHours: 24},
+		Lockout:  LockoutConfig{MaxFailures: 5, Minutes: 15},
+		Storage:  StorageConfig{Backend: "json", PersistFile: "granted_ips.json", DebounceMS: 500, RedisPrefix: "gateway:"},
+		WebAuthn: WebAuthnConfig{RPName: "Gateway"},
+		OIDC:     OIDCConfig{Scopes: []string{"openid", "email", "profile"}, GroupsClaim: "groups"},
+		Log:      LogConfig{Format: "text", Level: "info"},
+	}
+}
+
+// LoadConfig reads the config file at path ("" for none; YAML or TOML by
+// extension), applies environment overrides and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	c.fillDerived()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile decodes path over c, rejecting keys c doesn't have so a typo
+// doesn't silently fall back to a default.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(bytes.NewReader(data), yaml.Strict()).Decode(c)
+		if errors.Is(err, io.EOF) {
+			err = nil // empty file
+		}
+	case ".toml":
+		err = toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(c)
+	default:
+		return fmt.Errorf("config file %s: unknown format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides c with every env-tagged variable that is set and
+// non-empty. A value that doesn't parse is an error, not a silent default.
+func (c *Config) applyEnv() error {
+	var errs []error
+	eachConfigField(reflect.ValueOf(c).Elem(), func(f reflect.StructField, v reflect.Value) {
+		name := f.Tag.Get("env")
+		raw := os.Getenv(name)
+		if name == "" || raw == "" {
+			return
+		}
+
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(raw)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not true or false", name, raw))
+				return
+			}
+			v.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a whole number", name, raw))
+				return
+			}
+			v.SetInt(n)
+		case reflect.Slice:
+			v.Set(reflect.ValueOf(splitList(raw)))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// readSecretFiles fills each secret that has its file set (e.g.
+// GATEWAY_PASSWORD from GATEWAY_PASSWORD_FILE), trimming trailing newlines.
+// Setting both the secret and its file is an error, wherever each came from.
+func (c *Config) readSecretFiles() error {
+	var errs []error
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			f := section.Type().Field(j)
+			target := f.Tag.Get("file")
+			path := section.Field(j).String()
+			if target == "" || path == "" {
+				continue
+			}
+			secretField, _ := section.Type().FieldByName(target)
+			secret := section.FieldByName(target)
+			if secret.String() != "" {
+				errs = append(errs, fmt.Errorf("set only one of %s and %s", secretField.Tag.Get("env"), f.Tag.Get("env")))
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.Tag.Get("env"), err))
+				continue
+			}
+			secret.SetString(strings.TrimRight(string(data), "\r\n"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SecretFiles returns the files secrets are read from, for reloads to watch.
+func (c *Config) SecretFiles() []string {
+	var files []string
+	eachConfigField(reflect.ValueOf(c).Elem(), func(f reflect.StructField, v reflect.Value) {
+		if f.Tag.Get("file") != "" && v.String() != "" {
+			files = append(files, v.String())
+		}
+	})
+	return files
+}
+
+// fillDerived sets the paths that default to siblings of the persist file.
+func (c *Config) fillDerived() {
+	dir := filepath.Dir(c.Storage.PersistFile)
+	if c.Storage.Backend == "json" && c.Storage.LockoutFile == "" {
+		c.Storage.LockoutFile = filepath.Join(dir, "lockouts.json")
+	}
+	if c.Storage.Backend == "sqlite" && c.Storage.SQLitePath == "" {
+		c.Storage.SQLitePath = filepath.Join(dir, "gateway.db")
+	}
+	if c.WebAuthn.RPID != "" {
+		if len(c.WebAuthn.RPOrigins) == 0 {
+			c.WebAuthn.RPOrigins = []string{"https://" + c.WebAuthn.RPID}
+		}
+		if c.WebAuthn.CredentialsFile == "" {
+			c.WebAuthn.CredentialsFile = filepath.Join(dir, "webauthn_credentials.json")
+		}
+	}
+}
+
+// Validate reports every invalid or conflicting setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(validPort(c.Server.Port), "PORT: %q is not a port number", c.Server.Port)
+	for _, addr := range []struct{ name, value string }{{"ADMIN_ADDR", c.Admin.Addr}, {"METRICS_ADDR", c.Metrics.Addr}} {
+		if addr.value != "" {
+			_, port, err := net.SplitHostPort(addr.value)
+			check(err == nil && validPort(port), "%s: %q is not a host:port address", addr.name, addr.value)
+		}
+	}
+	check(c.Admin.Token == "" || len(c.Admin.Token) >= minAdminTokenLength,
+		"ADMIN_TOKEN must be at least %d characters, got %d", minAdminTokenLength, len(c.Admin.Token))
+	for _, p := range c.Server.TrustedProxies {
+		check(validProxy(p), "TRUSTED_PROXIES: %q is not an IP address or CIDR range", p)
+	}
+	check(c.Server.ConfigPollSeconds >= 0, "CONFIG_POLL_SECONDS must not be negative, got %d", c.Server.ConfigPollSeconds)
+	check(c.Server.ClientIPHeader != "", "CLIENT_IP_HEADER must not be empty")
+	check(c.Cookie.Name != "", "COOKIE_NAME must not be empty")
+
+	check(c.Auth.ExpirationDays > 0, "IP_EXPIRATION_DAYS must be positive, got %d", c.Auth.ExpirationDays)
+	check(c.Lockout.MaxFailures > 0, "MAX_LOGIN_FAILURES must be positive, got %d", c.Lockout.MaxFailures)
+	check(c.Lockout.Minutes > 0, "LOCKOUT_MINUTES must be positive, got %d", c.Lockout.Minutes)
+	check(!c.Auth.TOTPEnabled || c.Auth.UsersFile != "", "TOTP_ENABLED requires USERS_FILE")
+	check(c.Auth.PasswordMinLength >= 0, "PASSWORD_MIN_LENGTH must not be negative, got %d", c.Auth.PasswordMinLength)
+	check(c.Auth.PasswordMinEntropyBits >= 0, "PASSWORD_MIN_ENTROPY_BITS must not be negative, got %d", c.Auth.PasswordMinEntropyBits)
+	for _, p := range []struct{ name, value string }{{"GATEWAY_PASSWORD", c.Auth.Password}, {"GATEWAY_PASSWORD_PREVIOUS", c.Auth.PreviousPassword}} {
+		// The unlock form trims what's typed, so a padded password could never
+		// match.
+		check(strings.TrimSpace(p.value) == p.value, "%s must not start or end with whitespace", p.name)
+		if isPasswordHash(p.value) {
+			_, err := checkArgon2id(p.value, "")
+			check(err == nil, "%s: malformed argon2id hash", p.name)
+		}
+	}
+	check(c.Auth.PasswordGraceHours >= 0, "PASSWORD_GRACE_HOURS must not be negative, got %d", c.Auth.PasswordGraceHours)
+	if c.Auth.PreviousPassword != "" {
+		check(c.Auth.Password != "", "GATEWAY_PASSWORD_PREVIOUS requires GATEWAY_PASSWORD")
+		check(c.Auth.PreviousPassword != c.Auth.Password, "GATEWAY_PASSWORD_PREVIOUS is the same as GATEWAY_PASSWORD")
+		_, err := time.Parse(time.RFC3339, c.Auth.PasswordRotatedAt)
+		check(err == nil, "GATEWAY_PASSWORD_PREVIOUS requires PASSWORD_ROTATED_AT, the RFC 3339 time of the rotation, got %q", c.Auth.PasswordRotatedAt)
+	}
+
+	switch c.Storage.Backend {
+	case "json", "sqlite":
+	case "redis":
+		check(c.Storage.RedisURL != "", "STORAGE_BACKEND=redis requires REDIS_URL")
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_BACKEND: unknown backend %q, use json, sqlite or redis", c.Storage.Backend))
+	}
+	check(c.Storage.PersistFile != "", "PERSIST_FILE must not be empty")
+	check(c.Storage.PersistKey == "" || c.Storage.PersistKeyFile == "", "set only one of PERSIST_KEY and PERSIST_KEY_FILE")
+	check(c.Storage.DebounceMS >= 0, "PERSIST_DEBOUNCE_MS must not be negative, got %d", c.Storage.DebounceMS)
+
+	if c.WebAuthn.RPID != "" {
+		check(c.Auth.UsersFile != "", "WEBAUTHN_RP_ID requires USERS_FILE")
+		for _, o := range c.WebAuthn.RPOrigins {
+			u, err := url.Parse(o)
+			check(err == nil && u.Scheme != "" && u.Host != "", "WEBAUTHN_RP_ORIGINS: %q is not an origin", o)
+		}
+	}
+
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ClientID != "" && c.OIDC.RedirectURL != "", "OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+		// Without an allow list every account at the IdP could unlock.
+		check(len(c.OIDC.AllowedSubjects)+len(c.OIDC.AllowedEmails)+len(c.OIDC.AllowedGroups) > 0,
+			"OIDC_ISSUER requires at least one of OIDC_ALLOWED_SUBJECTS, OIDC_ALLOWED_EMAILS or OIDC_ALLOWED_GROUPS")
+	}
+
+	if c.ForwardAuth.Enabled {
+		u, err := url.Parse(c.ForwardAuth.UnlockURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+			"FORWARD_AUTH requires FORWARD_AUTH_UNLOCK_URL as an absolute URL, got %q", c.ForwardAuth.UnlockURL)
+	}
+	for _, host := range c.ForwardAuth.AllowedHosts {
+		check(host != "" && !strings.ContainsAny(host, "/:"), "FORWARD_AUTH_ALLOWED_HOSTS: %q is not a host name", host)
+	}
+
+	check(c.Audit.File == "" || len(c.Audit.Key) >= minAuditKeyLength,
+		"AUDIT_LOG requires AUDIT_KEY (or AUDIT_KEY_FILE) of at least %d characters", minAuditKeyLength)
+	check(c.Audit.MaxBytes >= 0, "AUDIT_MAX_BYTES must not be negative, got %d", c.Audit.MaxBytes)
+	check(c.Audit.Keep >= 0, "AUDIT_KEEP must not be negative, got %d", c.Audit.Keep)
+
+	switch strings.ToLower(c.Log.Format) {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT: %q is not text or json", c.Log.Format))
+	}
+	var lvl slog.Level
+	check(lvl.UnmarshalText([]byte(c.Log.Level)) == nil, "LOG_LEVEL: %q is not debug, info, warn or error", c.Log.Level)
+
+	return errors.Join(errs...)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
+
+func validProxy(proxy string) bool {
+	if net.ParseIP(proxy) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(proxy)
+	return err == nil
+}
+
+// AdminEnabled reports whether ADMIN_TOKEN is configured.
+func (c *Config) AdminEnabled() bool {
+	return c.Admin.Token != ""
+}
+
+// DashboardEnabled reports whether anyone can reach the admin dashboard,
+// either with ADMIN_TOKEN or as one of ADMIN_USERS.
+func (c *Config) DashboardEnabled() bool {
+	return c.Admin.Token != "" || len(c.Admin.Users) > 0
+}
+
+// MetricsEnabled reports whether /metrics can be served on the main router,
+// which requires METRICS_TOKEN.
+func (c *Config) MetricsEnabled() bool {
+	return c.Metrics.Token != ""
+}
+
+// Redacted returns a copy of c with every set secret replaced, for printing.
+func (c *Config) Redacted() *Config {
+	out := *c
+	eachConfigField(reflect.ValueOf(&out).Elem(), func(f reflect.StructField, v reflect.Value) {
+		if f.Tag.Get("secret") == "true" && v.String() != "" {
+			v.SetString(redacted)
+		}
+	})
+	return &out
+}
+
+// WriteYAML prints c as a config file.
+func (c *Config) WriteYAML(w io.Writer) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ConfigChange is a setting that differs between two configs.
+type ConfigChange struct {
+	Setting  string // the environment variable
+	From, To string // secrets are REDACTED
+	Reload   bool   // a reload applies it; otherwise it takes a restart
+}
+
+// Changes lists the settings that differ in next.
+func (c *Config) Changes(next *Config) []ConfigChange {
+	var changes []ConfigChange
+	from, to := configFields(c), configFields(next)
+	for i, f := range from {
+		a, b := formatConfigValue(f.value), formatConfigValue(to[i].value)
+		if a == b {
+			continue
+		}
+		if f.field.Tag.Get("secret") == "true" {
+			a, b = redactValue(a), redactValue(b)
+		}
+		changes = append(changes, ConfigChange{
+			Setting: f.field.Tag.Get("env"),
+			From:    a,
+			To:      b,
+			Reload:  f.field.Tag.Get("reload") == "true",
+		})
+	}
+	return changes
+}
+
+// WithReloadable returns a copy of c with the reloadable settings taken from
+// next, i.e. what is in effect after reloading next.
+func (c *Config) WithReloadable(next *Config) *Config {
+	out := *c
+	fields, nextFields := configFields(&out), configFields(next)
+	for i, f := range fields {
+		if f.field.Tag.Get("reload") == "true" {
+			f.value.Set(nextFields[i].value)
+		}
+	}
+	return &out
+}
+
+type configField struct {
+	field reflect.StructField
+	value reflect.Value
+}
+
+// configFields returns c's leaf fields in declaration order.
+func configFields(c *Config) []configField {
+	var fields []configField
+	eachConfigField(reflect.ValueOf(c).Elem(), func(f reflect.StructField, v reflect.Value) {
+		fields = append(fields, configField{f, v})
+	})
+	return fields
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func redactValue(v string) string {
+	if v == "" {
+		return v
+	}
+	return redacted
+}
+
+// eachConfigField calls fn for every leaf field of the config struct v.
+func eachConfigField(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			eachConfigField(v.Field(i), fn)
+			continue
+		}
+		fn(t.Field(i), v.Field(i))
+	}
+}
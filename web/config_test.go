@@ -0,0 +1,250 @@
+package web
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("expected the defaults to validate, got %v", err)
+	}
+}
+
+func TestLoadConfigReadsYAMLAndTOML(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("MAX_LOGIN_FAILURES", "")
+
+	for name, content := range map[string]string{
+		"gateway.yaml": "server:\n  port: \"8080\"\n  trusted_proxies: [10.0.0.0/8]\nlockout:\n  max_failures: 3\nstorage:\n  persist_file: /data/granted.json\n",
+		"gateway.toml": "[server]\nport = \"8080\"\ntrusted_proxies = [\"10.0.0.0/8\"]\n[lockout]\nmax_failures = 3\n[storage]\npersist_file = \"/data/granted.json\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeTestConfig(t, name, content))
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if cfg.Server.Port != "8080" || cfg.Lockout.MaxFailures != 3 || len(cfg.Server.TrustedProxies) != 1 {
+				t.Fatalf("expected the file's values, got %+v", cfg)
+			}
+			if cfg.Lockout.Minutes != 15 || cfg.Cookie.Name != "gateway_session" {
+				t.Fatalf("expected defaults for unset keys, got %+v", cfg)
+			}
+			if cfg.Storage.LockoutFile != "/data/lockouts.json" {
+				t.Fatalf("expected the lockout file next to the persist file, got %q", cfg.Storage.LockoutFile)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeTestConfig(t, "gateway.yaml", "server:\n  port: \"8080\"\nadmin:\n  users: [alice]\n")
+	t.Setenv("PORT", "9999")
+	t.Setenv("ADMIN_USERS", "bob, carol")
+	t.Setenv("ALLOW_LOCAL_BYPASS", "true")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Server.Port != "9999" || !cfg.Server.AllowLocalBypass {
+		t.Fatalf("expected env overrides, got %+v", cfg.Server)
+	}
+	if len(cfg.Admin.Users) != 2 || cfg.Admin.Users[0] != "bob" || cfg.Admin.Users[1] != "carol" {
+		t.Fatalf("expected ADMIN_USERS to replace the file's list, got %#v", cfg.Admin.Users)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	for name, content := range map[string]string{
+		"gateway.yaml": "server:\n  prot: \"8080\"\n",
+		"gateway.toml": "[server]\nprot = \"8080\"\n",
+		"gateway.ini":  "port=8080\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadConfig(writeTestConfig(t, name, content)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsEveryBadValue(t *testing.T) {
+	t.Setenv("IP_EXPIRATION_DAYS", "thirty")
+	t.Setenv("TOTP_ENABLED", "yes please")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, invalid")
+	t.Setenv("LOCKOUT_MINUTES", "-1")
+	t.Setenv("STORAGE_BACKEND", "postgres")
+
+	_, err := LoadConfig("")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Parse errors come first; fix those and validation finds the rest.
+	for _, want := range []string{"IP_EXPIRATION_DAYS", "TOTP_ENABLED"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s in %v", want, err)
+		}
+	}
+
+	t.Setenv("IP_EXPIRATION_DAYS", "")
+	t.Setenv("TOTP_ENABLED", "")
+	_, err = LoadConfig("")
+	for _, want := range []string{`"invalid"`, "LOCKOUT_MINUTES", `"postgres"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s in %v", want, err)
+		}
+	}
+}
+
+func TestValidateChecksDependentSettings(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.TOTPEnabled = true
+	cfg.OIDC.Issuer = "https://idp.example.com"
+	cfg.OIDC.ClientID = "gateway"
+	cfg.OIDC.RedirectURL = "https://gateway.example.com/unlock/oidc/callback"
+	cfg.Storage.Backend = "redis"
+	cfg.Storage.PersistKey = "a"
+	cfg.Storage.PersistKeyFile = "b"
+	cfg.Audit.File = "audit.log"
+	cfg.Admin.Token = "admin-token"
+
+	err := cfg.Validate()
+	for _, want := range []string{"TOTP_ENABLED requires USERS_FILE", "OIDC_ALLOWED_", "requires REDIS_URL", "only one of PERSIST_KEY", "AUDIT_LOG requires AUDIT_KEY", "ADMIN_TOKEN must be at least"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.Password = "hunter2"
+	cfg.Admin.Token = "admin-token"
+	cfg.Storage.RedisURL = "redis://:pw@redis:6379/0"
+	cfg.Admin.Addr = "127.0.0.1:9091"
+
+	var out bytes.Buffer
+	if err := cfg.Redacted().WriteYAML(&out); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, secret := range []string{"hunter2", "admin-token", "pw@redis"} {
+		if strings.Contains(out.String(), secret) {
+			t.Fatalf("expected %q redacted, got:\n%s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), redacted) || !strings.Contains(out.String(), "127.0.0.1:9091") {
+		t.Fatalf("expected redacted secrets and plain settings, got:\n%s", out.String())
+	}
+	if cfg.Auth.Password != "hunter2" {
+		t.Fatal("expected Redacted to leave the original alone")
+	}
+}
+
+func TestChangesListsSettingsAndRedactsSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	next := DefaultConfig()
+	next.Auth.Password = "hunter2"
+	next.Lockout.MaxFailures = 9
+	next.Server.Port = "8080"
+
+	changes := cfg.Changes(next)
+	want := map[string]ConfigChange{
+		"GATEWAY_PASSWORD":   {Setting: "GATEWAY_PASSWORD", From: "", To: redacted, Reload: true},
+		"MAX_LOGIN_FAILURES": {Setting: "MAX_LOGIN_FAILURES", From: "5", To: "9", Reload: true},
+		"PORT":               {Setting: "PORT", From: "9090", To: "8080", Reload: false},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %#v", len(want), changes)
+	}
+	for _, c := range changes {
+		if want[c.Setting] != c {
+			t.Fatalf("unexpected change %#v", c)
+		}
+	}
+}
+
+func TestWithReloadableKeepsRestartOnlySettings(t *testing.T) {
+	cfg := DefaultConfig()
+	next := DefaultConfig()
+	next.Server.TrustedProxies = []string{"10.1.2.3"}
+	next.Admin.Token = "admin-token"
+	next.Server.Port = "8080"
+	next.Storage.Backend = "sqlite"
+
+	applied := cfg.WithReloadable(next)
+	if applied.Admin.Token != "admin-token" || len(applied.Server.TrustedProxies) != 1 {
+		t.Fatalf("expected reloadable settings from next, got %#v", applied)
+	}
+	if applied.Server.Port != "9090" || applied.Storage.Backend != "json" {
+		t.Fatalf("expected restart-only settings kept, got port %q backend %q", applied.Server.Port, applied.Storage.Backend)
+	}
+	if cfg.Admin.Token != "" {
+		t.Fatal("expected WithReloadable to leave the original alone")
+	}
+}
+
+func TestLoadConfigReadsSecretFiles(t *testing.T) {
+	t.Setenv("GATEWAY_PASSWORD", "")
+	t.Setenv("SLACK_WEBHOOK_URL", "")
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	webhookFile := filepath.Join(dir, "webhook")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\r\n"), 0600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if err := os.WriteFile(webhookFile, []byte("https://hooks.example.com/x\r\n"), 0600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	t.Setenv("GATEWAY_PASSWORD_FILE", passwordFile)
+	configFile := writeTestConfig(t, "gateway.yaml", "notify:\n  slack_webhook_file: "+webhookFile+"\n")
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Auth.Password != "hunter2" {
+		t.Fatalf("expected the trailing newline trimmed, got %q", cfg.Auth.Password)
+	}
+	if cfg.Notify.SlackWebhook != "https://hooks.example.com/x" {
+		t.Fatalf("expected the webhook from its file, got %q", cfg.Notify.SlackWebhook)
+	}
+	if files := cfg.SecretFiles(); len(files) != 2 {
+		t.Fatalf("expected both secret files listed, got %v", files)
+	}
+
+	// Other whitespace is kept, and the password is then refused: the unlock
+	// form trims what's typed.
+	if err := os.WriteFile(passwordFile, []byte("hunter2 \n"), 0600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), "whitespace") {
+		t.Fatalf("expected a padded password file to be refused, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsSecretAndSecretFile(t *testing.T) {
+	t.Setenv("GATEWAY_PASSWORD", "hunter2")
+	t.Setenv("GATEWAY_PASSWORD_FILE", filepath.Join(t.TempDir(), "password"))
+	t.Setenv("ADMIN_TOKEN_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	_, err := LoadConfig("")
+	for _, want := range []string{"set only one of GATEWAY_PASSWORD and GATEWAY_PASSWORD_FILE", "ADMIN_TOKEN_FILE"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
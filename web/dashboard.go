@@ -0,0 +1,272 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminCookie     = "gateway_admin"
+	adminSessionTTL = 12 * time.Hour
+)
+
+// adminSessions are browser logins to the dashboard made with ADMIN_TOKEN.
+// Users listed in ADMIN_USERS don't need one; the user session from their
+// unlock is enough (never the grant cookie, which anyone behind the grant's IP
+// can be handed).
+type adminSessions struct {
+	lock     sync.Mutex
+	sessions map[string]time.Time // session -> expiry
+}
+
+type dashboardGrant struct {
+	IP        string
+	User      string
+	Remaining string
+}
+
+type dashboardLockout struct {
+	IP        string
+	Failures  int
+	Locked    bool
+	Remaining string
+}
+
+type dashboardData struct {
+	LoggedIn   bool
+	TokenLogin bool // offer the ADMIN_TOKEN login form
+	Failed     bool
+	CSRF       string
+	Grants     []dashboardGrant
+	Lockouts   []dashboardLockout
+	Events     []event
+}
+
+// adminIdentity returns the cookie value that proves dashboard access (used to
+// derive the CSRF token) and the name to log actions under, or "" if the
+// request isn't allowed in.
+func (h *Handlers) adminIdentity(g *gin.Context) (string, string) {
+	if user := h.currentUser(g); user != "" && h.live().adminUsers[user] {
+		session, _ := g.Cookie(userCookie)
+		return session, user
+	}
+
+	session, err := g.Cookie(adminCookie)
+	if err != nil || session == "" {
+		return "", ""
+	}
+
+	h.admin.lock.Lock()
+	defer h.admin.lock.Unlock()
+
+	expires, ok := h.admin.sessions[session]
+	if !ok || time.Now().After(expires) {
+		delete(h.admin.sessions, session)
+		return "", ""
+	}
+	return session, "admin token"
+}
+
+// csrfToken binds a form to the admin's session cookie.
+func (h *Handlers) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, h.csrfKey)
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkAdminPost verifies access and the CSRF token for a dashboard action.
+func (h *Handlers) checkAdminPost(g *gin.Context) (string, bool) {
+	session, who := h.adminIdentity(g)
+	if session == "" {
+		g.Status(http.StatusUnauthorized)
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(g.PostForm("csrf")), []byte(h.csrfToken(session))) != 1 {
+		slog.Warn("Rejecting admin action", "event", "admin_dashboard", "ip", h.clientIP(g), "user", who, "decision", "deny", "reason", "bad_csrf")
+		g.Status(http.StatusForbidden)
+		return "", false
+	}
+	return who, true
+}
+
+// AdminDashboard renders active grants, lockouts (on every replica, with a
+// shared store) and recent events, or the token login form.
+func (h *Handlers) AdminDashboard(g *gin.Context) {
+	session, _ := h.adminIdentity(g)
+	if session == "" {
+		h.renderDashboard(g, dashboardData{TokenLogin: h.live().adminToken != "", Failed: g.Query("failed") != ""})
+		return
+	}
+
+	h.refreshAllFromShared()
+	now := time.Now()
+	data := dashboardData{LoggedIn: true, CSRF: h.csrfToken(session), Events: h.events.recent()}
+
+	h.grantedLock.Lock()
+	for _, a := range h.granted {
+		p := snapshotPersisted(a)
+		remaining := p.AuthedTime.Add(h.expirationDuration()).Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+		data.Grants = append(data.Grants, dashboardGrant{IP: p.IP, User: p.User, Remaining: humanDuration(remaining)})
+	}
+	h.grantedLock.Unlock()
+	sort.Slice(data.Grants, func(i, j int) bool {
+		if data.Grants[i].IP != data.Grants[j].IP {
+			return data.Grants[i].IP < data.Grants[j].IP
+		}
+		return data.Grants[i].User < data.Grants[j].User
+	})
+
+	h.loginLock.Lock()
+	for ip, a := range h.loginAttempts {
+		l := dashboardLockout{IP: ip, Failures: a.failures}
+		if remaining := a.lockedUntil.Sub(now); remaining > 0 {
+			l.Locked = true
+			l.Remaining = humanDuration(remaining)
+		}
+		data.Lockouts = append(data.Lockouts, l)
+	}
+	h.loginLock.Unlock()
+	sort.Slice(data.Lockouts, func(i, j int) bool { return data.Lockouts[i].IP < data.Lockouts[j].IP })
+
+	h.renderDashboard(g, data)
+}
+
+func (h *Handlers) renderDashboard(g *gin.Context, data dashboardData) {
+	g.Header("Cache-Control", "no-store")
+	if err := h.Templates.ExecuteTemplate(g.Writer, "admin", data); err != nil {
+		slog.Error("Failed to render admin page", "err", err)
+		g.Status(http.StatusInternalServerError)
+	}
+}
+
+// AdminLogin exchanges ADMIN_TOKEN for a dashboard session cookie. Failures
+// count towards the same per-IP lockout as unlock attempts.
+func (h *Handlers) AdminLogin(g *gin.Context) {
+	ip := h.clientIP(g)
+	if h.rejectLockedOut(g, ip) {
+		return
+	}
+
+	token := g.PostForm("token")
+	adminToken := h.live().adminToken
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		h.registerFailedLogin(ip, "")
+		slog.Info("Failed admin login", "event", "admin_login", "ip", ip, "decision", "deny", "reason", "bad_token")
+		g.Redirect(http.StatusSeeOther, "/admin?failed=1")
+		return
+	}
+
+	session, err := generateSession()
+	if err != nil {
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+	h.admin.lock.Lock()
+	if h.admin.sessions == nil {
+		h.admin.sessions = make(map[string]time.Time)
+	}
+	h.admin.sessions[session] = time.Now().Add(adminSessionTTL)
+	h.admin.lock.Unlock()
+
+	h.clearLoginAttempts(ip)
+	slog.Info("Admin logged in to dashboard", "event", "admin_login", "ip", ip, "decision", "allow")
+	g.SetSameSite(http.SameSiteStrictMode)
+	g.SetCookie(adminCookie, session, int(adminSessionTTL.Seconds()), "/admin", "", true, true)
+	g.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// AdminLogout ends a token dashboard session.
+func (h *Handlers) AdminLogout(g *gin.Context) {
+	if _, ok := h.checkAdminPost(g); !ok {
+		return
+	}
+
+	if session, err := g.Cookie(adminCookie); err == nil {
+		h.admin.lock.Lock()
+		delete(h.admin.sessions, session)
+		h.admin.lock.Unlock()
+	}
+	g.SetSameSite(http.SameSiteStrictMode)
+	g.SetCookie(adminCookie, "", -1, "/admin", "", true, true)
+	g.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// AdminDashboardRevoke removes an IP's grants from the dashboard.
+func (h *Handlers) AdminDashboardRevoke(g *gin.Context) {
+	who, ok := h.checkAdminPost(g)
+	if !ok {
+		return
+	}
+
+	ip := g.PostForm("ip")
+	for _, p := range h.revokeGrants(func(a *authed) bool { return a.IP == ip }) {
+		slog.Info("Admin revoked grant", "event", "admin_revoked", "ip", ip, "grant_user", p.User, "user", who, "via", "dashboard")
+		h.events.add("revoked", ip, p.User, "by "+who)
+		h.audit.add("admin_revoked", ip, p.User, sessionFingerprintOfHash(p.SessionHash), "via dashboard by "+who)
+		h.syncGrant(p.key())
+	}
+	g.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// AdminDashboardUnlock clears failures and any lockout for an IP.
+func (h *Handlers) AdminDashboardUnlock(g *gin.Context) {
+	who, ok := h.checkAdminPost(g)
+	if !ok {
+		return
+	}
+
+	ip := g.PostForm("ip")
+	h.clearLoginAttempts(ip)
+	slog.Info("Admin cleared lockout", "event", "admin_lockout_cleared", "ip", ip, "user", who, "via", "dashboard")
+	h.events.add("lockout_cleared", ip, "", "by "+who)
+	h.audit.add("admin_lockout_cleared", ip, "", "", "via dashboard by "+who)
+	g.Redirect(http.StatusSeeOther, "/admin")
+}
+
+// pruneAdminSessions drops expired dashboard logins.
+func (h *Handlers) pruneAdminSessions(now time.Time) {
+	h.admin.lock.Lock()
+	defer h.admin.lock.Unlock()
+
+	for session, expires := range h.admin.sessions {
+		if now.After(expires) {
+			delete(h.admin.sessions, session)
+		}
+	}
+}
+
+// humanDuration formats a remaining lifetime for people, e.g. "29d 4h" or
+// "12m".
+func humanDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return formatUnits(int(d/(24*time.Hour)), "d", int(d%(24*time.Hour)/time.Hour), "h")
+	case d >= time.Hour:
+		return formatUnits(int(d/time.Hour), "h", int(d%time.Hour/time.Minute), "m")
+	case d >= time.Minute:
+		return formatUnits(int(d/time.Minute), "m", 0, "")
+	default:
+		return "<1m"
+	}
+}
+
+func formatUnits(major int, majorUnit string, minor int, minorUnit string) string {
+	s := strconv.Itoa(major) + majorUnit
+	if minor > 0 {
+		s += " " + strconv.Itoa(minor) + minorUnit
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestDashboardRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	r.GET("/admin", h.AdminDashboard)
+	r.POST("/admin/login", h.AdminLogin)
+	r.POST("/admin/logout", h.AdminLogout)
+	r.POST("/admin/grants/revoke", h.AdminDashboardRevoke)
+	r.POST("/admin/lockouts/clear", h.AdminDashboardUnlock)
+	return r
+}
+
+func newTestDashboardHandlers(t *testing.T) *Handlers {
+	t.Helper()
+
+	h := newTestAdminHandlers(t)
+	h.Templates = template.Must(template.ParseGlob("src/*.html"))
+	h.csrfKey = []byte("test-csrf-key")
+	h.events = newEventLog(10)
+	return h
+}
+
+func dashboardRequest(r *gin.Engine, method, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Gateway-Client-IP", "192.0.2.1")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// dashboardLogin logs in with the admin token and returns the session cookie.
+func dashboardLogin(t *testing.T, r *gin.Engine) *http.Cookie {
+	t.Helper()
+
+	w := dashboardRequest(r, http.MethodPost, "/admin/login", url.Values{"token": {testAdminToken}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin" {
+		t.Fatalf("expected redirect to the dashboard, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == adminCookie && c.Value != "" {
+			return c
+		}
+	}
+	t.Fatal("expected an admin session cookie")
+	return nil
+}
+
+func TestDashboardShowsLoginFormWithoutSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestDashboardHandlers(t)
+	r := newTestDashboardRouter(h)
+
+	w := dashboardRequest(r, http.MethodGet, "/admin", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="token"`) {
+		t.Fatalf("expected the token login form, got %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "203.0.113.10") {
+		t.Fatal("expected grants to be hidden before login")
+	}
+
+	w = dashboardRequest(r, http.MethodPost, "/admin/login", url.Values{"token": {"wrong"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin?failed=1" {
+		t.Fatalf("expected redirect back with an error, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("expected no cookie for a wrong token")
+	}
+}
+
+func TestDashboardTokenLoginListsGrants(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestDashboardHandlers(t)
+	r := newTestDashboardRouter(h)
+	h.registerFailedLogin("198.51.100.7", "")
+
+	cookie := dashboardLogin(t, r)
+	w := dashboardRequest(r, http.MethodGet, "/admin", nil, cookie)
+	body := w.Body.String()
+	for _, want := range []string{"203.0.113.10", "203.0.113.12", "198.51.100.7", "unlock_failed", h.csrfToken(cookie.Value)} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected dashboard to contain %q, got %s", want, body)
+		}
+	}
+	if strings.Contains(body, "alice-session") {
+		t.Fatal("expected raw sessions to be hidden")
+	}
+}
+
+func TestDashboardRevokeRequiresCSRFToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestDashboardHandlers(t)
+	r := newTestDashboardRouter(h)
+	cookie := dashboardLogin(t, r)
+
+	form := url.Values{"ip": {"203.0.113.12"}, "csrf": {"forged"}}
+	if w := dashboardRequest(r, http.MethodPost, "/admin/grants/revoke", form, cookie); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a bad CSRF token, got %d", w.Code)
+	}
+	form.Set("csrf", h.csrfToken(cookie.Value))
+	if w := dashboardRequest(r, http.MethodPost, "/admin/grants/revoke", form); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin cookie, got %d", w.Code)
+	}
+	if findTestGrant(h, "203.0.113.12") == nil {
+		t.Fatal("expected the grant to survive rejected requests")
+	}
+
+	if w := dashboardRequest(r, http.MethodPost, "/admin/grants/revoke", form, cookie); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect after revoking, got %d", w.Code)
+	}
+	if findTestGrant(h, "203.0.113.12") != nil {
+		t.Fatal("expected the grant to be revoked")
+	}
+	if events := h.events.recent(); len(events) == 0 || events[0].Kind != "revoked" || events[0].IP != "203.0.113.12" {
+		t.Fatalf("expected a revoked event, got %#v", events)
+	}
+}
+
+func TestDashboardAllowsAdminUsersSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestDashboardHandlers(t)
+	h.settings.adminToken = ""
+	h.settings.adminUsers = map[string]bool{"bob": true}
+	r := newTestDashboardRouter(h)
+
+	putTestUserSession(h, "bob-login", "bob")
+	putTestUserSession(h, "alice-login", "alice")
+
+	bob := &http.Cookie{Name: userCookie, Value: "bob-login"}
+	w := dashboardRequest(r, http.MethodGet, "/admin", nil, bob)
+	if !strings.Contains(w.Body.String(), h.csrfToken("bob-login")) {
+		t.Fatalf("expected bob to see the dashboard, got %s", w.Body.String())
+	}
+
+	alice := &http.Cookie{Name: userCookie, Value: "alice-login"}
+	w = dashboardRequest(r, http.MethodGet, "/admin", nil, alice)
+	if strings.Contains(w.Body.String(), "203.0.113.12") {
+		t.Fatal("expected alice, who isn't an admin, to be kept out")
+	}
+
+	// Bob's grant cookie is handed out per IP, so whoever shares his IP could
+	// hold it; it must not open the dashboard.
+	grant := &http.Cookie{Name: h.cookieName, Value: "bob-session"}
+	w = dashboardRequest(r, http.MethodGet, "/admin", nil, grant)
+	if strings.Contains(w.Body.String(), "203.0.113.12") {
+		t.Fatal("expected bob's grant cookie not to open the dashboard")
+	}
+	form := url.Values{"ip": {"203.0.113.12"}, "csrf": {h.csrfToken("bob-session")}}
+	if w := dashboardRequest(r, http.MethodPost, "/admin/grants/revoke", form, grant); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a revoke with bob's grant cookie, got %d", w.Code)
+	}
+
+	for i := 0; i < h.settings.maxLoginFailures; i++ {
+		h.registerFailedLogin("198.51.100.7", "")
+	}
+	form = url.Values{"ip": {"198.51.100.7"}, "csrf": {h.csrfToken("bob-login")}}
+	if w := dashboardRequest(r, http.MethodPost, "/admin/lockouts/clear", form, bob); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect after clearing, got %d", w.Code)
+	}
+	if locked, _ := h.isLockedOut("198.51.100.7"); locked {
+		t.Fatal("expected the lockout to be cleared")
+	}
+}
+
+func TestEventLogKeepsNewestFirst(t *testing.T) {
+	l := newEventLog(3)
+	for _, ip := range []string{"a", "b", "c", "d"} {
+		l.add("unlock", ip, "", "")
+	}
+
+	events := l.recent()
+	if len(events) != 3 || events[0].IP != "d" || events[2].IP != "b" {
+		t.Fatalf("expected the three newest events newest first, got %#v", events)
+	}
+
+	var nilLog *eventLog
+	nilLog.add("unlock", "a", "", "")
+	if nilLog.recent() != nil {
+		t.Fatal("expected a nil log to be a no-op")
+	}
+}
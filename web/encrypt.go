@@ -0,0 +1,109 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const persistCipherName = "aes-256-gcm"
+
+// persistAAD ties the ciphertext to its purpose, so a blob sealed with the
+// same key for something else doesn't open as a persist file.
+var persistAAD = []byte("gateway persist file")
+
+var errPersistEncrypted = errors.New("persist file is encrypted but neither PERSIST_KEY nor PERSIST_KEY_FILE is set")
+
+// sealedPersist is an encrypted persist file. The plaintext is the usual
+// persistEnvelope (or an older format, migrated after decrypting).
+type sealedPersist struct {
+	Encrypted string `json:"encrypted"`
+	Nonce     []byte `json:"nonce"`
+	Data      []byte `json:"data"`
+}
+
+// persistCipher returns the AEAD for the persist file, or nil if encryption
+// isn't configured. The key is 32 bytes, base64-encoded, from PERSIST_KEY or
+// the file named by PERSIST_KEY_FILE.
+func persistCipher(c *StorageConfig) (cipher.AEAD, error) {
+	encoded := c.PersistKey
+	if c.PersistKeyFile != "" {
+		if encoded != "" {
+			return nil, errors.New("set only one of PERSIST_KEY and PERSIST_KEY_FILE")
+		}
+		data, err := os.ReadFile(c.PersistKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading PERSIST_KEY_FILE: %w", err)
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("persist key is not valid base64: %w", err)
+	}
+	return newPersistCipher(key)
+}
+
+func newPersistCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("persist key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPersisted encrypts a persist file's contents, or returns them as is
+// without a cipher.
+func sealPersisted(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	if aead == nil {
+		return plain, nil
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedPersist{
+		Encrypted: persistCipherName,
+		Nonce:     nonce,
+		Data:      aead.Seal(nil, nonce, plain, persistAAD),
+	})
+}
+
+// openPersisted decrypts data if it is a sealed persist file and reports
+// whether it was.
+func openPersisted(aead cipher.AEAD, data []byte) ([]byte, bool, error) {
+	var sealed sealedPersist
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Encrypted == "" {
+		// Not sealed (or not JSON, which the caller reports).
+		return data, false, nil
+	}
+	if sealed.Encrypted != persistCipherName {
+		return nil, true, fmt.Errorf("persist file uses unknown cipher %q", sealed.Encrypted)
+	}
+	if aead == nil {
+		return nil, true, errPersistEncrypted
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, true, errors.New("persist file has a malformed nonce")
+	}
+
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Data, persistAAD)
+	if err != nil {
+		return nil, true, errors.New("decrypting persist file failed: wrong key or corrupted file")
+	}
+	return plain, true, nil
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPersistCipher(t *testing.T, seed byte) cipher.AEAD {
+	t.Helper()
+
+	aead, err := newPersistCipher(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	return aead
+}
+
+func TestJSONStoreEncryptsGrants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "granted.json")
+	s := newJSONStore(path, "")
+	s.aead = newTestPersistCipher(t, 1)
+
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: time.Now(), SessionHash: hashSession("a"), User: "alice"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, leak := range []string{"203.0.113.1", "alice", hashSession("a")} {
+		if strings.Contains(string(data), leak) {
+			t.Fatalf("expected %q to be encrypted, got %s", leak, data)
+		}
+	}
+
+	grants, err := readPersisted(path, newTestPersistCipher(t, 1))
+	if err != nil || len(grants) != 1 || grants[0].User != "alice" {
+		t.Fatalf("expected the grant back, got %#v (%v)", grants, err)
+	}
+	if _, err := readPersisted(path, newTestPersistCipher(t, 2)); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Fatalf("expected the wrong key to fail, got %v", err)
+	}
+	if _, err := readPersisted(path, nil); err != errPersistEncrypted {
+		t.Fatalf("expected a missing key to fail, got %v", err)
+	}
+}
+
+func TestReadPersistedEncryptsPlaintextFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "granted.json")
+	original := `[{"ip":"203.0.113.1","authed_time":"` + time.Now().Format(time.RFC3339) + `","session":"secret-session"}]`
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatalf("write persist file: %v", err)
+	}
+
+	aead := newTestPersistCipher(t, 1)
+	grants, err := readPersisted(path, aead)
+	if err != nil || len(grants) != 1 || grants[0].SessionHash != hashSession("secret-session") {
+		t.Fatalf("expected the hashed grant, got %#v (%v)", grants, err)
+	}
+
+	for _, file := range []string{path, persistBackupPath(path, 0)} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read %s: %v", file, err)
+		}
+		if strings.Contains(string(data), "secret-session") || strings.Contains(string(data), "203.0.113.1") {
+			t.Fatalf("expected %s to be encrypted, got %s", file, data)
+		}
+	}
+
+	// The sealed backup still opens, in the original format.
+	backup, _ := os.ReadFile(persistBackupPath(path, 0))
+	if plain, sealed, err := openPersisted(aead, backup); err != nil || !sealed || !strings.HasPrefix(string(plain), "[") || !strings.Contains(string(plain), hashSession("secret-session")) {
+		t.Fatalf("expected the backup to decrypt to the original grants, got %q %v (%v)", plain, sealed, err)
+	}
+}
+
+func TestPersistCipher(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	if aead, err := persistCipher(&StorageConfig{}); aead != nil || err != nil {
+		t.Fatalf("expected no cipher by default, got %v (%v)", aead, err)
+	}
+
+	if aead, err := persistCipher(&StorageConfig{PersistKey: key}); aead == nil || err != nil {
+		t.Fatalf("expected a cipher from PERSIST_KEY, got %v", err)
+	}
+
+	if _, err := persistCipher(&StorageConfig{PersistKey: base64.StdEncoding.EncodeToString([]byte("short"))}); err == nil {
+		t.Fatal("expected a short key to be rejected")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "persist.key")
+	if err := os.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	if aead, err := persistCipher(&StorageConfig{PersistKeyFile: keyFile}); aead == nil || err != nil {
+		t.Fatalf("expected a cipher from PERSIST_KEY_FILE, got %v", err)
+	}
+}
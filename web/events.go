@@ -0,0 +1,69 @@
+package web
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultEventLogSize is how many recent events the admin dashboard shows.
+const defaultEventLogSize = 50
+
+// event is a security-relevant occurrence kept for the admin dashboard.
+type event struct {
+	Time   time.Time
+	Kind   string
+	IP     string
+	User   string
+	Detail string
+}
+
+// eventLog is a fixed-size ring buffer of recent events. A nil *eventLog is a
+// valid no-op so handlers built without one (e.g. in tests) still work.
+type eventLog struct {
+	lock   sync.Mutex
+	events []event
+	next   int
+	full   bool
+}
+
+func newEventLog(size int) *eventLog {
+	if size <= 0 {
+		size = defaultEventLogSize
+	}
+	return &eventLog{events: make([]event, size)}
+}
+
+func (l *eventLog) add(kind, ip, user, detail string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.events[l.next] = event{Time: time.Now(), Kind: kind, IP: ip, User: user, Detail: detail}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the buffered events, newest first.
+func (l *eventLog) recent() []event {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.events)
+	}
+	out := make([]event, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.events[(l.next-i+len(l.events))%len(l.events)])
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forwardAuth adapts access checks to proxies that pass the check's response
+// straight to the browser (Traefik ForwardAuth, Caddy forward_auth): a denied
+// page load is redirected to the unlock page, with the URL it asked for as
+// the return parameter so the browser comes back after unlocking. The unlock
+// page must not itself sit behind the check.
+type forwardAuth struct {
+	unlockURL    *url.URL
+	allowedHosts []string // return URLs must be on one of these or a subdomain
+}
+
+// newForwardAuth returns nil unless FORWARD_AUTH is enabled. Return URLs are
+// limited to FORWARD_AUTH_ALLOWED_HOSTS, or by default COOKIE_DOMAIN and the
+// unlock page's own host, so /unlock?return= can't be used as an open
+// redirect.
+func newForwardAuth(c *ForwardAuthConfig, cookieDomain string) *forwardAuth {
+	if !c.Enabled {
+		return nil
+	}
+	unlockURL, err := url.Parse(c.UnlockURL)
+	if err != nil {
+		fatal("Invalid FORWARD_AUTH_UNLOCK_URL", "err", err) // checked by Config.Validate
+		return nil
+	}
+
+	f := &forwardAuth{unlockURL: unlockURL, allowedHosts: []string{unlockURL.Hostname()}}
+	hosts := c.AllowedHosts
+	if len(hosts) == 0 && cookieDomain != "" {
+		hosts = []string{cookieDomain}
+	}
+	for _, host := range hosts {
+		f.allowedHosts = append(f.allowedHosts, strings.ToLower(strings.TrimPrefix(host, ".")))
+	}
+	return f
+}
+
+// safeReturn returns raw if it is an absolute http(s) URL on an allowed host,
+// or "".
+func (f *forwardAuth) safeReturn(raw string) string {
+	if f == nil || raw == "" || len(raw) > 2048 {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.allowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// originalURL rebuilds the URL the browser asked the proxy for from the
+// X-Forwarded-Host, X-Forwarded-Uri and X-Forwarded-Proto headers.
+func originalURL(r *http.Request) string {
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	proto := firstHeaderValue(r, "X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return proto + "://" + host + uri
+}
+
+// firstHeaderValue returns the first entry of a possibly comma separated
+// header, as set by the proxy nearest the client.
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// unlockRedirect returns where to send a denied request, or "" to answer 401.
+// Only page loads (GET or HEAD, per X-Forwarded-Method) are redirected; an
+// API call or form post can't follow the unlock page back.
+func (f *forwardAuth) unlockRedirect(r *http.Request) string {
+	method := r.Header.Get("X-Forwarded-Method")
+	if method == "" {
+		method = r.Method
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		return ""
+	}
+
+	target := *f.unlockURL
+	if ret := f.safeReturn(originalURL(r)); ret != "" {
+		query := target.Query()
+		query.Set("return", ret)
+		target.RawQuery = query.Encode()
+	}
+	return target.String()
+}
+
+// denyAccess answers a failed access check: 401, or with FORWARD_AUTH a
+// redirect to the unlock page.
+func (h *Handlers) denyAccess(g *gin.Context) {
+	if h.forwardAuth != nil {
+		if target := h.forwardAuth.unlockRedirect(g.Request); target != "" {
+			g.Redirect(http.StatusFound, target)
+			return
+		}
+	}
+	g.Status(http.StatusUnauthorized)
+}
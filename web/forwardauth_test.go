@@ -0,0 +1,126 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestForwardAuth() *forwardAuth {
+	return newForwardAuth(&ForwardAuthConfig{Enabled: true, UnlockURL: "https://gateway.example.com/unlock"}, ".example.com")
+}
+
+func forwardAuthCheck(h *Handlers, method string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.RemoteAddr = "203.0.113.50:12345"
+	c.Request.Header.Set("X-Forwarded-Method", method)
+	for name, value := range headers {
+		c.Request.Header.Set(name, value)
+	}
+	h.AccessPage(c)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestAccessPageRedirectsWithForwardAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.forwardAuth = newTestForwardAuth()
+	headers := map[string]string{
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Uri":   "/reports?year=2024",
+		"X-Forwarded-Proto": "https",
+	}
+
+	w := forwardAuthCheck(&h, http.MethodGet, headers)
+	want := "https://gateway.example.com/unlock?return=" + url.QueryEscape("https://app.example.com/reports?year=2024")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+		t.Fatalf("expected a redirect to %s, got %d %q", want, w.Code, w.Header().Get("Location"))
+	}
+
+	if w := forwardAuthCheck(&h, http.MethodPost, headers); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a denied form post to get 401, got %d", w.Code)
+	}
+
+	headers["X-Forwarded-Host"] = "evil.example.net"
+	if w := forwardAuthCheck(&h, http.MethodGet, headers); w.Header().Get("Location") != "https://gateway.example.com/unlock" {
+		t.Fatalf("expected no return URL for a host outside the allowed ones, got %q", w.Header().Get("Location"))
+	}
+
+	h.forwardAuth = nil
+	if w := forwardAuthCheck(&h, http.MethodGet, headers); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without FORWARD_AUTH, got %d", w.Code)
+	}
+}
+
+func TestSafeReturnRejectsOtherHosts(t *testing.T) {
+	f := newTestForwardAuth()
+	for raw, want := range map[string]bool{
+		"https://app.example.com/x":          true,
+		"http://example.com/":                true,
+		"https://gateway.example.com/unlock": true,
+		"https://example.com.evil.net/":      false,
+		"https://user@app.example.com/":      false,
+		"javascript:alert(1)":                false,
+		"//app.example.com/":                 false,
+		"/relative":                          false,
+	} {
+		if got := f.safeReturn(raw) != ""; got != want {
+			t.Fatalf("safeReturn(%q) allowed = %v, want %v", raw, got, want)
+		}
+	}
+
+	var disabled *forwardAuth
+	if disabled.safeReturn("https://app.example.com/") != "" {
+		t.Fatal("expected no return URLs without FORWARD_AUTH")
+	}
+}
+
+func TestUnlockRedirectsToReturnURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.settings.unlockPasswd = testPassword
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	h.forwardAuth = newTestForwardAuth()
+
+	status, w := postUnlockForm(&h, "203.0.113.7", url.Values{"pass": {testPassword}, "return": {"https://app.example.com/reports"}})
+	if status != http.StatusSeeOther || w.Header().Get("Location") != "https://app.example.com/reports" {
+		t.Fatalf("expected a redirect back after unlocking, got %d %q", status, w.Header().Get("Location"))
+	}
+
+	status, w = postUnlockForm(&h, "203.0.113.8", url.Values{"pass": {testPassword}, "return": {"https://evil.example.net/"}})
+	if status != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Fatalf("expected the page without a redirect for a disallowed return URL, got %d %q", status, w.Header().Get("Location"))
+	}
+
+	status, w = postUnlockForm(&h, "203.0.113.9", url.Values{"pass": {"wrong"}, "return": {"https://app.example.com/reports"}})
+	if status != http.StatusUnauthorized || w.Header().Get("Location") != "" {
+		t.Fatalf("expected a failed unlock not to redirect, got %d %q", status, w.Header().Get("Location"))
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestValidateChecksForwardAuth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ForwardAuth.Enabled = true
+	cfg.ForwardAuth.AllowedHosts = []string{"https://example.com"}
+
+	err := cfg.Validate()
+	for _, want := range []string{"FORWARD_AUTH_UNLOCK_URL", "FORWARD_AUTH_ALLOWED_HOSTS"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
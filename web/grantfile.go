@@ -0,0 +1,232 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// GrantFile is the persist file opened for offline maintenance (the gateway
+// CLI). It reads and writes through the same code as the server, so records
+// are repaired and saved exactly as a restart would. Changes made while the
+// server is running are overwritten by its next save.
+type GrantFile struct {
+	h *Handlers
+
+	// Problems found while loading, reported by Verify, as grant keys (the
+	// IP, or IP/user for a user's grant).
+	duplicates      []string
+	missingSessions []string
+	invalid         []string
+
+	// Keys of revoked and pruned grants, deleted explicitly on Save for
+	// shared stores (whose replaceGrants never deletes).
+	removed []string
+}
+
+// Grant is one persisted grant as shown by the CLI.
+type Grant struct {
+	IP                 string
+	User               string
+	AuthedTime         time.Time
+	ExpiresAt          time.Time
+	Expired            bool
+	SessionFingerprint string
+}
+
+// VerifyReport summarizes the state of a persist file.
+type VerifyReport struct {
+	Records         int
+	Expired         []string
+	Duplicates      []string
+	MissingSessions []string
+	Invalid         []string
+	RemovedUsers    []string // grants of users no longer in USERS_FILE
+}
+
+// OK reports whether the file needs no repair.
+func (r VerifyReport) OK() bool {
+	return len(r.Expired) == 0 && len(r.Duplicates) == 0 && len(r.MissingSessions) == 0 &&
+		len(r.Invalid) == 0 && len(r.RemovedUsers) == 0
+}
+
+// OpenGrantFile loads the grants using the server's config (storage,
+// expiration and, if set, the users file). Unlike startup, expired and
+// removed-user records are kept so they can be listed and verified. A missing
+// file opens empty.
+func OpenGrantFile(cfg *Config) (*GrantFile, error) {
+	h := &Handlers{
+		persistFile:    cfg.Storage.PersistFile,
+		expirationDays: cfg.Auth.ExpirationDays,
+		granted:        make(map[string]*authed),
+	}
+	if usersFile := cfg.Auth.UsersFile; usersFile != "" {
+		users, err := loadUserStore(usersFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading users file %s: %w", usersFile, err)
+		}
+		h.users = users
+	}
+
+	store, err := openStore(&cfg.Storage, h.expirationDuration())
+	if err != nil {
+		return nil, err
+	}
+	h.store = store
+
+	f := &GrantFile{h: h}
+	persisted, err := store.loadGrants()
+	if err != nil && !os.IsNotExist(err) {
+		store.close()
+		return nil, err
+	}
+
+	for _, p := range persisted {
+		a, repaired, err := authedFromPersisted(p)
+		if err != nil {
+			f.invalid = append(f.invalid, fmt.Sprintf("%q: %v", p.IP, err))
+			continue
+		}
+		if net.ParseIP(a.IP) == nil {
+			f.invalid = append(f.invalid, fmt.Sprintf("%q: not an IP address", a.IP))
+		}
+		if repaired {
+			f.missingSessions = append(f.missingSessions, a.key())
+		}
+		if existing := h.granted[a.key()]; existing != nil {
+			mergeAuthRecords(existing, a)
+			f.duplicates = append(f.duplicates, a.key())
+			continue
+		}
+		h.putGrantedLocked(a)
+	}
+	return f, nil
+}
+
+// Path is the persist file being edited. With the SQLite backend it only
+// locates the database.
+func (f *GrantFile) Path() string {
+	return f.h.persistFile
+}
+
+// List returns every grant, including expired ones, sorted by IP and user.
+func (f *GrantFile) List() []Grant {
+	now := time.Now()
+	grants := make([]Grant, 0, len(f.h.granted))
+	for _, a := range f.h.granted {
+		grants = append(grants, f.view(a, now))
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].IP != grants[j].IP {
+			return grants[i].IP < grants[j].IP
+		}
+		return grants[i].User < grants[j].User
+	})
+	return grants
+}
+
+func (f *GrantFile) view(a *authed, now time.Time) Grant {
+	p := snapshotPersisted(a)
+	return Grant{
+		IP:                 p.IP,
+		User:               p.User,
+		AuthedTime:         p.AuthedTime,
+		ExpiresAt:          p.AuthedTime.Add(f.h.expirationDuration()),
+		Expired:            f.h.recordExpiredAt(a, now),
+		SessionFingerprint: sessionFingerprintOfHash(p.SessionHash),
+	}
+}
+
+// Add grants ip to user for ttl, replacing any existing grant of that user on
+// it. ttl can't exceed
+// IP_EXPIRATION_DAYS; zero means the full period.
+func (f *GrantFile) Add(ip, user string, ttl time.Duration) (Grant, error) {
+	if net.ParseIP(ip) == nil {
+		return Grant{}, fmt.Errorf("%q is not an IP address", ip)
+	}
+	full := f.h.expirationDuration()
+	if ttl == 0 {
+		ttl = full
+	}
+	if ttl < 0 || ttl > full {
+		return Grant{}, fmt.Errorf("ttl must be between 0 and %v", full)
+	}
+
+	// Grants expire a fixed period after AuthedTime, so a shorter ttl is an
+	// AuthedTime in the past.
+	now := time.Now()
+	a, err := newAuthed(ip, user, now.Add(ttl-full))
+	if err != nil {
+		return Grant{}, err
+	}
+	f.h.putGrantedLocked(a)
+	return f.view(a, now), nil
+}
+
+// Revoke removes every grant on ip and reports whether there were any.
+func (f *GrantFile) Revoke(ip string) bool {
+	return len(f.revoke(func(a *authed) bool { return a.IP == ip })) > 0
+}
+
+// Prune removes expired grants and grants of removed users, returning their
+// keys.
+func (f *GrantFile) Prune() []string {
+	now := time.Now()
+	// revokeGrants already holds the record lock while matching.
+	return f.revoke(func(a *authed) bool {
+		return now.Sub(a.AuthedTime) > f.h.expirationDuration() || f.h.userRevoked(a.User)
+	})
+}
+
+// revoke removes the matching grants, noting them for Save, and returns their
+// keys.
+func (f *GrantFile) revoke(match func(*authed) bool) []string {
+	var keys []string
+	for _, p := range f.h.revokeGrants(match) {
+		keys = append(keys, p.key())
+	}
+	f.removed = append(f.removed, keys...)
+	return keys
+}
+
+// Verify reports what loading the file had to repair and which records a
+// prune would drop.
+func (f *GrantFile) Verify() VerifyReport {
+	r := VerifyReport{
+		Records:         len(f.h.granted),
+		Duplicates:      f.duplicates,
+		MissingSessions: f.missingSessions,
+		Invalid:         f.invalid,
+	}
+	for _, g := range f.List() {
+		if g.Expired {
+			r.Expired = append(r.Expired, grantKey(g.IP, g.User))
+		}
+		if f.h.userRevoked(g.User) {
+			r.RemovedUsers = append(r.RemovedUsers, grantKey(g.IP, g.User))
+		}
+	}
+	return r
+}
+
+// Save writes the grants back atomically.
+func (f *GrantFile) Save() error {
+	if shared := f.h.shared(); shared != nil {
+		for _, key := range f.removed {
+			if err := shared.deleteGrant(key); err != nil {
+				return err
+			}
+		}
+	}
+	f.removed = nil
+
+	_, err := f.h.writeGranted()
+	return err
+}
+
+// Close releases the store.
+func (f *GrantFile) Close() error {
+	return f.h.store.close()
+}
@@ -1,7 +1,7 @@
 package web
 
 import (
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -18,6 +18,8 @@ type loginAttempt struct {
 // isLockedOut reports whether the IP is currently locked out and, if so, how
 // long remains.
 func (h *Handlers) isLockedOut(ip string) (bool, time.Duration) {
+	h.refreshLockoutFromShared(ip)
+
 	h.loginLock.Lock()
 	defer h.loginLock.Unlock()
 
@@ -31,17 +33,60 @@ func (h *Handlers) isLockedOut(ip string) (bool, time.Duration) {
 	return false, 0
 }
 
-// registerFailedLogin records a failed unlock for the IP and locks it out once
-// the failure threshold is reached.
-func (h *Handlers) registerFailedLogin(ip string) {
+// refreshLockoutFromShared copies ip's lockout state from a shared store, so
+// a lockout triggered on another replica applies here too.
+func (h *Handlers) refreshLockoutFromShared(ip string) {
+	shared := h.shared()
+	if shared == nil {
+		return
+	}
+	l, err := shared.lockout(ip)
+	if err != nil {
+		slog.Warn("Failed to read shared lockout state", "ip", ip, "err", err)
+		return
+	}
+
 	h.loginLock.Lock()
 	defer h.loginLock.Unlock()
+	if l == nil {
+		delete(h.loginAttempts, ip)
+		return
+	}
+	h.setLoginAttemptLocked(*l)
+}
 
+func (h *Handlers) setLoginAttemptLocked(l persistedLockout) {
 	if h.loginAttempts == nil {
 		h.loginAttempts = make(map[string]*loginAttempt)
 	}
+	h.loginAttempts[l.IP] = &loginAttempt{failures: l.Failures, lockedUntil: l.LockedUntil, lastSeen: l.LastSeen}
+}
 
+// registerFailedLogin records a failed unlock for the IP, attempted as user
+// ("" if none was given), and locks it out once the failure threshold is
+// reached. With a shared store the count is kept
+// there, so failures spread over replicas add up.
+func (h *Handlers) registerFailedLogin(ip, user string) {
 	now := time.Now()
+	settings := h.live()
+
+	if shared := h.shared(); shared != nil {
+		l, locked, err := shared.addFailure(ip, now, settings.maxLoginFailures, settings.lockoutDuration)
+		if err == nil {
+			h.loginLock.Lock()
+			h.setLoginAttemptLocked(l)
+			h.loginLock.Unlock()
+			h.recordFailedLogin(ip, user, locked, l.LockedUntil)
+			return
+		}
+		slog.Error("Failed to count failed login in shared store, counting locally", "ip", ip, "err", err)
+	}
+
+	h.loginLock.Lock()
+	if h.loginAttempts == nil {
+		h.loginAttempts = make(map[string]*loginAttempt)
+	}
+
 	a := h.loginAttempts[ip]
 	if a == nil {
 		a = &loginAttempt{}
@@ -50,10 +95,31 @@ func (h *Handlers) registerFailedLogin(ip string) {
 	a.lastSeen = now
 	a.failures++
 
-	if h.maxLoginFailures > 0 && a.failures >= h.maxLoginFailures {
-		a.lockedUntil = now.Add(h.lockoutDuration)
+	locked := false
+	if settings.maxLoginFailures > 0 && a.failures >= settings.maxLoginFailures {
+		a.lockedUntil = now.Add(settings.lockoutDuration)
 		a.failures = 0
-		log.Printf("Locking out %s until %v after repeated failed logins", ip, a.lockedUntil)
+		locked = true
+	}
+	lockedUntil := a.lockedUntil
+	h.loginLock.Unlock()
+
+	h.queueLockout(ip)
+	h.recordFailedLogin(ip, user, locked, lockedUntil)
+}
+
+// recordFailedLogin emits the events, audit records and metrics for a failed
+// unlock and, if it triggered one, the lockout.
+func (h *Handlers) recordFailedLogin(ip, user string, locked bool, lockedUntil time.Time) {
+	h.events.add("unlock_failed", ip, user, "")
+	h.audit.add("unlock_failed", ip, user, "", "")
+	h.metrics.unlock(false)
+
+	if locked {
+		slog.Warn("Locking out IP after repeated failed logins", "event", "lockout", "ip", ip, "until", lockedUntil)
+		h.events.add("lockout", ip, "", "until "+lockedUntil.Format(time.RFC3339))
+		h.audit.add("lockout", ip, "", "", "until "+lockedUntil.Format(time.RFC3339))
+		h.metrics.lockout()
 	}
 }
 
@@ -61,20 +127,35 @@ func (h *Handlers) registerFailedLogin(ip string) {
 // successful unlock.
 func (h *Handlers) clearLoginAttempts(ip string) {
 	h.loginLock.Lock()
-	defer h.loginLock.Unlock()
-
+	_, found := h.loginAttempts[ip]
 	delete(h.loginAttempts, ip)
+	h.loginLock.Unlock()
+
+	// Another replica may hold state for the IP that this one hasn't seen.
+	if found || h.shared() != nil {
+		h.syncLockout(ip)
+	}
 }
 
 // pruneLoginAttempts removes stale entries so the map can't grow unbounded from
 // a churn of distinct failing IPs.
 func (h *Handlers) pruneLoginAttempts(now time.Time) {
 	h.loginLock.Lock()
-	defer h.loginLock.Unlock()
-
+	var pruned []string
 	for ip, a := range h.loginAttempts {
 		if now.After(a.lockedUntil) && now.Sub(a.lastSeen) > time.Hour {
 			delete(h.loginAttempts, ip)
+			pruned = append(pruned, ip)
 		}
 	}
+	h.loginLock.Unlock()
+
+	// A shared store expires entries itself, and may have newer state from
+	// other replicas.
+	if h.shared() != nil {
+		return
+	}
+	for _, ip := range pruned {
+		h.syncLockout(ip)
+	}
 }
@@ -0,0 +1,44 @@
+package web
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ConfigureLogging installs the process-wide slog handler from LOG_FORMAT
+// ("text", the default, or "json") and LOG_LEVEL ("debug", "info", "warn" or
+// "error"; default "info"). The standard log package is routed through the
+// same handler at info level, so libraries that still use it come out in the
+// same format.
+func ConfigureLogging(c LogConfig) {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, c.Format, c.Level)))
+}
+
+func newLogHandler(w io.Writer, format, level string) slog.Handler {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			slog.Warn("Invalid LOG_LEVEL, using info", "value", level)
+			lvl = slog.LevelInfo
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	case "", "text":
+		return slog.NewTextHandler(w, opts)
+	default:
+		slog.Warn("Invalid LOG_FORMAT, using text", "value", format)
+		return slog.NewTextHandler(w, opts)
+	}
+}
+
+// fatal logs at error level and exits, for configuration errors at startup.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
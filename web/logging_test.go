@@ -0,0 +1,59 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// captureLogs routes slog to a buffer for the rest of the test.
+func captureLogs(t *testing.T, format, level string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, format, level)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestAccessRejectIsStructuredDebugEvent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	buf := captureLogs(t, "json", "debug")
+	h := newTestHandlers()
+	testAccess(&h, "198.51.100.1")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON log line, got %q (%v)", buf.String(), err)
+	}
+	want := map[string]any{"level": "DEBUG", "event": "access", "ip": "198.51.100.1", "decision": "deny", "reason": accessNoGrant, "host": "example.com"}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Fatalf("expected %s=%v, got %#v", k, v, entry)
+		}
+	}
+}
+
+func TestLogLevelHidesDebugRejects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	buf := captureLogs(t, "text", "info")
+	h := newTestHandlers()
+	testAccess(&h, "198.51.100.1")
+	if buf.Len() != 0 {
+		t.Fatalf("expected access rejects to be hidden at info, got %q", buf.String())
+	}
+
+	h.registerFailedLogin("198.51.100.1", "")
+	h.registerFailedLogin("198.51.100.1", "")
+	h.registerFailedLogin("198.51.100.1", "")
+	if !strings.Contains(buf.String(), "event=lockout") || !strings.Contains(buf.String(), "ip=198.51.100.1") {
+		t.Fatalf("expected a text lockout event, got %q", buf.String())
+	}
+}
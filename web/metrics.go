@@ -0,0 +1,192 @@
+package web
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons /access allowed or denied a request, used as the "reason" label.
+const (
+	accessCookie      = "cookie"
+	accessIPGrant     = "ip_grant"
+	accessLocalBypass = "local_bypass"
+	accessExpired     = "expired"
+	accessNoGrant     = "no_grant"
+)
+
+// metrics holds the Prometheus collectors. It uses its own registry so tests
+// can build as many Handlers as they like. A nil *metrics is a valid no-op,
+// like eventLog.
+type metrics struct {
+	registry *prometheus.Registry
+
+	access       *prometheus.CounterVec
+	unlocks      *prometheus.CounterVec
+	lockouts     prometheus.Counter
+	rateLimited  *prometheus.CounterVec
+	saveErrors   prometheus.Counter
+	saveDuration prometheus.Histogram
+
+	lockoutSaveErrors prometheus.Counter
+}
+
+func newMetrics(h *Handlers) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		access: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_access_total",
+			Help: "Access checks by result (allow/deny) and reason.",
+		}, []string{"result", "reason"}),
+		unlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_unlocks_total",
+			Help: "Unlock attempts by result (success/failure).",
+		}, []string{"result"}),
+		lockouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gateway_lockouts_total",
+			Help: "IPs locked out after repeated failed logins.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_rate_limited_total",
+			Help: "Requests rejected by a rate limiter.",
+		}, []string{"limiter"}),
+		saveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gateway_persist_save_errors_total",
+			Help: "Failed writes of the persist file.",
+		}),
+		saveDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gateway_persist_save_duration_seconds",
+			Help:    "Time taken to write the persist file.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}),
+		lockoutSaveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gateway_lockout_save_errors_total",
+			Help: "Failed writes of lockout state.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.access, m.unlocks, m.lockouts, m.rateLimited, m.saveErrors, m.saveDuration, m.lockoutSaveErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_granted_ips",
+			Help: "IPs with a grant, including ones not yet cleaned up after expiry.",
+		}, func() float64 { return float64(h.grantedCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_locked_out_ips",
+			Help: "IPs currently locked out.",
+		}, func() float64 { return float64(h.lockedOutCount(time.Now())) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_persist_pending_writes",
+			Help: "Grants and lockouts changed but not yet written to the store.",
+		}, func() float64 { return float64(h.writer.pending()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	// Start every series at zero so rate() works from the first scrape.
+	for _, reason := range []string{accessCookie, accessIPGrant, accessLocalBypass} {
+		m.access.WithLabelValues("allow", reason)
+	}
+	for _, reason := range []string{accessExpired, accessNoGrant} {
+		m.access.WithLabelValues("deny", reason)
+	}
+	m.unlocks.WithLabelValues("success")
+	m.unlocks.WithLabelValues("failure")
+	return m
+}
+
+func (m *metrics) accessAllowed(reason string) {
+	if m != nil {
+		m.access.WithLabelValues("allow", reason).Inc()
+	}
+}
+
+func (m *metrics) accessDenied(reason string) {
+	if m != nil {
+		m.access.WithLabelValues("deny", reason).Inc()
+	}
+}
+
+func (m *metrics) unlock(success bool) {
+	if m == nil {
+		return
+	}
+	if success {
+		m.unlocks.WithLabelValues("success").Inc()
+	} else {
+		m.unlocks.WithLabelValues("failure").Inc()
+	}
+}
+
+func (m *metrics) lockout() {
+	if m != nil {
+		m.lockouts.Inc()
+	}
+}
+
+func (m *metrics) persistSaved(took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.saveDuration.Observe(took.Seconds())
+	if err != nil {
+		m.saveErrors.Inc()
+	}
+}
+
+func (m *metrics) lockoutSaved(err error) {
+	if m != nil && err != nil {
+		m.lockoutSaveErrors.Inc()
+	}
+}
+
+func (h *Handlers) grantedCount() int {
+	return len(h.grantSnapshot().byIP)
+}
+
+func (h *Handlers) lockedOutCount(now time.Time) int {
+	h.loginLock.Lock()
+	defer h.loginLock.Unlock()
+
+	n := 0
+	for _, a := range h.loginAttempts {
+		if now.Before(a.lockedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// RateLimited counts a rejection by the named tollbooth limiter. Use it as the
+// limiter's OnLimitReached callback.
+func (h *Handlers) RateLimited(limiter string) func(http.ResponseWriter, *http.Request) {
+	return func(http.ResponseWriter, *http.Request) {
+		if h.metrics != nil {
+			h.metrics.rateLimited.WithLabelValues(limiter).Inc()
+		}
+	}
+}
+
+// MetricsHandler serves the Prometheus metrics, requiring
+// "Authorization: Bearer <METRICS_TOKEN>" when that is set. The token is read
+// per request, so a reload can set or change it.
+func (h *Handlers) MetricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(h.metrics.registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if metricsToken := h.live().metricsToken; metricsToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+				slog.Warn("Rejecting metrics request", "event", "metrics", "ip", r.RemoteAddr, "decision", "deny", "reason", "bad_token")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func scrapeTestMetrics(t *testing.T, h *Handlers, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	h.MetricsHandler().ServeHTTP(w, req)
+	return w
+}
+
+func testAccess(h *Handlers, ip string) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.Header.Set("X-Gateway-Client-IP", ip)
+	h.AccessPage(c)
+	return c.Writer.Status()
+}
+
+func TestMetricsCountAccessUnlocksAndLockouts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	h.metrics = newMetrics(&h)
+	putTestGrant(&h, &authed{IP: "203.0.113.10", AuthedTime: time.Now(), Session: "s1", SessionHash: hashSession("s1")})
+	putTestGrant(&h, &authed{IP: "203.0.113.11", AuthedTime: time.Now().Add(-40 * 24 * time.Hour), Session: "s2", SessionHash: hashSession("s2")})
+
+	testAccess(&h, "203.0.113.10")
+	testAccess(&h, "203.0.113.11")
+	testAccess(&h, "198.51.100.1")
+	testAccess(&h, "198.51.100.1")
+	for i := 0; i < h.settings.maxLoginFailures; i++ {
+		h.registerFailedLogin("198.51.100.7", "")
+	}
+	h.saveGranted()
+	h.RateLimited("auth")(nil, nil)
+
+	body := scrapeTestMetrics(t, &h, "").Body.String()
+	for _, want := range []string{
+		`gateway_access_total{reason="ip_grant",result="allow"} 1`,
+		`gateway_access_total{reason="expired",result="deny"} 1`,
+		`gateway_access_total{reason="no_grant",result="deny"} 2`,
+		`gateway_access_total{reason="cookie",result="allow"} 0`,
+		`gateway_unlocks_total{result="failure"} 3`,
+		`gateway_lockouts_total 1`,
+		`gateway_locked_out_ips 1`,
+		`gateway_granted_ips 2`,
+		`gateway_rate_limited_total{limiter="auth"} 1`,
+		`gateway_persist_save_duration_seconds_count 1`,
+		`gateway_persist_save_errors_total 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics output, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsHandlerRequiresToken(t *testing.T) {
+	h := newTestHandlers()
+	h.metrics = newMetrics(&h)
+	h.settings.metricsToken = "metrics-token"
+
+	if w := scrapeTestMetrics(t, &h, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+	if w := scrapeTestMetrics(t, &h, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", w.Code)
+	}
+	if w := scrapeTestMetrics(t, &h, "metrics-token"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "gateway_unlocks_total") {
+		t.Fatalf("expected metrics with the right token, got %d", w.Code)
+	}
+}
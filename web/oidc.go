@@ -0,0 +1,339 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcUserPrefix marks grants made through the identity provider. Those
+	// users don't exist in the users file, so they are never treated as removed
+	// by userRevoked.
+	oidcUserPrefix = "oidc:"
+
+	oidcStateCookie = "gateway_oidc_state"
+	oidcTimeout     = 10 * time.Second
+)
+
+// oidcLogin is the relying party side of an OIDC authorization code + PKCE
+// flow against a single issuer.
+type oidcLogin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+
+	allowedSubjects map[string]bool
+	allowedEmails   map[string]bool
+	allowedGroups   map[string]bool
+	groupsClaim     string
+
+	// The provider is discovered lazily so the gateway still starts (and
+	// password unlock still works) while the IdP is unreachable.
+	providerLock sync.Mutex
+	provider     *oidc.Provider
+
+	pendingLock sync.Mutex
+	pending     map[string]*oidcPending
+}
+
+// oidcPending is an authorization request waiting for its callback, keyed by
+// the state parameter.
+type oidcPending struct {
+	verifier string
+	nonce    string
+	ip       string
+	returnTo string // FORWARD_AUTH return URL, already checked
+	expires  time.Time
+}
+
+// oidcClaims are the ID token claims used for the allow lists.
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+var errOIDCNotAllowed = errors.New("identity is not on any OIDC allow list")
+
+// setupOIDC builds the OIDC login from its (validated) settings. It returns
+// nil when no issuer is configured.
+func setupOIDC(c *OIDCConfig) *oidcLogin {
+	if c.Issuer == "" {
+		return nil
+	}
+
+	return &oidcLogin{
+		issuer:          c.Issuer,
+		clientID:        c.ClientID,
+		clientSecret:    c.ClientSecret,
+		redirectURL:     c.RedirectURL,
+		scopes:          c.Scopes,
+		allowedSubjects: listSet(strings.Join(c.AllowedSubjects, ",")),
+		allowedEmails:   listSet(strings.ToLower(strings.Join(c.AllowedEmails, ","))),
+		allowedGroups:   listSet(strings.Join(c.AllowedGroups, ",")),
+		groupsClaim:     c.GroupsClaim,
+		pending:         make(map[string]*oidcPending),
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func listSet(v string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range splitList(v) {
+		set[item] = true
+	}
+	return set
+}
+
+func (o *oidcLogin) getProvider() (*oidc.Provider, error) {
+	o.providerLock.Lock()
+	defer o.providerLock.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	// Discovery uses a detached context: the provider (and its cached key set)
+	// outlives the request that triggered it.
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcTimeout}), o.issuer)
+	if err != nil {
+		return nil, err
+	}
+	o.provider = provider
+	return provider, nil
+}
+
+func (o *oidcLogin) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.clientID,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.scopes,
+	}
+}
+
+// allowed applies the subject, verified email and group allow lists and
+// returns the name recorded on the grant.
+func (o *oidcLogin) allowed(token *oidc.IDToken) (string, error) {
+	var claims oidcClaims
+	if err := token.Claims(&claims); err != nil {
+		return "", err
+	}
+	var raw map[string]any
+	if err := token.Claims(&raw); err != nil {
+		return "", err
+	}
+
+	name := oidcUserPrefix + token.Subject
+	email := strings.ToLower(claims.Email)
+	if email != "" && claims.EmailVerified {
+		name = oidcUserPrefix + email
+	}
+
+	if o.allowedSubjects[token.Subject] {
+		return name, nil
+	}
+	if email != "" && claims.EmailVerified && o.allowedEmails[email] {
+		return name, nil
+	}
+	if groups, ok := raw[o.groupsClaim].([]any); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok && o.allowedGroups[s] {
+				return name, nil
+			}
+		}
+	}
+	return name, errOIDCNotAllowed
+}
+
+func (o *oidcLogin) putPending(state string, p *oidcPending) {
+	o.pendingLock.Lock()
+	defer o.pendingLock.Unlock()
+
+	o.pending[state] = p
+}
+
+// takePending removes and returns the pending request for state. Each state is
+// single use and only valid from the IP that started it.
+func (o *oidcLogin) takePending(state, ip string) *oidcPending {
+	o.pendingLock.Lock()
+	defer o.pendingLock.Unlock()
+
+	p := o.pending[state]
+	if p == nil {
+		return nil
+	}
+	delete(o.pending, state)
+
+	if p.ip != ip || time.Now().After(p.expires) {
+		return nil
+	}
+	return p
+}
+
+// prune removes authorization requests that never came back.
+func (o *oidcLogin) prune(now time.Time) {
+	o.pendingLock.Lock()
+	defer o.pendingLock.Unlock()
+
+	for state, p := range o.pending {
+		if now.After(p.expires) {
+			delete(o.pending, state)
+		}
+	}
+}
+
+// OIDCLogin redirects the browser to the identity provider.
+func (h *Handlers) OIDCLogin(g *gin.Context) {
+	if h.oidc == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	if h.rejectLockedOut(g, ip) {
+		return
+	}
+
+	provider, err := h.oidc.getProvider()
+	if err != nil {
+		slog.Error("OIDC discovery failed", "issuer", h.oidc.issuer, "ip", ip, "err", err)
+		g.Status(http.StatusBadGateway)
+		return
+	}
+
+	state, err := generateSession()
+	if err != nil {
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateSession()
+	if err != nil {
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	h.oidc.putPending(state, &oidcPending{
+		verifier: verifier,
+		nonce:    nonce,
+		ip:       ip,
+		returnTo: h.forwardAuth.safeReturn(g.Query("return")),
+		expires:  time.Now().Add(challengeTTL),
+	})
+
+	// The state is also kept in a cookie so the callback has to come back to
+	// the browser that started the login, not just the same IP.
+	g.SetSameSite(http.SameSiteLaxMode)
+	g.SetCookie(oidcStateCookie, state, int(challengeTTL.Seconds()), "/unlock", "", true, true)
+
+	url := h.oidc.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	g.Redirect(http.StatusFound, url)
+}
+
+// OIDCCallback completes the authorization code flow and grants the client IP
+// if the identity is on an allow list.
+func (h *Handlers) OIDCCallback(g *gin.Context) {
+	if h.oidc == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	if h.rejectLockedOut(g, ip) {
+		return
+	}
+
+	state := g.Query("state")
+	cookieState, _ := g.Cookie(oidcStateCookie)
+	g.SetSameSite(http.SameSiteLaxMode)
+	g.SetCookie(oidcStateCookie, "", -1, "/unlock", "", true, true)
+
+	pending := h.oidc.takePending(state, ip)
+	if pending == nil || state == "" || cookieState != state {
+		h.registerFailedLogin(ip, "")
+		slog.Info("Unknown or expired OIDC state", "event", "unlock", "ip", ip, "decision", "deny", "reason", "challenge_expired")
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+	if errParam := g.Query("error"); errParam != "" {
+		slog.Info("OIDC provider returned an error", "event", "unlock", "ip", ip, "decision", "deny", "reason", "provider_error", "err", errParam)
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	name, err := h.oidcIdentity(g.Request.Context(), g.Query("code"), pending)
+	if err != nil {
+		h.registerFailedLogin(ip, name)
+		slog.Info("Failed OIDC login", "event", "unlock", "ip", ip, "user", name, "decision", "deny", "reason", "bad_credentials", "err", err)
+		h.notifyAsync(ip, name, false)
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if !h.completeUnlock(g, ip, name, "") {
+		return
+	}
+	target := "/unlock"
+	if pending.returnTo != "" {
+		target = pending.returnTo
+	}
+	g.Redirect(http.StatusFound, target)
+}
+
+// oidcIdentity exchanges the code (with the PKCE verifier), verifies the ID
+// token and its nonce, and checks the allow lists.
+func (h *Handlers) oidcIdentity(ctx context.Context, code string, pending *oidcPending) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+	ctx = oidc.ClientContext(ctx, &http.Client{Timeout: oidcTimeout})
+
+	provider, err := h.oidc.getProvider()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := h.oidc.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return "", fmt.Errorf("code exchange: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: h.oidc.clientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", fmt.Errorf("verify id_token: %w", err)
+	}
+	if idToken.Nonce != pending.nonce {
+		return "", errors.New("id_token nonce mismatch")
+	}
+
+	return h.oidc.allowed(idToken)
+}
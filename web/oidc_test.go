@@ -0,0 +1,257 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// mockIssuer is a minimal OIDC provider: discovery, JWKS and a token endpoint
+// that checks the PKCE verifier and returns a signed ID token.
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock      sync.Mutex
+	challenge string // code_challenge from the authorization request
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	m := &mockIssuer{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &m.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]any{
+			"iss":   m.server.URL,
+			"aud":   "gateway",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": m.nonce,
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     m.sign(claims),
+		})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(claims map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: m.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		m.t.Fatalf("signer: %v", err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		m.t.Fatalf("sign: %v", err)
+	}
+	raw, _ := jws.CompactSerialize()
+	return raw
+}
+
+func newTestOIDCHandlers(t *testing.T, issuer string) *Handlers {
+	t.Helper()
+
+	h := newTestHandlers()
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	h.oidc = &oidcLogin{
+		issuer:          issuer,
+		clientID:        "gateway",
+		redirectURL:     "https://unlock.example.com/unlock/oidc/callback",
+		scopes:          []string{"openid", "email"},
+		allowedSubjects: map[string]bool{},
+		allowedEmails:   map[string]bool{"alice@example.com": true},
+		allowedGroups:   map[string]bool{"family": true},
+		groupsClaim:     "groups",
+		pending:         make(map[string]*oidcPending),
+	}
+	return &h
+}
+
+// startOIDCLogin runs GET /unlock/oidc and records the PKCE challenge and
+// nonce the mock issuer should expect. It returns the state and its cookie.
+func startOIDCLogin(t *testing.T, h *Handlers, m *mockIssuer, ip string) (string, *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/unlock/oidc", nil)
+	c.Request.Header.Set("X-Gateway-Client-IP", ip)
+	h.OIDCLogin(c)
+
+	if c.Writer.Status() != http.StatusFound {
+		t.Fatalf("expected redirect to the issuer, got %d", c.Writer.Status())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("expected a PKCE S256 challenge, got %q", loc.RawQuery)
+	}
+
+	m.lock.Lock()
+	m.challenge = q.Get("code_challenge")
+	m.nonce = q.Get("nonce")
+	m.lock.Unlock()
+
+	var cookie *http.Cookie
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == oidcStateCookie {
+			cookie = ck
+		}
+	}
+	if cookie == nil || cookie.Value != q.Get("state") {
+		t.Fatal("expected the state to be mirrored in a cookie")
+	}
+	return q.Get("state"), cookie
+}
+
+func oidcCallback(h *Handlers, ip, state, code string, cookie *http.Cookie) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/unlock/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	c.Request.Header.Set("X-Gateway-Client-IP", ip)
+	if cookie != nil {
+		c.Request.AddCookie(cookie)
+	}
+	h.OIDCCallback(c)
+	return c.Writer.Status()
+}
+
+func TestOIDCLoginGrantsAllowedEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newMockIssuer(t)
+	m.claims = map[string]any{"sub": "user-1", "email": "Alice@example.com", "email_verified": true}
+	h := newTestOIDCHandlers(t, m.server.URL)
+
+	state, cookie := startOIDCLogin(t, h, m, "203.0.113.7")
+	if status := oidcCallback(h, "203.0.113.7", state, "good-code", cookie); status != http.StatusFound {
+		t.Fatalf("expected redirect back to /unlock after login, got %d", status)
+	}
+
+	grant := findTestGrant(h, "203.0.113.7")
+	if grant == nil || grant.User != "oidc:alice@example.com" {
+		t.Fatalf("expected grant attributed to the OIDC email, got %#v", grant)
+	}
+
+	// State is single use.
+	if status := oidcCallback(h, "203.0.113.7", state, "good-code", cookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a replayed state, got %d", status)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestOIDCLoginGrantsAllowedGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newMockIssuer(t)
+	m.claims = map[string]any{"sub": "user-2", "groups": []string{"guests", "family"}}
+	h := newTestOIDCHandlers(t, m.server.URL)
+
+	state, cookie := startOIDCLogin(t, h, m, "203.0.113.7")
+	if status := oidcCallback(h, "203.0.113.7", state, "good-code", cookie); status != http.StatusFound {
+		t.Fatalf("expected group member to be let in, got %d", status)
+	}
+	if grant := findTestGrant(h, "203.0.113.7"); grant == nil || grant.User != "oidc:user-2" {
+		t.Fatalf("expected grant attributed to the subject, got %#v", grant)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestOIDCLoginRejectsIdentitiesOffTheAllowLists(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newMockIssuer(t)
+	// Unverified emails don't count towards the email allow list.
+	m.claims = map[string]any{"sub": "user-3", "email": "alice@example.com", "email_verified": false}
+	h := newTestOIDCHandlers(t, m.server.URL)
+
+	state, cookie := startOIDCLogin(t, h, m, "203.0.113.7")
+	if status := oidcCallback(h, "203.0.113.7", state, "good-code", cookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an identity off the allow lists, got %d", status)
+	}
+	if findTestGrant(h, "203.0.113.7") != nil {
+		t.Fatal("expected no grant for a rejected identity")
+	}
+}
+
+func TestOIDCCallbackRequiresMatchingStateCookieAndIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newMockIssuer(t)
+	m.claims = map[string]any{"sub": "user-1", "email": "alice@example.com", "email_verified": true}
+	h := newTestOIDCHandlers(t, m.server.URL)
+
+	state, _ := startOIDCLogin(t, h, m, "203.0.113.7")
+	if status := oidcCallback(h, "203.0.113.7", state, "good-code", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the state cookie, got %d", status)
+	}
+
+	state, cookie := startOIDCLogin(t, h, m, "203.0.113.7")
+	if status := oidcCallback(h, "203.0.113.8", state, "good-code", cookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a callback from another IP, got %d", status)
+	}
+	if len(h.granted) != 0 {
+		t.Fatalf("expected no grants, got %d", len(h.granted))
+	}
+}
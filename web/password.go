@@ -0,0 +1,154 @@
+package web
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters for HashPassword, in the PHC format checkArgon2id reads.
+const (
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Time    = 3
+	argon2Threads = 2
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// isPasswordHash reports whether GATEWAY_PASSWORD holds an argon2id hash
+// rather than the password itself.
+func isPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$argon2id$")
+}
+
+// HashPassword returns an argon2id hash of password for GATEWAY_PASSWORD or a
+// users file.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword applies the password policy to GATEWAY_PASSWORD before the
+// gateway serves with it. Without a users file or OIDC the password is the
+// only way in, so it must be set; an empty one would reject every unlock. A
+// hash can't be checked here, so HashPassword's caller checks the password
+// before hashing it.
+func (c *Config) CheckPassword() error {
+	password := c.Auth.Password
+	switch {
+	case c.Auth.UsersFile != "":
+		return nil // GATEWAY_PASSWORD is ignored
+	case password == "" && c.OIDC.Issuer != "":
+		return nil
+	case password == "":
+		return errors.New("GATEWAY_PASSWORD is not set; set it (or GATEWAY_PASSWORD_FILE), USERS_FILE or OIDC_ISSUER")
+	case isPasswordHash(password):
+		return nil
+	}
+	return c.Auth.checkPasswordStrength(password)
+}
+
+// checkPasswordStrength reports every way password falls short of the policy.
+func (c *AuthConfig) checkPasswordStrength(password string) error {
+	var errs []error
+	if n := utf8.RuneCountInString(password); n < c.PasswordMinLength {
+		errs = append(errs, fmt.Errorf("GATEWAY_PASSWORD is %d characters, PASSWORD_MIN_LENGTH is %d", n, c.PasswordMinLength))
+	}
+	if bits := passwordEntropyBits(password); bits < float64(c.PasswordMinEntropyBits) {
+		errs = append(errs, fmt.Errorf("GATEWAY_PASSWORD has about %.0f bits of entropy, PASSWORD_MIN_ENTROPY_BITS is %d; make it longer or mix character types", bits, c.PasswordMinEntropyBits))
+	}
+	if c.BreachedPasswordsFile != "" {
+		breached, err := breachedPassword(c.BreachedPasswordsFile, password)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err))
+		} else if breached {
+			errs = append(errs, errors.New("GATEWAY_PASSWORD is in BREACHED_PASSWORDS_FILE"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// passwordEntropyBits is a rough upper bound on a password's strength: its
+// length, with repeated characters counting half, times log2 of the size of
+// the character classes it uses. It can't spot dictionary words, which is
+// what the breached list is for.
+func passwordEntropyBits(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	seen := make(map[rune]bool)
+	length := 0.0
+	for _, r := range password {
+		if seen[r] {
+			length += 0.5
+		} else {
+			length++
+			seen[r] = true
+		}
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return length * math.Log2(float64(pool))
+}
+
+// breachedPassword reports whether password is listed in path. Lines are
+// either plain passwords or upper or lower case SHA-1 hex digests, optionally
+// followed by ":count" as in the Have I Been Pwned downloads.
+func breachedPassword(path, password string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sum := sha1.Sum([]byte(password))
+	digest := hex.EncodeToString(sum[:])
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == password {
+			return true, nil
+		}
+		if hash, _, _ := strings.Cut(line, ":"); strings.EqualFold(hash, digest) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckPasswordRequiresAPassword(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.CheckPassword(); err == nil || !strings.Contains(err.Error(), "GATEWAY_PASSWORD is not set") {
+		t.Fatalf("expected an empty password to be refused, got %v", err)
+	}
+
+	cfg.Auth.UsersFile = "users.json"
+	if err := cfg.CheckPassword(); err != nil {
+		t.Fatalf("expected no password needed with a users file, got %v", err)
+	}
+}
+
+func TestCheckPasswordAppliesPolicy(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breached, []byte("123456\r\ncorrect-horse-battery\r\n"), 0600); err != nil {
+		t.Fatalf("write breached list: %v", err)
+	}
+
+	for _, tc := range []struct {
+		password, want string
+	}{
+		{"hunter2", "PASSWORD_MIN_LENGTH"},
+		{"aaaaaaaaaaaa", "PASSWORD_MIN_ENTROPY_BITS"},
+		{"correct-horse-battery", "BREACHED_PASSWORDS_FILE"},
+		{"a-long-unlisted-passphrase", ""},
+	} {
+		cfg := DefaultConfig()
+		cfg.Auth.Password = tc.password
+		cfg.Auth.BreachedPasswordsFile = breached
+		err := cfg.CheckPassword()
+		if tc.want == "" {
+			if err != nil {
+				t.Fatalf("expected %q to pass, got %v", tc.password, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("expected %q in the error for %q, got %v", tc.want, tc.password, err)
+		}
+	}
+}
+
+func TestValidateRejectsPaddedPasswords(t *testing.T) {
+	for _, tc := range []struct {
+		password, previous, want string
+	}{
+		{" padded-password-x", "", "GATEWAY_PASSWORD must not start or end with whitespace"},
+		{"a-long-unlisted-passphrase", "old-passphrase\t", "GATEWAY_PASSWORD_PREVIOUS must not start or end with whitespace"},
+	} {
+		cfg := DefaultConfig()
+		cfg.Auth.Password = tc.password
+		cfg.Auth.PreviousPassword = tc.previous
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("expected %q, got %v", tc.want, err)
+		}
+	}
+}
+
+func TestBreachedPasswordMatchesSHA1Digests(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "pwned.txt")
+	// SHA-1 of "password", as in the Have I Been Pwned downloads.
+	if err := os.WriteFile(breached, []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n"), 0600); err != nil {
+		t.Fatalf("write breached list: %v", err)
+	}
+	if ok, err := breachedPassword(breached, "password"); !ok || err != nil {
+		t.Fatalf("expected the digest to match, got %v (%v)", ok, err)
+	}
+	if ok, err := breachedPassword(breached, "another"); ok || err != nil {
+		t.Fatalf("expected no match, got %v (%v)", ok, err)
+	}
+}
+
+func TestUnlockWithHashedPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hash, err := HashPassword(testPassword)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	cfg := DefaultConfig()
+	cfg.Auth.Password = hash
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected the hash to validate, got %v", err)
+	}
+	for _, bad := range []string{"$argon2id$v=19$broken", strings.Replace(hash, ",t=3,", ",t=0,", 1)} {
+		cfg.Auth.Password = bad
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "malformed argon2id hash") {
+			t.Fatalf("expected a malformed hash to be rejected, got %v", err)
+		}
+	}
+
+	h := newTestHandlers()
+	h.settings.unlockPasswd = hash
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	if status, _ := postUnlock(&h, "203.0.113.7", hash); status != http.StatusUnauthorized {
+		t.Fatalf("expected the hash itself to be rejected, got %d", status)
+	}
+	if status, _ := postUnlock(&h, "203.0.113.8", testPassword); status != http.StatusOK {
+		t.Fatalf("expected the password to unlock, got %d", status)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
@@ -0,0 +1,559 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = 2 * time.Second
+
+// sharedStore is a grantStore that other replicas write to as well, so the
+// local maps are only a cache: lookups have to be checked against it and
+// failure counting has to happen in it.
+type sharedStore interface {
+	grantStore
+	// grantsByIP returns every user's grant on ip.
+	grantsByIP(ip string) ([]persistedAuthed, error)
+	grantBySession(session string) (*persistedAuthed, error)
+	lockout(ip string) (*persistedLockout, error)
+	// addFailure counts a failed unlock and locks the IP out once max is
+	// reached, atomically across replicas. It reports whether this failure
+	// triggered the lockout.
+	addFailure(ip string, now time.Time, max int, lockout time.Duration) (persistedLockout, bool, error)
+}
+
+// redisStore keeps grants and lockouts in Redis so several gateway replicas
+// share them. Grants are stored under their grantKey. Keys (under prefix,
+// default "gateway:"):
+//
+//	grant:<key>         hash of authed_time, session_hash, user, generation; expires with the grant
+//	session:<hash>      the grant key for a session hash; expires with the grant
+//	grants              set of grant keys, for loading at startup
+//	ip:<ip>             set of the grant keys on an IP
+//	lockout:<ip>        hash of failures, locked_until, last_seen
+//	lockouts            set of IPs with lockout state
+//
+// Expiry is left to Redis TTLs, so replaceGrants never deletes: one replica's
+// view of "all grants" is not authoritative. Expired keys are dropped from the
+// sets as they are found.
+type redisStore struct {
+	client     *redis.Client
+	prefix     string
+	expiration time.Duration
+}
+
+func openRedisStore(url, prefix string, expiration time.Duration) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing REDIS_URL: %w", err)
+	}
+	s := &redisStore{client: redis.NewClient(opts), prefix: prefix, expiration: expiration}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return s, nil
+}
+
+func (s *redisStore) key(parts ...string) string {
+	k := s.prefix
+	for i, p := range parts {
+		if i > 0 {
+			k += ":"
+		}
+		k += p
+	}
+	return k
+}
+
+func (s *redisStore) loadGrants() ([]persistedAuthed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.client.SMembers(ctx, s.key("grants")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []persistedAuthed
+	for _, key := range keys {
+		fields, err := s.client.HGetAll(ctx, s.key("grant", key)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			// Expired; drop it from the indexes.
+			ip, _ := splitGrantKey(key)
+			s.client.SRem(ctx, s.key("grants"), key)
+			s.client.SRem(ctx, s.key("ip", ip), key)
+			continue
+		}
+		p, err := parseRedisGrant(key, fields)
+		if err != nil {
+			return nil, err
+		}
+		if p.key() != key {
+			// Written before grants were keyed by user: move it.
+			if err := s.moveGrant(key, *p); err != nil {
+				return nil, err
+			}
+		} else {
+			s.client.SAdd(ctx, s.key("ip", p.IP), key)
+		}
+		grants = append(grants, *p)
+	}
+	return grants, nil
+}
+
+// moveGrant rewrites p, found under a bare-IP key from an older version, under
+// its grantKey.
+func (s *redisStore) moveGrant(old string, p persistedAuthed) error {
+	if err := s.putGrant(p); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key("grant", old))
+		pipe.SRem(ctx, s.key("grants"), old)
+		return nil
+	})
+	return err
+}
+
+// parseRedisGrant reads the grant:<key> hash. The IP comes from the key; the
+// user from the hash, so a record from before grants were keyed by user can
+// be told apart.
+func parseRedisGrant(key string, fields map[string]string) (*persistedAuthed, error) {
+	authedTime, err := strconv.ParseInt(fields["authed_time"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("grant %s: bad authed_time: %w", key, err)
+	}
+	ip, _ := splitGrantKey(key)
+	return &persistedAuthed{IP: ip, AuthedTime: unixNanoTime(authedTime), SessionHash: fields["session_hash"], User: fields["user"], Generation: fields["generation"]}, nil
+}
+
+// grantByKey returns the grant under key, or nil if there is none (or only
+// an older version's record that loadGrants hasn't moved yet).
+func (s *redisStore) grantByKey(key string) (*persistedAuthed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	fields, err := s.client.HGetAll(ctx, s.key("grant", key)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	p, err := parseRedisGrant(key, fields)
+	if err != nil || p.key() != key {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *redisStore) grantsByIP(ip string) ([]persistedAuthed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.client.SMembers(ctx, s.key("ip", ip)).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	cmds := make([]*redis.MapStringStringCmd, len(keys))
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, s.key("grant", key))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var grants []persistedAuthed
+	for i, key := range keys {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			s.client.SRem(ctx, s.key("ip", ip), key)
+			continue
+		}
+		p, err := parseRedisGrant(key, fields)
+		if err != nil {
+			return nil, err
+		}
+		if p.key() == key {
+			grants = append(grants, *p)
+		}
+	}
+	return grants, nil
+}
+
+func (s *redisStore) grantBySession(session string) (*persistedAuthed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	hash := hashSession(session)
+	key, err := s.client.Get(ctx, s.key("session", hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.grantByKey(key)
+	if err != nil || p == nil || p.SessionHash != hash {
+		// The grant has since been renewed with another session.
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *redisStore) putGrant(p persistedAuthed) error {
+	key := p.key()
+	ttl := time.Until(p.AuthedTime.Add(s.expiration))
+	if ttl <= 0 {
+		return s.deleteGrant(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	old, err := s.client.HGet(ctx, s.key("grant", key), "session_hash").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if old != "" && old != p.SessionHash {
+			pipe.Del(ctx, s.key("session", old))
+		}
+		grantKey := s.key("grant", key)
+		pipe.HSet(ctx, grantKey, "authed_time", timeUnixNano(p.AuthedTime), "session_hash", p.SessionHash, "user", p.User, "generation", p.Generation)
+		pipe.PExpire(ctx, grantKey, ttl)
+		pipe.Set(ctx, s.key("session", p.SessionHash), key, ttl)
+		pipe.SAdd(ctx, s.key("grants"), key)
+		pipe.SAdd(ctx, s.key("ip", p.IP), key)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) deleteGrant(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	old, err := s.client.HGet(ctx, s.key("grant", key), "session_hash").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	ip, _ := splitGrantKey(key)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if old != "" {
+			pipe.Del(ctx, s.key("session", old))
+		}
+		pipe.Del(ctx, s.key("grant", key))
+		pipe.SRem(ctx, s.key("grants"), key)
+		pipe.SRem(ctx, s.key("ip", ip), key)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) applyGrants(puts []persistedAuthed, deletes []string) error {
+	for _, p := range puts {
+		if err := s.putGrant(p); err != nil {
+			return err
+		}
+	}
+	for _, key := range deletes {
+		if err := s.deleteGrant(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) replaceGrants(grants []persistedAuthed) error {
+	for _, p := range grants {
+		if err := s.putGrant(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) loadLockouts() ([]persistedLockout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	ips, err := s.client.SMembers(ctx, s.key("lockouts")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var lockouts []persistedLockout
+	for _, ip := range ips {
+		l, err := s.lockout(ip)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			s.client.SRem(ctx, s.key("lockouts"), ip)
+			continue
+		}
+		lockouts = append(lockouts, *l)
+	}
+	return lockouts, nil
+}
+
+func (s *redisStore) lockout(ip string) (*persistedLockout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	fields, err := s.client.HGetAll(ctx, s.key("lockout", ip)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	return parseRedisLockout(ip, fields["failures"], fields["locked_until"], fields["last_seen"])
+}
+
+func parseRedisLockout(ip string, failures, lockedUntil, lastSeen string) (*persistedLockout, error) {
+	l := &persistedLockout{IP: ip}
+	var err error
+	var until, seen int64
+	if l.Failures, err = strconv.Atoi(failures); err != nil {
+		return nil, fmt.Errorf("lockout %s: bad failures: %w", ip, err)
+	}
+	if until, err = strconv.ParseInt(lockedUntil, 10, 64); err != nil {
+		return nil, fmt.Errorf("lockout %s: bad locked_until: %w", ip, err)
+	}
+	if seen, err = strconv.ParseInt(lastSeen, 10, 64); err != nil {
+		return nil, fmt.Errorf("lockout %s: bad last_seen: %w", ip, err)
+	}
+	l.LockedUntil, l.LastSeen = unixNanoTime(until), unixNanoTime(seen)
+	return l, nil
+}
+
+// lockoutTTL keeps lockout state as long as pruneLoginAttempts would: until
+// the lockout ends and the IP has been quiet for an hour.
+func lockoutTTL(l persistedLockout, now time.Time) time.Duration {
+	end := l.LastSeen
+	if l.LockedUntil.After(end) {
+		end = l.LockedUntil
+	}
+	return end.Add(time.Hour).Sub(now)
+}
+
+func (s *redisStore) putLockout(l persistedLockout) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		k := s.key("lockout", l.IP)
+		pipe.HSet(ctx, k, "failures", l.Failures, "locked_until", timeUnixNano(l.LockedUntil), "last_seen", timeUnixNano(l.LastSeen))
+		pipe.PExpire(ctx, k, lockoutTTL(l, time.Now()))
+		pipe.SAdd(ctx, s.key("lockouts"), l.IP)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) deleteLockout(ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key("lockout", ip))
+		pipe.SRem(ctx, s.key("lockouts"), ip)
+		return nil
+	})
+	return err
+}
+
+// addFailureScript mirrors registerFailedLogin: count the failure and, at the
+// threshold, lock out and reset the count. It returns the new state and 1 if
+// this call locked the IP out. Times come in as decimal strings and are stored
+// as given: Redis would format a Lua number near 1.7e18 in exponent notation,
+// and lose precision doing so.
+var addFailureScript = redis.NewScript(`
+local failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+local max = tonumber(ARGV[2])
+local locked = 0
+redis.call('HSET', KEYS[1], 'last_seen', ARGV[1])
+if redis.call('HEXISTS', KEYS[1], 'locked_until') == 0 then
+	redis.call('HSET', KEYS[1], 'locked_until', '0')
+end
+if max > 0 and failures >= max then
+	redis.call('HSET', KEYS[1], 'locked_until', ARGV[3], 'failures', 0)
+	locked = 1
+end
+redis.call('SADD', KEYS[2], ARGV[4])
+local state = redis.call('HMGET', KEYS[1], 'failures', 'locked_until', 'last_seen')
+return {state[1], state[2], state[3], locked}
+`)
+
+func (s *redisStore) addFailure(ip string, now time.Time, max int, lockout time.Duration) (persistedLockout, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	lastSeen := strconv.FormatInt(timeUnixNano(now), 10)
+	lockedUntil := strconv.FormatInt(timeUnixNano(now.Add(lockout)), 10)
+	res, err := addFailureScript.Run(ctx, s.client, []string{s.key("lockout", ip), s.key("lockouts")},
+		lastSeen, max, lockedUntil, ip).Slice()
+	if err != nil {
+		return persistedLockout{}, false, err
+	}
+	if len(res) != 4 {
+		return persistedLockout{}, false, fmt.Errorf("unexpected addFailure reply %v", res)
+	}
+	l, err := parseRedisLockout(ip, fmt.Sprint(res[0]), fmt.Sprint(res[1]), fmt.Sprint(res[2]))
+	if err != nil {
+		return persistedLockout{}, false, err
+	}
+	if err := s.client.PExpire(ctx, s.key("lockout", ip), lockoutTTL(*l, now)).Err(); err != nil {
+		slog.Warn("Failed to set lockout expiry", "ip", ip, "err", err)
+	}
+	return *l, res[3] == int64(1), nil
+}
+
+func (s *redisStore) close() error {
+	return s.client.Close()
+}
+
+// refreshFromShared brings the local records for session and ip in line with
+// a shared store, so grants made, renewed or revoked by other replicas are
+// seen here. On store errors the local state is used as is.
+func (h *Handlers) refreshFromShared(session, ip string) {
+	shared := h.shared()
+	if shared == nil {
+		return
+	}
+
+	if session != "" {
+		p, err := shared.grantBySession(session)
+		switch {
+		case err != nil:
+			slog.Warn("Failed to read shared grant", "session", sessionFingerprint(session), "err", err)
+		case p != nil:
+			h.applySharedGrant(p.key(), p)
+		default:
+			// Unknown to the store: revoked or replaced elsewhere if we
+			// still have it.
+			if a := h.findGrantedBySession(session); a != nil && a.IP != ip {
+				h.refreshSharedIP(shared, a.IP)
+			}
+		}
+	}
+	if ip != "" {
+		h.refreshSharedIP(shared, ip)
+	}
+}
+
+// refreshAllFromShared brings every local grant and lockout in line with a
+// shared store, for the admin views that list or clear all of them: grants
+// and lockouts other replicas made are added, and ones gone from the store
+// dropped. On store errors the local state is used as is.
+func (h *Handlers) refreshAllFromShared() {
+	shared := h.shared()
+	if shared == nil {
+		return
+	}
+
+	if grants, err := shared.loadGrants(); err != nil {
+		slog.Warn("Failed to read shared grants", "err", err)
+	} else {
+		found := make(map[string]bool, len(grants))
+		for i := range grants {
+			found[grants[i].key()] = true
+			h.applySharedGrant(grants[i].key(), &grants[i])
+		}
+		for key := range h.grantSnapshot().byKey {
+			if !found[key] {
+				h.applySharedGrant(key, nil)
+			}
+		}
+	}
+
+	lockouts, err := shared.loadLockouts()
+	if err != nil {
+		slog.Warn("Failed to read shared lockout state", "err", err)
+		return
+	}
+	h.loginLock.Lock()
+	defer h.loginLock.Unlock()
+	h.loginAttempts = make(map[string]*loginAttempt, len(lockouts))
+	for _, l := range lockouts {
+		h.setLoginAttemptLocked(l)
+	}
+}
+
+// refreshSharedIP applies the store's grants on ip, and drops the local ones
+// it no longer has.
+func (h *Handlers) refreshSharedIP(shared sharedStore, ip string) {
+	grants, err := shared.grantsByIP(ip)
+	if err != nil {
+		slog.Warn("Failed to read shared grant", "ip", ip, "err", err)
+		return
+	}
+
+	found := make(map[string]bool, len(grants))
+	for i := range grants {
+		found[grants[i].key()] = true
+		h.applySharedGrant(grants[i].key(), &grants[i])
+	}
+	for _, v := range h.grantSnapshot().byIP[ip] {
+		if key := v.key(); !found[key] {
+			h.applySharedGrant(key, nil)
+		}
+	}
+}
+
+// applySharedGrant replaces the local record under key with p, or drops it if
+// p is nil. Sessions are never changed in place; a new session gets a new
+// record, which only has the session's hash. Most calls find the grant as the
+// snapshot already has it, and return without taking grantedLock, so /access
+// checks stay off the write path.
+func (h *Handlers) applySharedGrant(key string, p *persistedAuthed) {
+	if sharedGrantCurrent(h.grantSnapshot().byKey[key], p) {
+		return
+	}
+
+	h.grantedLock.Lock()
+	defer h.grantedLock.Unlock()
+	defer h.publishGrantsLocked()
+
+	local := h.granted[key]
+	switch {
+	case p == nil:
+		if local != nil {
+			h.deleteGrantedLocked(key)
+		}
+	case local == nil || local.SessionHash != p.SessionHash:
+		h.putGrantedLocked(&authed{IP: p.IP, AuthedTime: p.AuthedTime, SessionHash: p.SessionHash, User: p.User, Generation: p.Generation})
+	default:
+		local.recordEditLock.Lock()
+		local.AuthedTime = p.AuthedTime
+		local.User = p.User
+		local.Generation = p.Generation
+		local.recordEditLock.Unlock()
+		h.markGrantLocked(key)
+	}
+}
+
+// sharedGrantCurrent reports whether the local view v already matches the
+// shared store's p (both absent counts as a match).
+func sharedGrantCurrent(v *grantView, p *persistedAuthed) bool {
+	if v == nil || p == nil {
+		return v == nil && p == nil
+	}
+	return v.SessionHash == p.SessionHash && v.AuthedTime.Equal(p.AuthedTime) && v.User == p.User && v.Generation == p.Generation
+}
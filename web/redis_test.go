@@ -0,0 +1,277 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRedisStore(t *testing.T, mr *miniredis.Miniredis) *redisStore {
+	t.Helper()
+
+	s, err := openRedisStore("redis://"+mr.Addr(), "gateway:", 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("open redis: %v", err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+// newTestReplicas returns two Handlers sharing one Redis, as two gateway
+// replicas would.
+func newTestReplicas(t *testing.T) (*Handlers, *Handlers, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	a, b := newTestHandlers(), newTestHandlers()
+	a.store = newTestRedisStore(t, mr)
+	b.store = newTestRedisStore(t, mr)
+	return &a, &b, mr
+}
+
+func testAccessWithSession(h *Handlers, ip, session string) int {
+	w := httptest.NewRecorder()
+	g, _ := gin.CreateTestContext(w)
+	g.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	g.Request.Header.Set(h.clientIPHeader, ip)
+	if session != "" {
+		g.Request.AddCookie(&http.Cookie{Name: h.cookieName, Value: session})
+	}
+	h.AccessPage(g)
+	return g.Writer.Status()
+}
+
+func TestRedisStoreRoundTripGrants(t *testing.T) {
+	s := newTestRedisStore(t, miniredis.RunT(t))
+	now := time.Now().Truncate(time.Millisecond)
+
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now, SessionHash: hashSession("a"), User: "alice"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now, SessionHash: hashSession("b"), User: "alice"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if p, _ := s.grantBySession("a"); p != nil {
+		t.Fatalf("expected the replaced session to be gone, got %#v", p)
+	}
+	if p, err := s.grantBySession("b"); err != nil || p == nil || p.IP != "203.0.113.1" || !p.AuthedTime.Equal(now) {
+		t.Fatalf("expected the grant by session, got %#v %v", p, err)
+	}
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now, SessionHash: hashSession("c"), User: "bob"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if grants, err := s.grantsByIP("203.0.113.1"); err != nil || len(grants) != 2 {
+		t.Fatalf("expected a grant per user on the IP, got %#v %v", grants, err)
+	}
+	if err := s.deleteGrant(grantKey("203.0.113.1", "bob")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if err := s.deleteGrant(grantKey("203.0.113.1", "alice")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if grants, err := s.loadGrants(); err != nil || len(grants) != 0 {
+		t.Fatalf("expected no grants, got %#v %v", grants, err)
+	}
+	if p, _ := s.grantBySession("b"); p != nil {
+		t.Fatal("expected the session to be deleted with the grant")
+	}
+}
+
+func TestRedisStoreMovesIPKeyedGrants(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisStore(t, mr)
+
+	// An older version keyed every grant by IP alone.
+	mr.HSet("gateway:grant:203.0.113.1", "authed_time", strconv.FormatInt(time.Now().UnixNano(), 10), "session_hash", hashSession("a"), "user", "alice", "generation", "")
+	mr.Set("gateway:session:"+hashSession("a"), "203.0.113.1")
+	mr.SAdd("gateway:grants", "203.0.113.1")
+
+	if grants, err := s.loadGrants(); err != nil || len(grants) != 1 || grants[0].User != "alice" {
+		t.Fatalf("expected the old grant to load, got %#v %v", grants, err)
+	}
+	if p, err := s.grantBySession("a"); err != nil || p == nil || p.key() != grantKey("203.0.113.1", "alice") {
+		t.Fatalf("expected the grant under its new key, got %#v %v", p, err)
+	}
+	if mr.Exists("gateway:grant:203.0.113.1") {
+		t.Fatal("expected the IP-keyed record to be removed")
+	}
+}
+
+func TestRedisStoreExpiresGrants(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisStore(t, mr)
+
+	// Granted 29 days ago, so one day is left.
+	authedAt := time.Now().Add(-29 * 24 * time.Hour)
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: authedAt, SessionHash: hashSession("a")}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if ttl := mr.TTL("gateway:grant:203.0.113.1"); ttl > 24*time.Hour || ttl < 23*time.Hour {
+		t.Fatalf("expected about a day left on the grant, got %v", ttl)
+	}
+
+	mr.FastForward(25 * time.Hour)
+	if grants, _ := s.loadGrants(); len(grants) != 0 {
+		t.Fatalf("expected the grant to expire, got %#v", grants)
+	}
+	if p, _ := s.grantBySession("a"); p != nil {
+		t.Fatal("expected the session to expire with the grant")
+	}
+	if mr.Exists("gateway:session:" + hashSession("a")) {
+		t.Fatal("expected the session key to expire")
+	}
+}
+
+func TestReplicasShareGrants(t *testing.T) {
+	a, b, _ := newTestReplicas(t)
+
+	record, err := a.addGranted("203.0.113.1", "alice", "")
+	if err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+
+	if code := testAccess(b, "203.0.113.1"); code != http.StatusOK {
+		t.Fatalf("expected the other replica to allow the IP, got %d", code)
+	}
+	if code := testAccessWithSession(b, "198.51.100.9", record.Session); code != http.StatusOK {
+		t.Fatalf("expected the other replica to accept the session from another IP, got %d", code)
+	}
+
+	// Unlocking again on the other replica reuses the grant, but that replica
+	// only knows the session's hash, so it rotates in one it can hand out.
+	again, err := b.addGranted("203.0.113.1", "alice", "")
+	if err != nil {
+		t.Fatalf("re-add grant: %v", err)
+	}
+	if again.Session == "" || again.SessionHash == record.SessionHash {
+		t.Fatal("expected a new session to be issued for the reused grant")
+	}
+	if code := testAccessWithSession(a, "198.51.100.9", again.Session); code != http.StatusOK {
+		t.Fatalf("expected the new session to work on the first replica, got %d", code)
+	}
+
+	for _, p := range a.revokeGrants(func(r *authed) bool { return r.IP == "203.0.113.1" }) {
+		a.syncGrant(p.key())
+	}
+	if code := testAccess(b, "203.0.113.1"); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revocation to reach the other replica, got %d", code)
+	}
+	if code := testAccessWithSession(b, "198.51.100.9", again.Session); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to be rejected, got %d", code)
+	}
+}
+
+func TestSharedAccessChecksKeepUnchangedSnapshot(t *testing.T) {
+	a, b, _ := newTestReplicas(t)
+
+	record, err := a.addGranted("203.0.113.1", "", "")
+	if err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	// The first check on the other replica picks the grant up.
+	if code := testAccessWithSession(b, "203.0.113.1", record.Session); code != http.StatusOK {
+		t.Fatalf("expected the other replica to allow the session, got %d", code)
+	}
+
+	for _, h := range []*Handlers{a, b} {
+		before := h.grantSnapshot()
+		for range 3 {
+			if code := testAccessWithSession(h, "203.0.113.1", record.Session); code != http.StatusOK {
+				t.Fatalf("expected the session to be allowed, got %d", code)
+			}
+			if code := testAccess(h, "203.0.113.1"); code != http.StatusOK {
+				t.Fatalf("expected the IP to be allowed, got %d", code)
+			}
+		}
+		if h.grantSnapshot() != before {
+			t.Fatal("expected access checks against an unchanged shared grant not to publish a new snapshot")
+		}
+	}
+}
+
+func TestReplicasShareLockouts(t *testing.T) {
+	a, b, mr := newTestReplicas(t)
+	const ip = "198.51.100.7"
+
+	// Failures spread over both replicas add up to the threshold of 3.
+	a.registerFailedLogin(ip, "")
+	b.registerFailedLogin(ip, "")
+	if locked, _ := a.isLockedOut(ip); locked {
+		t.Fatal("expected no lockout before the threshold")
+	}
+	a.registerFailedLogin(ip, "")
+
+	locked, remaining := b.isLockedOut(ip)
+	if !locked || remaining > time.Minute {
+		t.Fatalf("expected the other replica to see the lockout, got %v %v", locked, remaining)
+	}
+	if ttl := mr.TTL("gateway:lockout:" + ip); ttl <= time.Hour || ttl > time.Hour+time.Minute {
+		t.Fatalf("expected the lockout state to outlive the lockout by an hour, got %v", ttl)
+	}
+
+	b.clearLoginAttempts(ip)
+	if locked, _ := a.isLockedOut(ip); locked {
+		t.Fatal("expected clearing on one replica to unlock the IP everywhere")
+	}
+}
+
+func TestAdminSeesAndClearsOtherReplicasState(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	a, b, mr := newTestReplicas(t)
+	b.settings.adminToken = testAdminToken
+	if _, err := a.addGranted("203.0.113.5", "alice", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	for i := 0; i < a.settings.maxLoginFailures; i++ {
+		a.registerFailedLogin("198.51.100.7", "")
+	}
+
+	r := newTestAdminRouter(b)
+	var grants []adminGrant
+	if err := json.Unmarshal(adminRequest(r, http.MethodGet, "/admin/api/grants", testAdminToken).Body.Bytes(), &grants); err != nil || len(grants) != 1 || grants[0].User != "alice" {
+		t.Fatalf("expected the other replica's grant listed, got %#v (%v)", grants, err)
+	}
+	var lockouts []adminLockout
+	if err := json.Unmarshal(adminRequest(r, http.MethodGet, "/admin/api/lockouts", testAdminToken).Body.Bytes(), &lockouts); err != nil || len(lockouts) != 1 || lockouts[0].IP != "198.51.100.7" {
+		t.Fatalf("expected the other replica's lockout listed, got %#v (%v)", lockouts, err)
+	}
+
+	w := httptest.NewRecorder()
+	g, _ := gin.CreateTestContext(w)
+	g.Request = httptest.NewRequest(http.MethodDelete, "/admin/api/lockouts", nil)
+	b.AdminClearLockouts(g)
+	if mr.Exists("gateway:lockout:198.51.100.7") {
+		t.Fatal("expected clearing all lockouts to clear the shared store")
+	}
+	if locked, _ := a.isLockedOut("198.51.100.7"); locked {
+		t.Fatal("expected the lockout cleared on the replica that recorded it")
+	}
+}
+
+func TestAddFailureStoresPlainIntegers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisStore(t, mr)
+	const ip = "198.51.100.7"
+
+	now := time.Now()
+	l, locked, err := s.addFailure(ip, now, 1, time.Minute)
+	if err != nil || !locked {
+		t.Fatalf("expected the first failure to lock out, got %v (%v)", locked, err)
+	}
+	if !l.LockedUntil.Equal(now.Add(time.Minute)) || !l.LastSeen.Equal(now) {
+		t.Fatalf("expected exact times back, got %#v", l)
+	}
+	for field, want := range map[string]int64{"locked_until": now.Add(time.Minute).UnixNano(), "last_seen": now.UnixNano()} {
+		if raw := mr.HGet("gateway:lockout:"+ip, field); raw != strconv.FormatInt(want, 10) {
+			t.Fatalf("expected %s stored as the integer %d, got %q", field, want, raw)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// liveSettings are the settings Reload can change while serving (the ones
+// tagged reload in Config). Handlers reads them through live(), which returns
+// a copy, so a request sees either the old settings or the new ones, never a
+// mix.
+type liveSettings struct {
+	unlockPasswd       string // GATEWAY_PASSWORD; "" with a users file
+	unlockGeneration   string // passwordGeneration(unlockPasswd)
+	previousPasswd     string // GATEWAY_PASSWORD_PREVIOUS, accepted until previousSince+passwordGrace
+	previousGeneration string
+	previousSince      time.Time // PASSWORD_ROTATED_AT
+	passwordGrace      time.Duration
+	revokeRetired      bool // REVOKE_RETIRED_GRANTS
+	maxLoginFailures   int
+	lockoutDuration    time.Duration
+	adminToken         string          // bearer token for the admin API (ADMIN_TOKEN); "" = disabled
+	adminUsers         map[string]bool // users allowed on the admin dashboard (ADMIN_USERS)
+	metricsToken       string          // bearer token for /metrics (METRICS_TOKEN); "" = only on METRICS_ADDR
+	slackWebhook       string          // optional Incoming Webhook URL (SLACK_WEBHOOK_URL); "" = silent no-op
+	allowLocalBypass   bool            // ALLOW_LOCAL_BYPASS: grant 192.168.0-29.x without unlocking
+}
+
+func newLiveSettings(cfg *Config, withUsers bool) liveSettings {
+	s := liveSettings{
+		unlockPasswd:     cfg.Auth.Password,
+		previousPasswd:   cfg.Auth.PreviousPassword,
+		passwordGrace:    time.Duration(cfg.Auth.PasswordGraceHours) * time.Hour,
+		revokeRetired:    cfg.Auth.RevokeRetiredGrants,
+		maxLoginFailures: cfg.Lockout.MaxFailures,
+		lockoutDuration:  time.Duration(cfg.Lockout.Minutes) * time.Minute,
+		adminToken:       cfg.Admin.Token,
+		adminUsers:       listSet(strings.Join(cfg.Admin.Users, ",")),
+		metricsToken:     cfg.Metrics.Token,
+		slackWebhook:     cfg.Notify.SlackWebhook,
+		allowLocalBypass: cfg.Server.AllowLocalBypass,
+	}
+	if withUsers {
+		s.unlockPasswd, s.previousPasswd = "", ""
+	}
+	if s.previousPasswd != "" {
+		s.previousSince, _ = time.Parse(time.RFC3339, cfg.Auth.PasswordRotatedAt) // checked by Validate
+	}
+	s.unlockGeneration = passwordGeneration(s.unlockPasswd)
+	s.previousGeneration = passwordGeneration(s.previousPasswd)
+	return s
+}
+
+// live returns the current reloadable settings.
+func (h *Handlers) live() liveSettings {
+	h.settingsLock.RLock()
+	defer h.settingsLock.RUnlock()
+	return h.settings
+}
+
+// Reload applies the reloadable settings from cfg and re-reads the users file,
+// revoking grants of users that are no longer in it and, with
+// REVOKE_RETIRED_GRANTS, grants made with retired passwords. Grants, sessions
+// and lockout state are otherwise kept. Settings that need a restart are left
+// alone; see Config.Changes. If the users file can't be read nothing changes.
+func (h *Handlers) Reload(cfg *Config) error {
+	if h.users != nil {
+		n, err := h.users.reload()
+		if err != nil {
+			return fmt.Errorf("reloading users file: %w", err)
+		}
+		slog.Info("Reloaded users", "event", "users_loaded", "count", n, "file", h.users.file)
+	}
+
+	settings := newLiveSettings(cfg, h.users != nil)
+	h.settingsLock.Lock()
+	h.settings = settings
+	h.settingsLock.Unlock()
+
+	if h.users != nil {
+		h.revokeAndRecord("user_removed", "user removed from users file", func(a *authed) bool { return h.userRevoked(a.User) })
+	}
+	h.revokeRetiredGrants(time.Now())
+	return nil
+}
+
+// revokeAndRecord revokes the grants match selects, logging and auditing each
+// with reason.
+func (h *Handlers) revokeAndRecord(reason, detail string, match func(*authed) bool) {
+	for _, p := range h.revokeGrants(match) {
+		slog.Info("Revoked grant", "event", "grant_revoked", "ip", p.IP, "user", p.User, "reason", reason)
+		h.events.add("revoked", p.IP, p.User, detail)
+		h.audit.add("grant_revoked", p.IP, p.User, sessionFingerprintOfHash(p.SessionHash), detail)
+		h.syncGrant(p.key())
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestUsersFile(t *testing.T, path string, users map[string]string) {
+	t.Helper()
+
+	var entries []user
+	for name, pass := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("hash password: %v", err)
+		}
+		entries = append(entries, user{Name: name, PasswordHash: string(hash)})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("marshal users: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write users file: %v", err)
+	}
+}
+
+func TestReloadSwapsPasswordAndKeepsGrants(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.settings.unlockPasswd = testPassword
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	putTestGrant(&h, &authed{IP: "203.0.113.10", AuthedTime: time.Now(), SessionHash: hashSession("session-token")})
+
+	cfg := DefaultConfig()
+	cfg.Auth.Password = "rotated-password"
+	cfg.Lockout.MaxFailures = 7
+	if err := h.Reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if status, _ := postUnlock(&h, "203.0.113.7", testPassword); status != http.StatusUnauthorized {
+		t.Fatalf("expected the old password to be rejected, got %d", status)
+	}
+	if status, _ := postUnlock(&h, "203.0.113.8", "rotated-password"); status != http.StatusOK {
+		t.Fatalf("expected the new password to unlock, got %d", status)
+	}
+	if h.live().maxLoginFailures != 7 {
+		t.Fatalf("expected MAX_LOGIN_FAILURES to be reloaded, got %d", h.live().maxLoginFailures)
+	}
+	if findTestGrant(&h, "203.0.113.10") == nil {
+		t.Fatal("expected existing grants to survive a reload")
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestReloadRevokesRemovedUsers(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	writeTestUsersFile(t, usersFile, map[string]string{"alice": "alice-pass", "bob": "bob-pass"})
+	users, err := loadUserStore(usersFile)
+	if err != nil {
+		t.Fatalf("load users: %v", err)
+	}
+
+	h := newTestHandlers()
+	h.users = users
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	putTestGrant(&h, &authed{IP: "203.0.113.10", AuthedTime: time.Now(), SessionHash: hashSession("alice-session"), User: "alice"})
+	putTestGrant(&h, &authed{IP: "203.0.113.11", AuthedTime: time.Now(), SessionHash: hashSession("bob-session"), User: "bob"})
+
+	writeTestUsersFile(t, usersFile, map[string]string{"alice": "alice-pass"})
+	if err := h.Reload(DefaultConfig()); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if findTestGrant(&h, "203.0.113.11") != nil {
+		t.Fatal("expected the removed user's grant to be revoked")
+	}
+	if findTestGrant(&h, "203.0.113.10") == nil {
+		t.Fatal("expected the remaining user's grant to be kept")
+	}
+}
+
+func TestReloadKeepsSettingsWhenUsersFileIsBad(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	writeTestUsersFile(t, usersFile, map[string]string{"alice": "alice-pass"})
+	users, err := loadUserStore(usersFile)
+	if err != nil {
+		t.Fatalf("load users: %v", err)
+	}
+
+	h := newTestHandlers()
+	h.users = users
+	if err := os.WriteFile(usersFile, []byte("not json"), 0600); err != nil {
+		t.Fatalf("write users file: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Lockout.MaxFailures = 9
+	if err := h.Reload(cfg); err == nil {
+		t.Fatal("expected a reload error for a bad users file")
+	}
+	if h.live().maxLoginFailures != 3 {
+		t.Fatalf("expected the settings to be left alone, got MAX_LOGIN_FAILURES %d", h.live().maxLoginFailures)
+	}
+	if _, ok := h.users.users["alice"]; !ok {
+		t.Fatal("expected the loaded users to be kept")
+	}
+}
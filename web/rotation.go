@@ -0,0 +1,87 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// generationSalt is fixed so the same password always gets the same
+// generation, across restarts and replicas.
+var generationSalt = []byte("gateway password generation")
+
+// passwordGeneration identifies a shared password (or its hash, if that's how
+// it is configured) so grants can record which one they were made with. It is
+// a short argon2id digest so the generations in storage are no cheaper to
+// guess passwords against than a hashed GATEWAY_PASSWORD.
+func passwordGeneration(password string) string {
+	if password == "" {
+		return ""
+	}
+	return hex.EncodeToString(argon2.IDKey([]byte(password), generationSalt, 1, 19*1024, 1, 8))
+}
+
+// matchPassword compares password against a configured GATEWAY_PASSWORD,
+// which is either plaintext or an argon2id hash.
+func matchPassword(configured, password string) bool {
+	if configured == "" {
+		return false
+	}
+	if isPasswordHash(configured) {
+		ok, _ := checkArgon2id(configured, password) // the format is checked at startup
+		return ok
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(configured)) == 1
+}
+
+// previousValidAt reports whether the previous password is still in its grace
+// period at now.
+func (s liveSettings) previousValidAt(now time.Time) bool {
+	return s.previousPasswd != "" && now.Before(s.previousSince.Add(s.passwordGrace))
+}
+
+// matchSharedPassword checks password against the current shared password and,
+// during its grace period, the previous one. It returns the generation of the
+// one that matched.
+func (h *Handlers) matchSharedPassword(password string, now time.Time) (string, bool) {
+	s := h.live()
+	if matchPassword(s.unlockPasswd, password) {
+		return s.unlockGeneration, true
+	}
+	if s.previousValidAt(now) && matchPassword(s.previousPasswd, password) {
+		slog.Info("Accepted the previous password", "event", "previous_password_used", "grace_ends", s.previousSince.Add(s.passwordGrace))
+		return s.previousGeneration, true
+	}
+	return "", false
+}
+
+// generationRetired reports whether a grant made with generation should be
+// revoked under REVOKE_RETIRED_GRANTS: it was made with a shared password that
+// is neither the current one nor the previous one in its grace period. Grants
+// without a generation are kept, since there is no telling which password
+// made them.
+func (s liveSettings) generationRetired(generation string, now time.Time) bool {
+	if !s.revokeRetired || generation == "" || s.unlockGeneration == "" {
+		return false
+	}
+	if generation == s.unlockGeneration {
+		return false
+	}
+	return generation != s.previousGeneration || !s.previousValidAt(now)
+}
+
+// revokeRetiredGrants revokes the grants generationRetired matches. It runs on
+// startup, on reload and with the hourly cleanup, so grants made with the
+// previous password go within the hour after its grace period ends.
+func (h *Handlers) revokeRetiredGrants(now time.Time) {
+	s := h.live()
+	if !s.revokeRetired {
+		return
+	}
+	h.revokeAndRecord("password_retired", "made with a retired password", func(a *authed) bool {
+		return s.generationRetired(a.Generation, now)
+	})
+}
@@ -0,0 +1,115 @@
+package web
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRotationHandlers(t *testing.T, current, previous string) *Handlers {
+	t.Helper()
+
+	h := newTestHandlers()
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	cfg := DefaultConfig()
+	cfg.Auth.Password = current
+	cfg.Auth.PreviousPassword = previous
+	cfg.Auth.PasswordRotatedAt = time.Now().Format(time.RFC3339)
+	cfg.Auth.RevokeRetiredGrants = true
+	cfg.Lockout.MaxFailures = 3
+	h.settings = newLiveSettings(cfg, false)
+	return &h
+}
+
+func TestPreviousPasswordUnlocksDuringGracePeriod(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestRotationHandlers(t, "new-password", "old-password")
+	if status, _ := postUnlock(h, "203.0.113.7", "old-password"); status != http.StatusOK {
+		t.Fatalf("expected the previous password to unlock during the grace period, got %d", status)
+	}
+	if status, _ := postUnlock(h, "203.0.113.8", "new-password"); status != http.StatusOK {
+		t.Fatalf("expected the current password to unlock, got %d", status)
+	}
+	if g := findTestGrant(h, "203.0.113.7"); g == nil || g.Generation != passwordGeneration("old-password") {
+		t.Fatalf("expected the grant to record the previous generation, got %#v", g)
+	}
+	if g := findTestGrant(h, "203.0.113.8"); g == nil || g.Generation != passwordGeneration("new-password") {
+		t.Fatalf("expected the grant to record the current generation, got %#v", g)
+	}
+
+	h.settingsLock.Lock()
+	h.settings.previousSince = time.Now().Add(-25 * time.Hour)
+	h.settingsLock.Unlock()
+	if status, _ := postUnlock(h, "203.0.113.9", "old-password"); status != http.StatusUnauthorized {
+		t.Fatalf("expected the previous password to be refused after the grace period, got %d", status)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestRevokeRetiredGrants(t *testing.T) {
+	h := newTestRotationHandlers(t, "new-password", "old-password")
+	now := time.Now()
+	for ip, generation := range map[string]string{
+		"203.0.113.1": passwordGeneration("new-password"),
+		"203.0.113.2": passwordGeneration("old-password"),
+		"203.0.113.3": passwordGeneration("older-password"),
+		"203.0.113.4": "",
+	} {
+		putTestGrant(h, &authed{IP: ip, AuthedTime: now, SessionHash: hashSession(ip), Generation: generation})
+	}
+
+	h.revokeRetiredGrants(now)
+	for ip, want := range map[string]bool{"203.0.113.1": true, "203.0.113.2": true, "203.0.113.3": false, "203.0.113.4": true} {
+		if got := findTestGrant(h, ip) != nil; got != want {
+			t.Fatalf("grant %s kept = %v, want %v", ip, got, want)
+		}
+	}
+
+	h.revokeRetiredGrants(now.Add(25 * time.Hour))
+	if findTestGrant(h, "203.0.113.2") != nil {
+		t.Fatal("expected the previous password's grant revoked after its grace period")
+	}
+	if findTestGrant(h, "203.0.113.1") == nil || findTestGrant(h, "203.0.113.4") == nil {
+		t.Fatal("expected current and unknown generation grants kept")
+	}
+}
+
+func TestGracePeriodRunsFromRotationTime(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.Password = "new-password"
+	cfg.Auth.PreviousPassword = "old-password"
+	cfg.Auth.RevokeRetiredGrants = true
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "PASSWORD_ROTATED_AT") {
+		t.Fatalf("expected the previous password to require a rotation time, got %v", err)
+	}
+
+	rotated := time.Now().Add(-25 * time.Hour).Truncate(time.Second)
+	cfg.Auth.PasswordRotatedAt = rotated.Format(time.RFC3339)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// A restart or reload rebuilds the settings from the configuration, so
+	// the grace period still ends 24 hours after the rotation.
+	h := newTestRotationHandlers(t, "new-password", "old-password")
+	putTestGrant(h, &authed{IP: "203.0.113.2", AuthedTime: time.Now(), SessionHash: hashSession("old"), Generation: passwordGeneration("old-password")})
+	if err := h.Reload(cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !h.live().previousSince.Equal(rotated) {
+		t.Fatalf("expected the grace period to start at %v, got %v", rotated, h.live().previousSince)
+	}
+	if _, ok := h.matchSharedPassword("old-password", time.Now()); ok {
+		t.Fatal("expected the previous password refused after its grace period")
+	}
+	if findTestGrant(h, "203.0.113.2") != nil {
+		t.Fatal("expected the previous password's grant revoked after its grace period")
+	}
+}
@@ -0,0 +1,212 @@
+package web
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// persistSchemaVersion is the persist file format written by this build. To
+// change the grant model, bump it and append a migration from the previous
+// version to persistMigrations.
+const persistSchemaVersion = 2
+
+// persistEnvelope is the persist file: the grants plus the schema version they
+// were written with.
+type persistEnvelope struct {
+	Version int               `json:"version"`
+	Grants  []persistedAuthed `json:"grants"`
+}
+
+// persistMigrations[v] rewrites a version v file as version v+1. Migrations
+// work on the raw JSON so they keep fields this build doesn't know about and
+// don't change meaning when persistedAuthed does.
+var persistMigrations = []func([]byte) ([]byte, error){
+	0: migrateBareArray,
+	1: migrateHashSessions,
+}
+
+var errPersistVersionMissing = errors.New("persist file has no schema version")
+
+// migrateBareArray wraps the original format, a bare array of grants, in the
+// version 1 envelope.
+func migrateBareArray(data []byte) ([]byte, error) {
+	var grants []json.RawMessage
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, err
+	}
+	if grants == nil {
+		grants = []json.RawMessage{}
+	}
+	return json.Marshal(struct {
+		Version int               `json:"version"`
+		Grants  []json.RawMessage `json:"grants"`
+	}{1, grants})
+}
+
+// migrateHashSessions replaces each grant's raw session token with its hash.
+func migrateHashSessions(data []byte) ([]byte, error) {
+	var envelope struct {
+		Grants []map[string]json.RawMessage `json:"grants"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if err := hashGrantSessions(envelope.Grants); err != nil {
+		return nil, err
+	}
+	if envelope.Grants == nil {
+		envelope.Grants = []map[string]json.RawMessage{}
+	}
+
+	return json.Marshal(struct {
+		Version int                          `json:"version"`
+		Grants  []map[string]json.RawMessage `json:"grants"`
+	}{2, envelope.Grants})
+}
+
+// hashGrantSessions replaces the "session" field of each grant with
+// "session_hash". Grants without a session are left to be repaired on load.
+func hashGrantSessions(grants []map[string]json.RawMessage) error {
+	for _, grant := range grants {
+		var session string
+		if raw, ok := grant["session"]; ok {
+			if err := json.Unmarshal(raw, &session); err != nil {
+				return fmt.Errorf("session: %w", err)
+			}
+			delete(grant, "session")
+		}
+		if session == "" {
+			continue
+		}
+		hash, err := json.Marshal(hashSession(session))
+		if err != nil {
+			return err
+		}
+		grant["session_hash"] = hash
+	}
+	return nil
+}
+
+// scrubSessions hashes the raw session tokens of a version from file in its
+// own layout, so the pre-migration backup holds nothing that could be replayed
+// as a cookie. Files from version 2 on only have hashes already.
+func scrubSessions(data []byte, from int) ([]byte, error) {
+	switch from {
+	case 0:
+		var grants []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &grants); err != nil {
+			return nil, err
+		}
+		if err := hashGrantSessions(grants); err != nil {
+			return nil, err
+		}
+		return json.Marshal(grants)
+	case 1:
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		var grants []map[string]json.RawMessage
+		if err := json.Unmarshal(envelope["grants"], &grants); err != nil {
+			return nil, err
+		}
+		if err := hashGrantSessions(grants); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(grants)
+		if err != nil {
+			return nil, err
+		}
+		envelope["grants"] = raw
+		return json.Marshal(envelope)
+	default:
+		return data, nil
+	}
+}
+
+// persistVersion reports the schema version of a persist file. The original
+// format, a bare array, is version 0.
+func persistVersion(data []byte) (int, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return 0, nil
+	}
+
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	if header.Version == nil {
+		return 0, errPersistVersionMissing
+	}
+	return *header.Version, nil
+}
+
+// migratePersisted upgrades data to persistSchemaVersion and returns it with
+// the version it started at. Files from a newer build are refused rather than
+// read with fields dropped and then saved over.
+func migratePersisted(data []byte) ([]byte, int, error) {
+	from, err := persistVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > persistSchemaVersion || from < 0 {
+		return nil, from, fmt.Errorf("persist file schema version %d is not supported (this build reads up to %d)", from, persistSchemaVersion)
+	}
+
+	for v := from; v < persistSchemaVersion; v++ {
+		if data, err = persistMigrations[v](data); err != nil {
+			return nil, from, fmt.Errorf("migrating persist file from version %d: %w", v, err)
+		}
+	}
+	return data, from, nil
+}
+
+// persistBackupPath is where the pre-migration copy of a version v file is
+// kept.
+func persistBackupPath(path string, v int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, v)
+}
+
+// migratePersistFile rewrites the persist file at path in the current format,
+// sealed with aead if set. If the schema changed, the original is first copied
+// to persistBackupPath, with its session tokens hashed (see scrubSessions) and
+// sealed too, so a backup doesn't undo either protection; an existing backup is
+// left alone so the first pre-migration copy survives.
+func migratePersistFile(path string, original, migrated []byte, from int, aead cipher.AEAD) error {
+	if from != persistSchemaVersion {
+		backup := persistBackupPath(path, from)
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			scrubbed, err := scrubSessions(original, from)
+			if err != nil {
+				return fmt.Errorf("scrubbing persist file backup: %w", err)
+			}
+			sealed, err := sealPersisted(aead, scrubbed)
+			if err != nil {
+				return fmt.Errorf("sealing persist file backup: %w", err)
+			}
+			if err := writeFileAtomic(backup, sealed); err != nil {
+				return fmt.Errorf("backing up persist file: %w", err)
+			}
+		}
+		slog.Info("Migrating persist file", "event", "persist_migrated", "file", path, "from", from, "to", persistSchemaVersion, "backup", backup)
+	}
+
+	sealed, err := sealPersisted(aead, migrated)
+	if err != nil {
+		return fmt.Errorf("sealing persist file: %w", err)
+	}
+	if err := writeFileAtomic(path, sealed); err != nil {
+		return fmt.Errorf("writing migrated persist file: %w", err)
+	}
+	if aead != nil && from == persistSchemaVersion {
+		slog.Info("Encrypted persist file", "event", "persist_encrypted", "file", path)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package web
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadPersistedMigratesBareArray(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "granted.json")
+	authedAt := time.Now().Truncate(time.Second).UTC()
+	original := `[{"ip":"203.0.113.1","authed_time":"` + authedAt.Format(time.RFC3339) + `","session":"a","last_access":"2024-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatalf("write persist file: %v", err)
+	}
+
+	grants, err := readPersisted(path, nil)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(grants) != 1 || grants[0].IP != "203.0.113.1" || grants[0].SessionHash != hashSession("a") || !grants[0].AuthedTime.Equal(authedAt) {
+		t.Fatalf("expected the grant to survive migration, got %#v", grants)
+	}
+
+	backup, err := os.ReadFile(persistBackupPath(path, 0))
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	var backedUp []map[string]any
+	if err := json.Unmarshal(backup, &backedUp); err != nil || len(backedUp) != 1 || backedUp[0]["last_access"] == nil {
+		t.Fatalf("expected the original grants to be backed up in their own layout, got %s (%v)", backup, err)
+	}
+	if _, raw := backedUp[0]["session"]; raw || backedUp[0]["session_hash"] != hashSession("a") {
+		t.Fatalf("expected the backup to hold only the session's hash, got %s", backup)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read migrated file: %v", err)
+	}
+	var migrated struct {
+		Version int              `json:"version"`
+		Grants  []map[string]any `json:"grants"`
+	}
+	if err := json.Unmarshal(data, &migrated); err != nil {
+		t.Fatalf("decode migrated file: %v", err)
+	}
+	if migrated.Version != persistSchemaVersion || len(migrated.Grants) != 1 {
+		t.Fatalf("expected a current envelope, got %s", data)
+	}
+	if _, ok := migrated.Grants[0]["last_access"]; !ok {
+		t.Fatal("expected migration to keep fields it doesn't know about")
+	}
+
+	// Reading again is a no-op.
+	if _, err := readPersisted(path, nil); err != nil {
+		t.Fatalf("re-read: %v", err)
+	}
+	if again, _ := os.ReadFile(path); string(again) != string(data) {
+		t.Fatal("expected a current file not to be rewritten")
+	}
+}
+
+func TestReadPersistedBackupHasNoRawSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "granted.json")
+	original := `{"version":1,"grants":[{"ip":"203.0.113.1","authed_time":"` + time.Now().Format(time.RFC3339) + `","session":"secret-session"}]}`
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatalf("write persist file: %v", err)
+	}
+
+	if _, err := readPersisted(path, nil); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	backup, err := os.ReadFile(persistBackupPath(path, 1))
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	if strings.Contains(string(backup), "secret-session") || !strings.Contains(string(backup), hashSession("secret-session")) {
+		t.Fatalf("expected the backup to hold only the session's hash, got %s", backup)
+	}
+	if v, err := persistVersion(backup); err != nil || v != 1 {
+		t.Fatalf("expected the backup to stay a version 1 file, got %d (%v)", v, err)
+	}
+}
+
+func TestReadPersistedKeepsFirstBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "granted.json")
+	if err := os.WriteFile(persistBackupPath(path, 0), []byte("first"), 0600); err != nil {
+		t.Fatalf("write backup: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("[]"), 0600); err != nil {
+		t.Fatalf("write persist file: %v", err)
+	}
+
+	if _, err := readPersisted(path, nil); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if backup, _ := os.ReadFile(persistBackupPath(path, 0)); string(backup) != "first" {
+		t.Fatalf("expected the existing backup to be kept, got %q", backup)
+	}
+}
+
+func TestReadPersistedRejectsUnknownVersions(t *testing.T) {
+	for name, content := range map[string]string{
+		"newer":   `{"version":99,"grants":[]}`,
+		"missing": `{"grants":[]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "granted.json")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("write persist file: %v", err)
+			}
+
+			if _, err := readPersisted(path, nil); err == nil || !strings.Contains(err.Error(), "persist file") {
+				t.Fatalf("expected the file to be refused, got %v", err)
+			}
+			if data, _ := os.ReadFile(path); string(data) != content {
+				t.Fatal("expected a refused file to be left untouched")
+			}
+		})
+	}
+}
+
+func TestJSONStoreWritesCurrentVersion(t *testing.T) {
+	dir := t.TempDir()
+	s := newJSONStore(filepath.Join(dir, "granted.json"), "")
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: time.Now(), SessionHash: hashSession("a")}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if version, err := persistVersion(data); err != nil || version != persistSchemaVersion {
+		t.Fatalf("expected version %d, got %d (%v)", persistSchemaVersion, version, err)
+	}
+	if _, err := os.Stat(persistBackupPath(s.path, 0)); !os.IsNotExist(err) {
+		t.Fatal("expected no backup for a file written in the current format")
+	}
+}
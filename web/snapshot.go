@@ -0,0 +1,128 @@
+package web
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// grantView is an immutable copy of a grant, as the read path sees it.
+type grantView struct {
+	IP          string
+	AuthedTime  time.Time
+	Session     string // "" for grants loaded from storage; see authed.Session
+	SessionHash string
+	User        string
+	Generation  string
+}
+
+// grantSnapshot is a read-only copy of the grants. Writers copy it under
+// grantedLock, update the entries of the grants that changed and swap it in
+// whole (copy-on-write), so /access checks read it without taking grantedLock
+// or any record lock.
+type grantSnapshot struct {
+	byKey     map[string]*grantView
+	byIP      map[string][]*grantView // every user's grant on the IP
+	bySession map[string]*grantView
+}
+
+var emptyGrantSnapshot = &grantSnapshot{}
+
+func (a *authed) view() grantView {
+	a.recordEditLock.Lock()
+	defer a.recordEditLock.Unlock()
+
+	return grantView{IP: a.IP, AuthedTime: a.AuthedTime, Session: a.Session, SessionHash: a.SessionHash, User: a.User, Generation: a.Generation}
+}
+
+func (v *grantView) key() string {
+	return grantKey(v.IP, v.User)
+}
+
+// markGrantLocked notes that the grant under key was added, removed or edited
+// in place, for the next publishGrantsLocked. Callers hold grantedLock.
+func (h *Handlers) markGrantLocked(key string) {
+	if h.changedGrants == nil {
+		h.changedGrants = make(map[string]bool)
+	}
+	h.changedGrants[key] = true
+}
+
+// publishGrantsLocked swaps in a snapshot with the marked grants brought up to
+// date; the other entries are carried over as they are. Callers hold
+// grantedLock and call it after any change to granted or to a record in it,
+// once per batch of changes.
+func (h *Handlers) publishGrantsLocked() {
+	if len(h.changedGrants) == 0 {
+		return
+	}
+
+	old := h.grantSnapshot()
+	s := &grantSnapshot{byKey: maps.Clone(old.byKey), byIP: maps.Clone(old.byIP), bySession: maps.Clone(old.bySession)}
+	if s.byKey == nil {
+		s.byKey = make(map[string]*grantView, len(h.changedGrants))
+		s.byIP = make(map[string][]*grantView, len(h.changedGrants))
+		s.bySession = make(map[string]*grantView, len(h.changedGrants))
+	}
+	for key := range h.changedGrants {
+		if v := s.byKey[key]; v != nil {
+			delete(s.byKey, key)
+			if s.bySession[v.SessionHash] == v {
+				delete(s.bySession, v.SessionHash)
+			}
+			// The old slice is shared with the previous snapshot, so
+			// build a new one rather than deleting in place.
+			others := make([]*grantView, 0, len(s.byIP[v.IP]))
+			for _, o := range s.byIP[v.IP] {
+				if o != v {
+					others = append(others, o)
+				}
+			}
+			if len(others) == 0 {
+				delete(s.byIP, v.IP)
+			} else {
+				s.byIP[v.IP] = others
+			}
+		}
+		if a := h.granted[key]; a != nil {
+			v := a.view()
+			s.byKey[key] = &v
+			s.byIP[v.IP] = append(slices.Clip(s.byIP[v.IP]), &v)
+			if v.SessionHash != "" {
+				s.bySession[v.SessionHash] = &v
+			}
+		}
+	}
+	clear(h.changedGrants)
+	h.grants.Store(s)
+}
+
+// grantSnapshot returns the current snapshot; never nil.
+func (h *Handlers) grantSnapshot() *grantSnapshot {
+	if s := h.grants.Load(); s != nil {
+		return s
+	}
+	return emptyGrantSnapshot
+}
+
+// lookupGrant returns a grant on ip from the snapshot, or nil. When several
+// users hold one, an unexpired grant is preferred, and of those the shared
+// password's, whose session may go to any browser behind the IP.
+func (h *Handlers) lookupGrant(ip string) *grantView {
+	var found *grantView
+	for _, v := range h.grantSnapshot().byIP[ip] {
+		if h.isExpired(v) {
+			if found == nil {
+				found = v
+			}
+			continue
+		}
+		if v.User == "" {
+			return v
+		}
+		if found == nil || h.isExpired(found) {
+			found = v
+		}
+	}
+	return found
+}
@@ -0,0 +1,279 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, registers "sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS grants (
+	ip           TEXT NOT NULL,
+	authed_time  INTEGER NOT NULL,
+	session_hash TEXT NOT NULL,
+	user         TEXT NOT NULL DEFAULT '',
+	generation   TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (ip, user)
+);
+CREATE TABLE IF NOT EXISTS lockouts (
+	ip           TEXT PRIMARY KEY,
+	failures     INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL,
+	last_seen    INTEGER NOT NULL
+);`
+
+// sqliteStore keeps grants and lockouts in an embedded SQLite database, one
+// row per grant (IP and user) or locked-out IP, so each change is a single-row write instead of a full rewrite.
+// Times are stored as Unix nanoseconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; a single connection avoids
+	// SQLITE_BUSY between our own goroutines.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sqlite schema in %s: %w", path, err)
+	}
+	if err := migrateSQLiteSessions(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite schema in %s: %w", path, err)
+	}
+	if err := migrateSQLiteGenerations(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite schema in %s: %w", path, err)
+	}
+	if err := migrateSQLiteGrantKeys(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite schema in %s: %w", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// migrateSQLiteSessions replaces the raw session column of older databases
+// with session_hash.
+func migrateSQLiteSessions(db *sql.DB) error {
+	var old int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('grants') WHERE name = 'session'`).Scan(&old); err != nil || old == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`ALTER TABLE grants ADD COLUMN session_hash TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT ip, session FROM grants WHERE session != ''`)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var ip, session string
+		if err := rows.Scan(&ip, &session); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[ip] = hashSession(session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for ip, hash := range hashes {
+		if _, err := tx.Exec(`UPDATE grants SET session_hash = ? WHERE ip = ?`, hash, ip); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`ALTER TABLE grants DROP COLUMN session`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateSQLiteGenerations adds the generation column to older databases;
+// their grants keep an unknown ("") generation.
+func migrateSQLiteGenerations(db *sql.DB) error {
+	var found int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('grants') WHERE name = 'generation'`).Scan(&found); err != nil || found > 0 {
+		return err
+	}
+	_, err := db.Exec(`ALTER TABLE grants ADD COLUMN generation TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// migrateSQLiteGrantKeys rebuilds the grants table of older databases, keyed
+// by IP alone, with the (ip, user) key. SQLite can't change a primary key in
+// place.
+func migrateSQLiteGrantKeys(db *sql.DB) error {
+	var pk int
+	if err := db.QueryRow(`SELECT pk FROM pragma_table_info('grants') WHERE name = 'user'`).Scan(&pk); err != nil || pk > 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`CREATE TABLE grants_new (
+	ip           TEXT NOT NULL,
+	authed_time  INTEGER NOT NULL,
+	session_hash TEXT NOT NULL,
+	user         TEXT NOT NULL DEFAULT '',
+	generation   TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (ip, user)
+)`,
+		`INSERT INTO grants_new (ip, authed_time, session_hash, user, generation)
+	SELECT ip, authed_time, session_hash, user, generation FROM grants`,
+		`DROP TABLE grants`,
+		`ALTER TABLE grants_new RENAME TO grants`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) loadGrants() ([]persistedAuthed, error) {
+	rows, err := s.db.Query(`SELECT ip, authed_time, session_hash, user, generation FROM grants`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []persistedAuthed
+	for rows.Next() {
+		var p persistedAuthed
+		var authedTime int64
+		if err := rows.Scan(&p.IP, &authedTime, &p.SessionHash, &p.User, &p.Generation); err != nil {
+			return nil, err
+		}
+		p.AuthedTime = unixNanoTime(authedTime)
+		grants = append(grants, p)
+	}
+	return grants, rows.Err()
+}
+
+const upsertGrant = `INSERT INTO grants (ip, authed_time, session_hash, user, generation) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(ip, user) DO UPDATE SET authed_time = excluded.authed_time, session_hash = excluded.session_hash, generation = excluded.generation`
+
+func (s *sqliteStore) putGrant(p persistedAuthed) error {
+	_, err := s.db.Exec(upsertGrant, p.IP, timeUnixNano(p.AuthedTime), p.SessionHash, p.User, p.Generation)
+	return err
+}
+
+const deleteGrantRow = `DELETE FROM grants WHERE ip = ? AND user = ?`
+
+func (s *sqliteStore) deleteGrant(key string) error {
+	ip, user := splitGrantKey(key)
+	_, err := s.db.Exec(deleteGrantRow, ip, user)
+	return err
+}
+
+func (s *sqliteStore) applyGrants(puts []persistedAuthed, deletes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range puts {
+		if _, err := tx.Exec(upsertGrant, p.IP, timeUnixNano(p.AuthedTime), p.SessionHash, p.User, p.Generation); err != nil {
+			return err
+		}
+	}
+	for _, key := range deletes {
+		ip, user := splitGrantKey(key)
+		if _, err := tx.Exec(deleteGrantRow, ip, user); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) replaceGrants(grants []persistedAuthed) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM grants`); err != nil {
+		return err
+	}
+	for _, p := range grants {
+		if _, err := tx.Exec(upsertGrant, p.IP, timeUnixNano(p.AuthedTime), p.SessionHash, p.User, p.Generation); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) loadLockouts() ([]persistedLockout, error) {
+	rows, err := s.db.Query(`SELECT ip, failures, locked_until, last_seen FROM lockouts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []persistedLockout
+	for rows.Next() {
+		var l persistedLockout
+		var lockedUntil, lastSeen int64
+		if err := rows.Scan(&l.IP, &l.Failures, &lockedUntil, &lastSeen); err != nil {
+			return nil, err
+		}
+		l.LockedUntil, l.LastSeen = unixNanoTime(lockedUntil), unixNanoTime(lastSeen)
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+func (s *sqliteStore) putLockout(l persistedLockout) error {
+	_, err := s.db.Exec(`INSERT INTO lockouts (ip, failures, locked_until, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET failures = excluded.failures, locked_until = excluded.locked_until, last_seen = excluded.last_seen`,
+		l.IP, l.Failures, timeUnixNano(l.LockedUntil), timeUnixNano(l.LastSeen))
+	return err
+}
+
+func (s *sqliteStore) deleteLockout(ip string) error {
+	_, err := s.db.Exec(`DELETE FROM lockouts WHERE ip = ?`, ip)
+	return err
+}
+
+func (s *sqliteStore) close() error {
+	return s.db.Close()
+}
+
+// timeUnixNano and unixNanoTime map the zero time to 0 and back, since a
+// never-locked IP has a zero lockedUntil.
+func timeUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func unixNanoTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,126 @@
+// Passkey unlock and registration for the gateway unlock page. Kept as a
+// static file because the CSP only allows scripts from 'self'.
+(function () {
+  "use strict";
+
+  function toBuffer(value) {
+    var b64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    while (b64.length % 4) {
+      b64 += "=";
+    }
+    var raw = atob(b64);
+    var buf = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+      buf[i] = raw.charCodeAt(i);
+    }
+    return buf.buffer;
+  }
+
+  function toBase64URL(buffer) {
+    if (!buffer) {
+      return undefined;
+    }
+    var bytes = new Uint8Array(buffer);
+    var raw = "";
+    for (var i = 0; i < bytes.length; i++) {
+      raw += String.fromCharCode(bytes[i]);
+    }
+    return btoa(raw).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function status(text) {
+    var el = document.getElementById("passkey-status");
+    if (el) {
+      el.textContent = text;
+    }
+  }
+
+  function post(url, body) {
+    return fetch(url, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json" },
+      body: body ? JSON.stringify(body) : undefined
+    }).then(function (resp) {
+      if (!resp.ok) {
+        throw new Error("request failed (" + resp.status + ")");
+      }
+      return resp.status === 204 ? null : resp.json();
+    });
+  }
+
+  function login() {
+    status("Waiting for your passkey…");
+    post("unlock/webauthn/begin").then(function (begin) {
+      var opts = begin.options.publicKey;
+      opts.challenge = toBuffer(opts.challenge);
+      (opts.allowCredentials || []).forEach(function (c) {
+        c.id = toBuffer(c.id);
+      });
+      return navigator.credentials.get({ publicKey: opts }).then(function (cred) {
+        return post("unlock/webauthn/finish?token=" + encodeURIComponent(begin.token), {
+          id: cred.id,
+          rawId: toBase64URL(cred.rawId),
+          type: cred.type,
+          response: {
+            clientDataJSON: toBase64URL(cred.response.clientDataJSON),
+            authenticatorData: toBase64URL(cred.response.authenticatorData),
+            signature: toBase64URL(cred.response.signature),
+            userHandle: toBase64URL(cred.response.userHandle)
+          }
+        });
+      });
+    }).then(function () {
+      status("Unlocked.");
+      // Set (and checked) by the server for FORWARD_AUTH.
+      var ret = document.querySelector("input[name=return]");
+      if (ret) {
+        window.location.assign(ret.value);
+      }
+    }).catch(function (err) {
+      status("Passkey unlock failed: " + err.message);
+    });
+  }
+
+  function register() {
+    status("Follow your browser's prompt to create a passkey…");
+    post("unlock/webauthn/register/begin").then(function (begin) {
+      var opts = begin.options.publicKey;
+      opts.challenge = toBuffer(opts.challenge);
+      opts.user.id = toBuffer(opts.user.id);
+      (opts.excludeCredentials || []).forEach(function (c) {
+        c.id = toBuffer(c.id);
+      });
+      return navigator.credentials.create({ publicKey: opts }).then(function (cred) {
+        return post("unlock/webauthn/register/finish?token=" + encodeURIComponent(begin.token), {
+          id: cred.id,
+          rawId: toBase64URL(cred.rawId),
+          type: cred.type,
+          response: {
+            clientDataJSON: toBase64URL(cred.response.clientDataJSON),
+            attestationObject: toBase64URL(cred.response.attestationObject),
+            transports: cred.response.getTransports ? cred.response.getTransports() : []
+          }
+        });
+      });
+    }).then(function () {
+      status("Passkey added.");
+    }).catch(function (err) {
+      status("Could not add a passkey: " + err.message);
+    });
+  }
+
+  document.addEventListener("DOMContentLoaded", function () {
+    if (!window.PublicKeyCredential) {
+      return;
+    }
+    var loginButton = document.getElementById("passkey-login");
+    if (loginButton) {
+      loginButton.addEventListener("click", login);
+    }
+    var registerButton = document.getElementById("passkey-register");
+    if (registerButton) {
+      registerButton.addEventListener("click", register);
+    }
+  });
+})();
@@ -0,0 +1,387 @@
+package web
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// grantStore persists grants and lockout state. Handlers keeps the live state
+// in memory and writes each change through to the store; the store is only
+// read back at startup (and by the CLI).
+type grantStore interface {
+	loadGrants() ([]persistedAuthed, error)
+	putGrant(p persistedAuthed) error
+	// deleteGrant removes the grant under a grantKey.
+	deleteGrant(key string) error
+	// applyGrants writes a batch of upserts and deletes (grantKeys) at once.
+	applyGrants(puts []persistedAuthed, deletes []string) error
+	// replaceGrants swaps the whole set, for bulk cleanups.
+	replaceGrants(grants []persistedAuthed) error
+
+	loadLockouts() ([]persistedLockout, error)
+	putLockout(l persistedLockout) error
+	deleteLockout(ip string) error
+
+	close() error
+}
+
+type persistedLockout struct {
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// openStore opens the configured backend: "json" (the persist file, sealed if
+// PERSIST_KEY or PERSIST_KEY_FILE is set), "sqlite" or "redis" (shared
+// between replicas). expiration is the grant lifetime, for backends that
+// expire keys themselves.
+func openStore(c *StorageConfig, expiration time.Duration) (grantStore, error) {
+	if c.Backend != "" && c.Backend != "json" && (c.PersistKey != "" || c.PersistKeyFile != "") {
+		slog.Warn("PERSIST_KEY only encrypts the json backend; ignoring it", "backend", c.Backend)
+	}
+
+	switch c.Backend {
+	case "", "json":
+		aead, err := persistCipher(c)
+		if err != nil {
+			return nil, err
+		}
+		s := newJSONStore(c.PersistFile, c.LockoutFile)
+		s.aead = aead
+		return s, nil
+	case "sqlite":
+		return openSQLiteStore(c.SQLitePath)
+	case "redis":
+		if c.RedisURL == "" {
+			return nil, fmt.Errorf("STORAGE_BACKEND=redis requires REDIS_URL")
+		}
+		return openRedisStore(c.RedisURL, c.RedisPrefix, expiration)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", c.Backend)
+	}
+}
+
+// storage returns the configured store, falling back to the JSON file at
+// persistFile (without lockout state) for Handlers built without one.
+func (h *Handlers) storage() grantStore {
+	h.storeLock.Lock()
+	defer h.storeLock.Unlock()
+
+	if h.store == nil {
+		h.store = newJSONStore(h.persistFile, "")
+	}
+	return h.store
+}
+
+// shared returns the store if other replicas write to it too, or nil.
+func (h *Handlers) shared() sharedStore {
+	s, _ := h.storage().(sharedStore)
+	return s
+}
+
+// syncGrant writes the current state of the grant under key to the store: the
+// record if there is one, a delete if not. Reading the state at write time
+// means racing calls can't leave an older version behind. After Close has
+// begun it does nothing.
+func (h *Handlers) syncGrant(key string) {
+	if h.closing() {
+		return
+	}
+	h.syncGrants([]string{key})
+}
+
+// syncGrants is syncGrant for several keys, written as one batch.
+func (h *Handlers) syncGrants(keys []string) error {
+	h.saveLock.Lock()
+	defer h.saveLock.Unlock()
+
+	var (
+		puts    []persistedAuthed
+		deletes []string
+	)
+	h.grantedLock.Lock()
+	for _, key := range keys {
+		if a := h.granted[key]; a != nil {
+			puts = append(puts, snapshotPersisted(a))
+		} else {
+			deletes = append(deletes, key)
+		}
+	}
+	h.grantedLock.Unlock()
+
+	start := time.Now()
+	err := h.storage().applyGrants(puts, deletes)
+	h.metrics.persistSaved(time.Since(start), err)
+	if err != nil {
+		slog.Error("Error saving grants", "event", "persist_save_failed", "grants", keys, "err", err)
+	}
+	return err
+}
+
+// syncLockout writes the current lockout state for ip to the store. After
+// Close has begun it does nothing.
+func (h *Handlers) syncLockout(ip string) error {
+	if h.closing() {
+		return nil
+	}
+	return h.writeLockout(ip)
+}
+
+// writeLockout does the work of syncLockout, for the persist writer's flush.
+func (h *Handlers) writeLockout(ip string) error {
+	h.loginLock.Lock()
+	a := h.loginAttempts[ip]
+	var l persistedLockout
+	if a != nil {
+		l = persistedLockout{IP: ip, Failures: a.failures, LockedUntil: a.lockedUntil, LastSeen: a.lastSeen}
+	}
+	h.loginLock.Unlock()
+
+	var err error
+	if a != nil {
+		err = h.storage().putLockout(l)
+	} else {
+		err = h.storage().deleteLockout(ip)
+	}
+	h.metrics.lockoutSaved(err)
+	if err != nil {
+		slog.Error("Error saving lockout state", "ip", ip, "err", err)
+	}
+	return err
+}
+
+// loadLockouts restores lockout state, dropping entries pruning would remove.
+func (h *Handlers) loadLockouts() {
+	lockouts, err := h.storage().loadLockouts()
+	if err != nil {
+		slog.Error("Error loading lockout state", "err", err)
+		return
+	}
+
+	now := time.Now()
+	h.loginLock.Lock()
+	defer h.loginLock.Unlock()
+
+	for _, l := range lockouts {
+		if lockoutStale(l, now) {
+			continue
+		}
+		h.loginAttempts[l.IP] = &loginAttempt{failures: l.Failures, lockedUntil: l.LockedUntil, lastSeen: l.LastSeen}
+	}
+	if len(h.loginAttempts) > 0 {
+		slog.Info("Restored lockout state", "count", len(h.loginAttempts))
+	}
+}
+
+// lockoutStale reports whether pruneLoginAttempts would have dropped l: the
+// lockout is over and the IP has been quiet for an hour.
+func lockoutStale(l persistedLockout, now time.Time) bool {
+	return now.After(l.LockedUntil) && now.Sub(l.LastSeen) > time.Hour
+}
+
+// jsonStore is the PERSIST_FILE (a persistEnvelope). It keeps its own copy of
+// the records so single-grant updates can be applied, but every write still
+// rewrites the whole file (atomically: temp file + rename). Lockout state goes to a second
+// file, lockoutPath, written the same way; with no lockoutPath it isn't kept.
+type jsonStore struct {
+	lock   sync.Mutex
+	path   string
+	aead   cipher.AEAD                // seals the grants file if PERSIST_KEY is set
+	grants map[string]persistedAuthed // by grantKey
+
+	lockoutPath string
+	lockouts    map[string]persistedLockout
+}
+
+func newJSONStore(path, lockoutPath string) *jsonStore {
+	return &jsonStore{
+		path:        path,
+		grants:      make(map[string]persistedAuthed),
+		lockoutPath: lockoutPath,
+		lockouts:    make(map[string]persistedLockout),
+	}
+}
+
+func (s *jsonStore) loadGrants() ([]persistedAuthed, error) {
+	persisted, err := readPersisted(s.path, s.aead)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.grants = make(map[string]persistedAuthed, len(persisted))
+	for _, p := range persisted {
+		s.grants[p.key()] = p
+	}
+	return persisted, nil
+}
+
+func (s *jsonStore) putGrant(p persistedAuthed) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.grants[p.key()] = p
+	return s.writeLocked()
+}
+
+func (s *jsonStore) deleteGrant(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.grants, key)
+	return s.writeLocked()
+}
+
+func (s *jsonStore) applyGrants(puts []persistedAuthed, deletes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range puts {
+		s.grants[p.key()] = p
+	}
+	for _, key := range deletes {
+		delete(s.grants, key)
+	}
+	return s.writeLocked()
+}
+
+func (s *jsonStore) replaceGrants(grants []persistedAuthed) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.grants = make(map[string]persistedAuthed, len(grants))
+	for _, p := range grants {
+		s.grants[p.key()] = p
+	}
+	return s.writeLocked()
+}
+
+func (s *jsonStore) writeLocked() error {
+	persisted := make([]persistedAuthed, 0, len(s.grants))
+	for _, p := range s.grants {
+		persisted = append(persisted, p)
+	}
+	sortPersisted(persisted)
+
+	data, err := json.Marshal(persistEnvelope{Version: persistSchemaVersion, Grants: persisted})
+	if err != nil {
+		return fmt.Errorf("marshaling granted IPs: %w", err)
+	}
+	if data, err = sealPersisted(s.aead, data); err != nil {
+		return fmt.Errorf("sealing persist file: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing persist file: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonStore) loadLockouts() ([]persistedLockout, error) {
+	if s.lockoutPath == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(s.lockoutPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading lockout file: %w", err)
+	}
+	var lockouts []persistedLockout
+	if err := json.Unmarshal(data, &lockouts); err != nil {
+		return nil, fmt.Errorf("unmarshaling lockout file: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lockouts = make(map[string]persistedLockout, len(lockouts))
+	for _, l := range lockouts {
+		s.lockouts[l.IP] = l
+	}
+	return lockouts, nil
+}
+
+func (s *jsonStore) putLockout(l persistedLockout) error {
+	if s.lockoutPath == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lockouts[l.IP] = l
+	return s.writeLockoutsLocked()
+}
+
+func (s *jsonStore) deleteLockout(ip string) error {
+	if s.lockoutPath == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.lockouts, ip)
+	return s.writeLockoutsLocked()
+}
+
+// writeLockoutsLocked rewrites the lockout file, leaving out stale entries
+// (pruneLoginAttempts only forgets the ones still in memory).
+func (s *jsonStore) writeLockoutsLocked() error {
+	now := time.Now()
+	lockouts := make([]persistedLockout, 0, len(s.lockouts))
+	for ip, l := range s.lockouts {
+		if lockoutStale(l, now) {
+			delete(s.lockouts, ip)
+			continue
+		}
+		lockouts = append(lockouts, l)
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].IP < lockouts[j].IP })
+
+	data, err := json.Marshal(lockouts)
+	if err != nil {
+		return fmt.Errorf("marshaling lockouts: %w", err)
+	}
+	if err := writeFileAtomic(s.lockoutPath, data); err != nil {
+		return fmt.Errorf("writing lockout file: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonStore) close() error { return nil }
+
+// sortPersisted orders grants by IP, then user.
+func sortPersisted(grants []persistedAuthed) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].IP != grants[j].IP {
+			return grants[i].IP < grants[j].IP
+		}
+		return grants[i].User < grants[j].User
+	})
+}
+
+// writeFileAtomic replaces path with data via a temp file and rename, so a
+// crash mid-write leaves the old file intact.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
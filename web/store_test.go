@@ -0,0 +1,192 @@
+package web
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores returns one of each backend, backed by a temp dir.
+func testStores(t *testing.T) map[string]func() grantStore {
+	t.Helper()
+
+	dir := t.TempDir()
+	return map[string]func() grantStore{
+		"json": func() grantStore {
+			return newJSONStore(filepath.Join(dir, "granted.json"), filepath.Join(dir, "lockouts.json"))
+		},
+		"sqlite": func() grantStore {
+			s, err := openSQLiteStore(filepath.Join(dir, "gateway.db"))
+			if err != nil {
+				t.Fatalf("open sqlite: %v", err)
+			}
+			t.Cleanup(func() { s.close() })
+			return s
+		},
+	}
+}
+
+func TestStoresRoundTripGrants(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now, SessionHash: hashSession("a"), User: "alice"}); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := s.putGrant(persistedAuthed{IP: "203.0.113.2", AuthedTime: now, SessionHash: hashSession("b")}); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now.Add(time.Hour), SessionHash: hashSession("a"), User: "alice", Generation: "gen-2"}); err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: now, SessionHash: hashSession("f"), User: "bob"}); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := s.deleteGrant("203.0.113.2"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if err := s.deleteGrant(grantKey("203.0.113.1", "bob")); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+
+			grants, err := open().loadGrants()
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if len(grants) != 1 || grants[0].User != "alice" || grants[0].Generation != "gen-2" || !grants[0].AuthedTime.Equal(now.Add(time.Hour)) {
+				t.Fatalf("expected only the updated grant, got %#v", grants)
+			}
+
+			if err := s.replaceGrants([]persistedAuthed{{IP: "203.0.113.3", AuthedTime: now, SessionHash: hashSession("c")}}); err != nil {
+				t.Fatalf("replace: %v", err)
+			}
+			if grants, _ := open().loadGrants(); len(grants) != 1 || grants[0].IP != "203.0.113.3" {
+				t.Fatalf("expected the replaced set, got %#v", grants)
+			}
+
+			batch := []persistedAuthed{
+				{IP: "203.0.113.4", AuthedTime: now, SessionHash: hashSession("d")},
+				{IP: "203.0.113.5", AuthedTime: now, SessionHash: hashSession("e")},
+			}
+			if err := s.applyGrants(batch, []string{"203.0.113.3"}); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if grants, _ := open().loadGrants(); len(grants) != 2 || grants[0].IP == "203.0.113.3" || grants[1].IP == "203.0.113.3" {
+				t.Fatalf("expected the batch to replace the deleted grant, got %#v", grants)
+			}
+		})
+	}
+}
+
+func TestStoresKeepLockoutsAcrossRestart(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHandlers()
+			h.store = open()
+			for i := 0; i < h.settings.maxLoginFailures; i++ {
+				h.registerFailedLogin("198.51.100.7", "")
+				h.syncLockout("198.51.100.7")
+			}
+			h.registerFailedLogin("198.51.100.8", "")
+			h.syncLockout("198.51.100.8")
+			h.clearLoginAttempts("198.51.100.8")
+			time.Sleep(20 * time.Millisecond) // let registerFailedLogin's async writes land
+			h.store.close()
+
+			restarted := newTestHandlers()
+			restarted.store = open()
+			restarted.loadLockouts()
+			if locked, _ := restarted.isLockedOut("198.51.100.7"); !locked {
+				t.Fatal("expected the lockout to survive a restart")
+			}
+			if _, found := restarted.loginAttempts["198.51.100.8"]; found {
+				t.Fatal("expected cleared failures to stay cleared")
+			}
+		})
+	}
+}
+
+func TestJSONStoreDropsStaleLockouts(t *testing.T) {
+	dir := t.TempDir()
+	s := newJSONStore(filepath.Join(dir, "granted.json"), filepath.Join(dir, "lockouts.json"))
+
+	now := time.Now()
+	stale := persistedLockout{IP: "198.51.100.1", Failures: 1, LastSeen: now.Add(-2 * time.Hour)}
+	if err := s.putLockout(stale); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := s.putLockout(persistedLockout{IP: "198.51.100.2", LockedUntil: now.Add(time.Minute), LastSeen: now}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	lockouts, err := newJSONStore(s.path, s.lockoutPath).loadLockouts()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(lockouts) != 1 || lockouts[0].IP != "198.51.100.2" {
+		t.Fatalf("expected only the active lockout to be written, got %#v", lockouts)
+	}
+}
+
+func TestUnlockWritesSingleGrantToSQLite(t *testing.T) {
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	defer s.close()
+
+	h := newTestHandlers()
+	h.store = s
+	putTestGrant(&h, &authed{IP: "203.0.113.9", AuthedTime: time.Now(), Session: "existing", SessionHash: hashSession("existing")})
+
+	if _, err := h.addGranted("203.0.113.1", "alice", ""); err != nil {
+		t.Fatalf("add grant: %v", err)
+	}
+	h.syncGrant("203.0.113.1")
+
+	grants, err := s.loadGrants()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(grants) != 1 || grants[0].IP != "203.0.113.1" || grants[0].User != "alice" {
+		t.Fatalf("expected just the new grant to be written, got %#v", grants)
+	}
+}
+
+func TestSQLiteStoreHashesOldSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE grants (ip TEXT PRIMARY KEY, authed_time INTEGER NOT NULL, session TEXT NOT NULL, user TEXT NOT NULL DEFAULT '');
+		INSERT INTO grants VALUES ('203.0.113.1', 1, 'secret-session', 'alice')`); err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	db.Close()
+
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer s.close()
+
+	grants, err := s.loadGrants()
+	if err != nil || len(grants) != 1 || grants[0].SessionHash != hashSession("secret-session") || grants[0].User != "alice" {
+		t.Fatalf("expected the session to be hashed, got %#v (%v)", grants, err)
+	}
+	var raw int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('grants') WHERE name = 'session'`).Scan(&raw); err != nil || raw != 0 {
+		t.Fatalf("expected the raw session column to be dropped, got %d (%v)", raw, err)
+	}
+
+	if err := s.putGrant(persistedAuthed{IP: "203.0.113.1", AuthedTime: time.Now(), SessionHash: hashSession("b"), User: "bob"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if grants, err := s.loadGrants(); err != nil || len(grants) != 2 {
+		t.Fatalf("expected the migrated table to hold a grant per user on the IP, got %#v (%v)", grants, err)
+	}
+}
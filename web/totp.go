@@ -0,0 +1,235 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	totpPeriod        = 30 // seconds per code (RFC 6238 default)
+	totpDigits        = 6
+	totpSkew          = 1 // accept one step either side for clock drift
+	challengeTTL      = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpChallenge is a pending second-factor step. It is created once the
+// password has been accepted and is bound to the client IP that passed it.
+type totpChallenge struct {
+	user    string
+	ip      string
+	secret  string // only set while enrolling a new authenticator
+	expires time.Time
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given counter.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP checks code against the secret around now and returns the
+// matching time step. Steps at or before lastCounter are refused so a code
+// can't be replayed within its validity window.
+func matchTOTP(secret, code string, now time.Time, lastCounter int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI builds the otpauth:// URI understood by authenticator
+// apps.
+func totpProvisioningURI(issuer, user, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + user,
+		RawQuery: v.Encode(),
+	}).String()
+}
+
+// qrSVG renders text as an inline SVG QR code. Inline markup is used rather
+// than a data: image because the CSP only allows 'self' sources.
+func qrSVG(text string) (template.HTML, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	const quiet = 4
+	size := code.Size + 2*quiet
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="240" height="240" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+
+	// Only generated path data goes into the markup, never user input.
+	return template.HTML(b.String()), nil
+}
+
+// generateRecoveryCodes returns the plaintext codes to show the user once and
+// the hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	plain := make([]string, 0, recoveryCodeCount)
+	hashed := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		plain = append(plain, code[:5]+"-"+code[5:])
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return plain, hashed, nil
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code. The codes are random
+// and high-entropy, so a plain SHA-256 is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// beginSecondFactor stores a challenge for a user whose password was accepted
+// and returns the page data for the code step. Users without a secret get a
+// fresh one to enroll.
+func (h *Handlers) beginSecondFactor(ip, user string) (unlockPageData, error) {
+	token, err := generateSession()
+	if err != nil {
+		return unlockPageData{}, err
+	}
+
+	ch := &totpChallenge{user: user, ip: ip, expires: time.Now().Add(challengeTTL)}
+	if !h.users.hasTOTP(user) {
+		if ch.secret, err = generateTOTPSecret(); err != nil {
+			return unlockPageData{}, err
+		}
+	}
+
+	h.challengeLock.Lock()
+	if h.challenges == nil {
+		h.challenges = make(map[string]*totpChallenge)
+	}
+	h.challenges[token] = ch
+	h.challengeLock.Unlock()
+
+	return h.secondFactorPage(token, ch)
+}
+
+func (h *Handlers) secondFactorPage(token string, ch *totpChallenge) (unlockPageData, error) {
+	data := h.basePageData()
+	data.Pending = token
+	if ch.secret == "" {
+		return data, nil
+	}
+
+	data.Enroll = true
+	data.OTPSecret = ch.secret
+	uri := totpProvisioningURI(h.totpIssuer, ch.user, ch.secret)
+	data.OTPURI = template.URL(uri)
+	qrCode, err := qrSVG(uri)
+	if err != nil {
+		return unlockPageData{}, err
+	}
+	data.QR = qrCode
+	return data, nil
+}
+
+// challenge returns the pending challenge for token if it is still valid and
+// was issued to ip.
+func (h *Handlers) challenge(token, ip string) *totpChallenge {
+	h.challengeLock.Lock()
+	defer h.challengeLock.Unlock()
+
+	ch := h.challenges[token]
+	if ch == nil {
+		return nil
+	}
+	if time.Now().After(ch.expires) {
+		delete(h.challenges, token)
+		return nil
+	}
+	if ch.ip != ip {
+		return nil
+	}
+	return ch
+}
+
+func (h *Handlers) dropChallenge(token string) {
+	h.challengeLock.Lock()
+	defer h.challengeLock.Unlock()
+
+	delete(h.challenges, token)
+}
+
+// pruneChallenges removes abandoned second-factor challenges.
+func (h *Handlers) pruneChallenges(now time.Time) {
+	h.challengeLock.Lock()
+	defer h.challengeLock.Unlock()
+
+	for token, ch := range h.challenges {
+		if now.After(ch.expires) {
+			delete(h.challenges, token)
+		}
+	}
+}
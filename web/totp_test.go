@@ -0,0 +1,173 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTOTPCodeMatchesRFC6238Vector(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, T = 59s; the last six digits of 94287082.
+	if got := totpCode([]byte("12345678901234567890"), 59/totpPeriod); got != "287082" {
+		t.Fatalf("expected 287082, got %s", got)
+	}
+}
+
+func TestMatchTOTPRefusesReplayedStep(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	code := totpCode([]byte("12345678901234567890"), now.Unix()/totpPeriod)
+
+	step, ok := matchTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fatal("expected current code to match")
+	}
+	if _, ok := matchTOTP(secret, code, now, step); ok {
+		t.Fatal("expected an already used step to be refused")
+	}
+}
+
+func TestUnlockWithTOTPEnrollsThenRequiresCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.Templates = template.Must(template.ParseGlob("src/*.html"))
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass"})
+	h.users.file = filepath.Join(t.TempDir(), "users.json")
+	h.totpEnabled = true
+	h.totpIssuer = "Gateway"
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	const ip = "203.0.113.7"
+	login := url.Values{"user": {"alice"}, "pass": {"alice-pass"}}
+
+	// The password alone doesn't grant; it starts enrollment.
+	status, w := postUnlockForm(&h, ip, login)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for the password step, got %d", status)
+	}
+	if findTestGrant(&h, ip) != nil {
+		t.Fatal("expected no grant before the second factor")
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `href="otpauth://totp/`) || !strings.Contains(body, "<svg") {
+		t.Fatalf("expected provisioning link and QR code on enrollment page, got %q", body)
+	}
+	pending := pendingToken(t, body)
+
+	h.challengeLock.Lock()
+	secret := h.challenges[pending].secret
+	h.challengeLock.Unlock()
+	key, _ := totpEncoding.DecodeString(secret)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	// A challenge is bound to the IP that passed the password.
+	if status, _ := postUnlockForm(&h, "203.0.113.8", url.Values{"pending": {pending}, "code": {code}}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a challenge used from another IP, got %d", status)
+	}
+
+	status, w = postUnlockForm(&h, ip, url.Values{"pending": {pending}, "code": {code}})
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 after confirming enrollment, got %d", status)
+	}
+	if grant := findTestGrant(&h, ip); grant == nil || grant.User != "alice" {
+		t.Fatalf("expected alice to be granted after enrollment, got %#v", grant)
+	}
+	recovery := regexp.MustCompile(`<code>([a-z2-7]{5}-[a-z2-7]{5})</code>`).FindAllStringSubmatch(w.Body.String(), -1)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes to be shown, got %d", recoveryCodeCount, len(recovery))
+	}
+
+	// Next login asks for a code from the enrolled authenticator. The code
+	// used for enrollment can't be replayed.
+	_, w = postUnlockForm(&h, ip, login)
+	pending = pendingToken(t, w.Body.String())
+	if strings.Contains(w.Body.String(), "otpauth://") {
+		t.Fatal("expected no enrollment for an enrolled user")
+	}
+	if status, _ := postUnlockForm(&h, ip, url.Values{"pending": {pending}, "code": {code}}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a replayed code, got %d", status)
+	}
+
+	// A recovery code works exactly once.
+	if status, _ := postUnlockForm(&h, ip, url.Values{"pending": {pending}, "code": {recovery[0][1]}}); status != http.StatusOK {
+		t.Fatalf("expected 200 for a recovery code, got %d", status)
+	}
+	_, w = postUnlockForm(&h, ip, login)
+	pending = pendingToken(t, w.Body.String())
+	if status, _ := postUnlockForm(&h, ip, url.Values{"pending": {pending}, "code": {recovery[0][1]}}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a reused recovery code, got %d", status)
+	}
+
+	// The enrolled state survives a reload of the users file.
+	reloaded, err := loadUserStore(h.users.file)
+	if err != nil {
+		t.Fatalf("reload users file: %v", err)
+	}
+	if !reloaded.hasTOTP("alice") || len(reloaded.users["alice"].RecoveryCodes) != recoveryCodeCount-1 {
+		t.Fatalf("expected persisted secret and %d recovery codes, got %#v", recoveryCodeCount-1, reloaded.users["alice"])
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func pendingToken(t *testing.T, body string) string {
+	t.Helper()
+
+	m := regexp.MustCompile(`name="pending" value="([^"]+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("expected a pending second factor challenge, got %q", body)
+	}
+	return m[1]
+}
+
+func TestInterleavedTOTPEnrollmentKeepsFirstAuthenticator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.Templates = template.Must(template.ParseGlob("src/*.html"))
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass"})
+	h.users.file = filepath.Join(t.TempDir(), "users.json")
+	h.totpEnabled = true
+	h.totpIssuer = "Gateway"
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	const ip = "203.0.113.7"
+	login := url.Values{"user": {"alice"}, "pass": {"alice-pass"}}
+	codeFor := func(pending string) string {
+		h.challengeLock.Lock()
+		secret := h.challenges[pending].secret
+		h.challengeLock.Unlock()
+		key, _ := totpEncoding.DecodeString(secret)
+		return totpCode(key, time.Now().Unix()/totpPeriod)
+	}
+
+	_, w := postUnlockForm(&h, ip, login)
+	first := pendingToken(t, w.Body.String())
+	_, w = postUnlockForm(&h, ip, login)
+	second := pendingToken(t, w.Body.String())
+	firstCode, secondCode := codeFor(first), codeFor(second)
+
+	if status, _ := postUnlockForm(&h, ip, url.Values{"pending": {first}, "code": {firstCode}}); status != http.StatusOK {
+		t.Fatalf("expected the first enrollment to succeed, got %d", status)
+	}
+	enrolled := h.users.users["alice"].TOTPSecret
+
+	if status, _ := postUnlockForm(&h, ip, url.Values{"pending": {second}, "code": {secondCode}}); status != http.StatusConflict {
+		t.Fatalf("expected the stale enrollment to be refused, got %d", status)
+	}
+	if h.users.users["alice"].TOTPSecret != enrolled {
+		t.Fatal("expected the stale enrollment not to replace the enrolled authenticator")
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
@@ -1,83 +1,299 @@
 package web
 
 import (
-	"crypto/subtle"
-	"log"
+	"errors"
+	"html/template"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// unlockPageData is passed to the unlock template.
+type unlockPageData struct {
+	Users    bool // show the username field
+	Passkeys bool // WebAuthn is configured
+	OIDC     bool // offer sign in through the identity provider
+	Unlocked bool // a user just unlocked; offer to register a passkey
+	Granted  bool // this request unlocked the IP
+
+	// Return is where to send the browser after unlocking (FORWARD_AUTH);
+	// already checked against the allowed hosts.
+	Return string
+
+	// Second factor step. Pending is the challenge token carried between the
+	// password and code forms; the enrollment fields are only set for users
+	// who haven't registered an authenticator yet.
+	Pending       string
+	Enroll        bool
+	OTPSecret     string
+	OTPURI        template.URL // otpauth:// isn't on html/template's safe scheme list
+	QR            template.HTML
+	RecoveryCodes []string // shown once, right after enrollment
+}
+
 func (h *Handlers) UnlockPage(g *gin.Context) {
+	data := h.basePageData()
+	ret := h.forwardAuth.safeReturn(g.Request.FormValue("return"))
+
 	if g.Request.Method == http.MethodPost {
 		ip := h.clientIP(g)
 
-		if locked, retryIn := h.isLockedOut(ip); locked {
-			log.Printf("Rejecting login from locked-out IP %v (%ds remaining)", ip, int(retryIn.Seconds()))
-			g.Header("Retry-After", strconv.Itoa(int(retryIn.Seconds())+1))
-			g.Status(http.StatusTooManyRequests)
+		if h.rejectLockedOut(g, ip) {
 			return
 		}
 
-		rawPassword := g.Request.FormValue("pass")
-
-		password, valid := validatePassword(rawPassword)
-		if !valid {
-			log.Printf("Invalid password format from %v", ip)
-			g.Status(http.StatusBadRequest)
+		var ok bool
+		if token := g.Request.FormValue("pending"); token != "" {
+			data, ok = h.unlockSecondFactor(g, ip, token)
+		} else {
+			data, ok = h.unlockPassword(g, ip)
+		}
+		if !ok {
 			return
 		}
+	}
+
+	data.Return = ret
+	// Go straight back unless the page has something to show first: new
+	// recovery codes or the offer to add a passkey.
+	if data.Granted && ret != "" && len(data.RecoveryCodes) == 0 && !(data.Unlocked && data.Passkeys) {
+		g.Redirect(http.StatusSeeOther, ret)
+		return
+	}
+
+	if err := h.Templates.ExecuteTemplate(g.Writer, "unlock", data); err != nil {
+		slog.Error("Failed to render unlock page", "err", err)
+		g.Status(http.StatusInternalServerError)
+	}
+}
+
+// unlockPassword handles the password form. It returns the page to render, or
+// false if a bare status has already been written.
+func (h *Handlers) unlockPassword(g *gin.Context, ip string) (unlockPageData, bool) {
+	data := h.basePageData()
+
+	password, valid := validatePassword(g.Request.FormValue("pass"))
+	if !valid {
+		slog.Info("Invalid password format", "event", "unlock", "ip", ip, "decision", "deny", "reason", "invalid_format")
+		g.Status(http.StatusBadRequest)
+		return data, false
+	}
+
+	username, generation, ok := h.checkCredentials(g.Request.FormValue("user"), password)
+	if !ok {
+		h.registerFailedLogin(ip, username)
+		slog.Info("Failed login", "event", "unlock", "ip", ip, "user", username, "decision", "deny", "reason", "bad_credentials")
+		h.notifyAsync(ip, username, false)
+		// Return 401 (not 200) so a failed unlock is distinguishable in
+		// access logs; the page still renders below for the user.
+		g.Status(http.StatusUnauthorized)
+		return data, true
+	}
+
+	if h.totpEnabled && username != "" {
+		page, err := h.beginSecondFactor(ip, username)
+		if err != nil {
+			slog.Error("Failed to start second factor", "ip", ip, "err", err)
+			g.Status(http.StatusInternalServerError)
+			return data, false
+		}
+		return page, true
+	}
+
+	data.Unlocked = username != ""
+	data.Granted = h.completeUnlock(g, ip, username, generation)
+	return data, data.Granted
+}
+
+func (h *Handlers) basePageData() unlockPageData {
+	return unlockPageData{Users: h.users != nil, Passkeys: h.webAuthn != nil, OIDC: h.oidc != nil}
+}
+
+// unlockSecondFactor handles the code form that follows a correct password,
+// either confirming a new authenticator or checking an enrolled one.
+func (h *Handlers) unlockSecondFactor(g *gin.Context, ip, token string) (unlockPageData, bool) {
+	data := h.basePageData()
+
+	ch := h.challenge(token, ip)
+	if ch == nil {
+		slog.Info("Unknown or expired second factor challenge", "event", "unlock", "ip", ip, "decision", "deny", "reason", "challenge_expired")
+		g.Status(http.StatusUnauthorized)
+		return data, true
+	}
+
+	code := strings.TrimSpace(g.Request.FormValue("code"))
+	if code == "" || len(code) > 32 {
+		g.Status(http.StatusBadRequest)
+		return data, false
+	}
 
-		if subtle.ConstantTimeCompare([]byte(password), []byte(h.unlockPasswd)) == 1 {
-			record, err := h.addGranted(ip)
-			if err != nil {
-				log.Printf("Failed to create auth session for %v: %v", ip, err)
-				g.Status(http.StatusInternalServerError)
-				return
+	var (
+		ok            bool
+		err           error
+		recoveryCodes []string
+	)
+	if ch.secret != "" {
+		var step int64
+		if step, ok = matchTOTP(ch.secret, code, time.Now(), 0); ok {
+			var hashed []string
+			if recoveryCodes, hashed, err = generateRecoveryCodes(); err == nil {
+				err = h.users.enrollTOTP(ch.user, ch.secret, step, hashed)
 			}
-			h.clearLoginAttempts(ip)
-			h.setSessionCookie(g, record)
-		} else {
-			h.registerFailedLogin(ip)
-			log.Printf("Failed login from %v", ip)
-			go h.notify(ip, false)
-			// Return 401 (not 200) so a failed unlock is distinguishable in
-			// access logs; the page still renders below for the user.
-			g.Status(http.StatusUnauthorized)
 		}
+	} else {
+		ok, err = h.users.verifySecondFactor(ch.user, code, time.Now())
+	}
+	if errors.Is(err, errTOTPEnrolled) {
+		h.dropChallenge(token)
+		slog.Warn("Authenticator enrolled during another enrollment", "event", "unlock", "ip", ip, "user", ch.user, "decision", "deny", "reason", "already_enrolled")
+		g.Status(http.StatusConflict)
+		return data, true
+	}
+	if err != nil {
+		slog.Error("Failed to update second factor state", "user", ch.user, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return data, false
+	}
+
+	if !ok {
+		h.registerFailedLogin(ip, ch.user)
+		slog.Info("Failed second factor", "event", "unlock", "ip", ip, "user", ch.user, "decision", "deny", "reason", "bad_code")
+		h.notifyAsync(ip, ch.user, false)
+		g.Status(http.StatusUnauthorized)
+		page, err := h.secondFactorPage(token, ch)
+		if err != nil {
+			return data, true
+		}
+		return page, true
 	}
 
-	if err := h.Templates.ExecuteTemplate(g.Writer, "unlock", nil); err != nil {
-		log.Printf("Failed to render unlock page: %v", err)
+	h.dropChallenge(token)
+	if ch.secret != "" {
+		slog.Info("Enrolled authenticator", "event", "totp_enrolled", "user", ch.user)
+	}
+	data.RecoveryCodes = recoveryCodes
+	data.Unlocked = true
+	data.Granted = h.completeUnlock(g, ip, ch.user, "")
+	return data, data.Granted
+}
+
+// completeUnlock grants the IP and sets the session cookie, and the user
+// session cookie for a named user, once every factor has been checked.
+func (h *Handlers) completeUnlock(g *gin.Context, ip, user, generation string) bool {
+	record, err := h.addGranted(ip, user, generation)
+	if err != nil {
+		slog.Error("Failed to create auth session", "ip", ip, "err", err)
 		g.Status(http.StatusInternalServerError)
+		return false
 	}
+	h.clearLoginAttempts(ip)
+	h.issueSessionCookie(g, ip, "unlock", record.view())
+	if user != "" {
+		h.startUserSession(g, user)
+	}
+	h.events.add("unlock", ip, user, "")
+	h.metrics.unlock(true)
+	return true
 }
 
-func (h *Handlers) addGranted(ip string) (*authed, error) {
+// checkCredentials validates the submitted password. With a users file the
+// username must match an account; otherwise the password is compared against
+// the shared GATEWAY_PASSWORD (or the previous one during its grace period),
+// the returned username is always "" and the generation says which password
+// matched.
+func (h *Handlers) checkCredentials(rawUser, password string) (string, string, bool) {
+	if h.users == nil {
+		generation, ok := h.matchSharedPassword(password, time.Now())
+		return "", generation, ok
+	}
+
+	username, valid := validateUsername(rawUser)
+	if !valid {
+		return "", "", false
+	}
+	u, ok := h.users.authenticate(username, password)
+	if !ok {
+		return username, "", false
+	}
+	return u.Name, "", true
+}
+
+// addGranted grants ip to user ("" for the shared password or a local bypass)
+// after an unlock, with the password generation, if any. Other users' grants
+// on the same IP are left alone.
+func (h *Handlers) addGranted(ip, user, generation string) (*authed, error) {
+	// Reuse a grant another replica made for this IP and user rather than
+	// making a second one.
+	h.refreshFromShared("", ip)
 	now := time.Now()
+	key := grantKey(ip, user)
 
 	h.grantedLock.Lock()
-	if existing := h.reuseGrantedIPLocked(ip, now); existing != nil {
+	expired := h.compactGrantedLocked(now)
+	// Runs after every path below has released grantedLock.
+	defer h.recordExpired(expired)
+	if len(expired) > 0 {
+		slog.Info("Cleaned auth list", "event", "grants_cleaned", "expired", len(expired))
+	}
+	existing, err := h.reuseGrantLocked(ip, user, generation, now)
+	if err != nil {
+		h.grantedLock.Unlock()
+		return nil, err
+	}
+	if existing != nil {
+		h.publishGrantsLocked()
 		h.grantedLock.Unlock()
-		log.Printf("Reusing existing auth session for %v", ip)
-		go h.saveGranted()
+		fingerprint := sessionFingerprintOfHash(existing.view().SessionHash)
+		slog.Info("Reusing existing auth session", "event", "unlock", "ip", ip, "user", user, "decision", "allow", "reason", "existing_grant", "session", fingerprint)
+		h.audit.add("grant_reused", ip, user, fingerprint, "")
+		h.syncGrantAfterUnlock(key)
 		return existing, nil
 	}
 
-	record, err := newAuthed(ip, now)
+	record, err := newAuthed(ip, user, now)
 	if err != nil {
 		h.grantedLock.Unlock()
 		return nil, err
 	}
-	h.granted[ip] = record
+	record.Generation = generation
+	h.putGrantedLocked(record)
+	h.publishGrantsLocked()
 	h.grantedLock.Unlock()
 
-	log.Printf("Adding %v to allowed list", ip)
+	slog.Info("Adding grant", "event", "unlock", "ip", ip, "user", user, "decision", "allow", "reason", "new_grant", "session", sessionFingerprintOfHash(record.SessionHash))
+	h.audit.add("grant_created", ip, user, sessionFingerprintOfHash(record.SessionHash), "")
 
-	go h.saveGranted()
-	go h.notify(ip, true)
+	h.syncGrantAfterUnlock(key)
+	h.notifyAsync(ip, user, true)
 
 	return record, nil
 }
+
+// syncGrantAfterUnlock stores a new or renewed grant. Local stores are written
+// in the background by the persist writer; a shared store is written before
+// returning, since the next request may reach a replica that reads the grant
+// from it, and this one drops grants the store doesn't know.
+func (h *Handlers) syncGrantAfterUnlock(key string) {
+	if h.shared() != nil {
+		h.syncGrant(key)
+		return
+	}
+	h.queueGrant(key)
+}
+
+// rejectLockedOut writes a 429 if ip is locked out from failed unlocks.
+func (h *Handlers) rejectLockedOut(g *gin.Context, ip string) bool {
+	locked, retryIn := h.isLockedOut(ip)
+	if !locked {
+		return false
+	}
+
+	slog.Info("Rejecting login from locked-out IP", "event", "unlock", "ip", ip, "decision", "deny", "reason", "locked_out", "retry_in", retryIn.Round(time.Second).String())
+	g.Header("Retry-After", strconv.Itoa(int(retryIn.Seconds())+1))
+	g.Status(http.StatusTooManyRequests)
+	return true
+}
@@ -1,14 +1,22 @@
 package web
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const testPassword = "test-password"
@@ -19,9 +27,13 @@ const testPassword = "test-password"
 // engine's WriteHeaderNow flush, so the recorder's own Code isn't reliable for
 // body-less responses) along with the recorder for header assertions.
 func postUnlock(h *Handlers, ip, pass string) (int, *httptest.ResponseRecorder) {
+	return postUnlockForm(h, ip, url.Values{"pass": {pass}})
+}
+
+func postUnlockForm(h *Handlers, ip string, form url.Values) (int, *httptest.ResponseRecorder) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
-	c.Request = httptest.NewRequest(http.MethodPost, "/unlock", strings.NewReader("pass="+pass))
+	c.Request = httptest.NewRequest(http.MethodPost, "/unlock", strings.NewReader(form.Encode()))
 	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	c.Request.Header.Set("X-Gateway-Client-IP", ip)
 	h.UnlockPage(c)
@@ -32,7 +44,7 @@ func TestUnlockWrongPasswordReturns401(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers()
-	h.unlockPasswd = testPassword
+	h.settings.unlockPasswd = testPassword
 	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
 
 	status, _ := postUnlock(&h, "203.0.113.7", "wrong")
@@ -46,7 +58,7 @@ func TestUnlockCorrectPasswordGrantsHeaderIP(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers()
-	h.unlockPasswd = testPassword
+	h.settings.unlockPasswd = testPassword
 	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
 
 	status, w := postUnlock(&h, "203.0.113.7", testPassword)
@@ -73,7 +85,7 @@ func TestUnlockLocksOutAfterRepeatedFailures(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers() // maxLoginFailures = 3
-	h.unlockPasswd = testPassword
+	h.settings.unlockPasswd = testPassword
 	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
 
 	const ip = "203.0.113.7"
@@ -108,7 +120,7 @@ func TestUnlockSuccessClearsFailureCount(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	h := newTestHandlers() // maxLoginFailures = 3
-	h.unlockPasswd = testPassword
+	h.settings.unlockPasswd = testPassword
 	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
 
 	const ip = "203.0.113.7"
@@ -125,3 +137,214 @@ func TestUnlockSuccessClearsFailureCount(t *testing.T) {
 	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
 	time.Sleep(20 * time.Millisecond)
 }
+
+func newTestUserStore(t *testing.T, users map[string]string) *userStore {
+	t.Helper()
+
+	s := &userStore{users: make(map[string]*user)}
+	for name, pass := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("hash password: %v", err)
+		}
+		s.users[name] = &user{Name: name, PasswordHash: string(hash)}
+	}
+	return s
+}
+
+func TestDummyHashMatchesUsersAlgorithm(t *testing.T) {
+	argon, err := HashPassword(testPassword)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+
+	for _, tc := range []struct {
+		hash, want string
+	}{
+		{argon, fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$", argon2.Version, argon2Memory, argon2Time, argon2Threads)},
+		{string(bcrypted), fmt.Sprintf("$2a$%02d$", bcrypt.MinCost)},
+	} {
+		path := filepath.Join(t.TempDir(), "users.json")
+		data, _ := json.Marshal([]user{{Name: "alice", PasswordHash: tc.hash}})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("write users file: %v", err)
+		}
+		s, err := loadUserStore(path)
+		if err != nil {
+			t.Fatalf("load users file: %v", err)
+		}
+		if !strings.HasPrefix(s.dummy, tc.want) {
+			t.Fatalf("expected a dummy hash starting %q, got %q", tc.want, s.dummy)
+		}
+		if _, ok := s.authenticate("mallory", testPassword); ok {
+			t.Fatal("expected an unknown user to be refused")
+		}
+		if _, ok := s.authenticate("alice", testPassword); !ok {
+			t.Fatal("expected alice to authenticate")
+		}
+	}
+}
+
+func TestUnlockWithUsersFileRecordsUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass", "bob": "bob-pass"})
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	if status, _ := postUnlockForm(&h, "203.0.113.7", url.Values{"user": {"alice"}, "pass": {"bob-pass"}}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for another user's password, got %d", status)
+	}
+	if status, _ := postUnlockForm(&h, "203.0.113.7", url.Values{"user": {"mallory"}, "pass": {"alice-pass"}}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown user, got %d", status)
+	}
+
+	status, _ := postUnlockForm(&h, "203.0.113.7", url.Values{"user": {"alice"}, "pass": {"alice-pass"}})
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for valid credentials, got %d", status)
+	}
+	grant := findTestGrant(&h, "203.0.113.7")
+	if grant == nil || grant.User != "alice" {
+		t.Fatalf("expected grant attributed to alice, got %#v", grant)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func sessionCookie(w *httptest.ResponseRecorder, name string) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestUnlockByAnotherUserFromSameIPGetsOwnSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass", "bob": "bob-pass"})
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	_, w := postUnlockForm(&h, "203.0.113.7", url.Values{"user": {"alice"}, "pass": {"alice-pass"}})
+	alice := sessionCookie(w, "gateway_session")
+	_, w = postUnlockForm(&h, "203.0.113.7", url.Values{"user": {"bob"}, "pass": {"bob-pass"}})
+	bob := sessionCookie(w, "gateway_session")
+
+	if alice == "" || bob == "" || alice == bob {
+		t.Fatalf("expected each user their own session, got %q and %q", alice, bob)
+	}
+	if v := h.findGrantedBySession(bob); v == nil || v.User != "bob" {
+		t.Fatalf("expected bob's session to be attributed to bob, got %#v", v)
+	}
+	if v := h.findGrantedBySession(alice); v == nil || v.User != "alice" {
+		t.Fatalf("expected alice to keep her own grant on the shared IP, got %#v", v)
+	}
+
+	// Visiting from the same IP doesn't hand out bob's session.
+	wa := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(wa)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.Header.Set("X-Gateway-Client-IP", "203.0.113.7")
+	h.AccessPage(c)
+	if c.Writer.Status() != http.StatusOK || sessionCookie(wa, "gateway_session") != "" {
+		t.Fatalf("expected IP access without bob's cookie, got %d %q", c.Writer.Status(), wa.Header().Get("Set-Cookie"))
+	}
+
+	if removed := h.revokeGrants(func(a *authed) bool { return a.User == "alice" }); len(removed) != 1 || removed[0].User != "alice" {
+		t.Fatalf("expected revoking alice to remove only her grant, removed %v", removed)
+	}
+	if h.findGrantedBySession(alice) != nil || h.findGrantedBySession(bob) == nil {
+		t.Fatal("expected bob's session to outlive alice's revocation")
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestUnlockWithUsersFileIgnoresSharedPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	h.settings.unlockPasswd = testPassword
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass"})
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	if status, _ := postUnlock(&h, "203.0.113.7", testPassword); status != http.StatusUnauthorized {
+		t.Fatalf("expected shared password to be rejected in multi-user mode, got %d", status)
+	}
+}
+
+func TestLoadGrantedDropsGrantsOfRemovedUsers(t *testing.T) {
+	now := time.Now().UTC()
+	data, err := json.Marshal([]persistedAuthed{
+		{IP: "203.0.113.10", AuthedTime: now, SessionHash: hashSession("alice-session"), User: "alice"},
+		{IP: "203.0.113.11", AuthedTime: now, SessionHash: hashSession("bob-session"), User: "bob"},
+		{IP: "203.0.113.12", AuthedTime: now, SessionHash: hashSession("shared-session")},
+	})
+	if err != nil {
+		t.Fatalf("marshal persisted grants: %v", err)
+	}
+	persistFile := filepath.Join(t.TempDir(), "granted.json")
+	if err := os.WriteFile(persistFile, data, 0600); err != nil {
+		t.Fatalf("write persisted grants: %v", err)
+	}
+
+	h := newTestHandlers()
+	h.persistFile = persistFile
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass"})
+
+	h.loadGranted()
+
+	if findTestGrant(&h, "203.0.113.11") != nil {
+		t.Fatal("expected grant for removed user bob to be dropped")
+	}
+	if findTestGrant(&h, "203.0.113.10") == nil || findTestGrant(&h, "203.0.113.12") == nil {
+		t.Fatal("expected grants for alice and the shared password to be kept")
+	}
+}
+
+func TestCheckPasswordHashArgon2id(t *testing.T) {
+	// argon2id of "secret" with salt "saltsaltsaltsalt", m=64, t=1, p=1.
+	salt := []byte("saltsaltsaltsalt")
+	key := argon2.IDKey([]byte("secret"), salt, 1, 64, 1, 32)
+	hash := "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+
+	if ok, err := checkPasswordHash(hash, "secret"); err != nil || !ok {
+		t.Fatalf("expected argon2id hash to verify, got ok=%v err=%v", ok, err)
+	}
+	if ok, err := checkPasswordHash(hash, "wrong"); err != nil || ok {
+		t.Fatalf("expected wrong password to fail, got ok=%v err=%v", ok, err)
+	}
+	if _, err := checkPasswordHash("plaintext", "plaintext"); err == nil {
+		t.Fatal("expected plaintext hash to be rejected")
+	}
+}
+
+func TestCheckPasswordHashRejectsBadArgon2idParameters(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("saltsaltsaltsalt"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+
+	for name, hash := range map[string]string{
+		"zero time":     "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"zero threads":  "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"huge time":     "$argon2id$v=19$m=64,t=100000,p=1$" + salt + "$" + key,
+		"tiny memory":   "$argon2id$v=19$m=8,t=1,p=4$" + salt + "$" + key,
+		"huge memory":   "$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + key,
+		"threads range": "$argon2id$v=19$m=64,t=1,p=300$" + salt + "$" + key,
+		"short salt":    "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString([]byte("salt")) + "$" + key,
+		"long salt":     "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)) + "$" + key,
+		"short key":     "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 8)),
+		"long key":      "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)),
+	} {
+		if _, err := checkPasswordHash(hash, "secret"); !errors.Is(err, errMalformedHash) {
+			t.Errorf("%s: expected errMalformedHash, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// user is a single account from the users file. Passwords are only ever
+// stored as bcrypt ($2a$/$2b$/$2y$) or argon2id (PHC string) hashes.
+type user struct {
+	Name         string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+
+	// Second factor state, written back to the users file on enrollment and
+	// each successful code.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // SHA-256 hashes, removed once used
+}
+
+// userStore holds the accounts loaded from USERS_FILE. When it is nil the
+// gateway runs in the legacy single shared password mode.
+type userStore struct {
+	lock  sync.Mutex
+	file  string
+	users map[string]*user
+	dummy string // see newDummyHash
+}
+
+var (
+	errUnknownHashFormat = errors.New("unknown password hash format")
+	errMalformedHash     = errors.New("malformed password hash")
+	errTOTPEnrolled      = errors.New("user already has an authenticator")
+)
+
+// loadUserStore reads the users file. The file is a JSON array of objects with
+// "username" and "password_hash" fields.
+func loadUserStore(path string) (*userStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*user
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("parse users file: %w", err)
+	}
+
+	s := &userStore{file: path, users: make(map[string]*user, len(users))}
+	for _, u := range users {
+		u.Name = strings.TrimSpace(u.Name)
+		if u.Name == "" {
+			return nil, errors.New("users file contains an entry without a username")
+		}
+		if _, dup := s.users[u.Name]; dup {
+			return nil, fmt.Errorf("users file contains duplicate username %q", u.Name)
+		}
+		if _, err := checkPasswordHash(u.PasswordHash, ""); errors.Is(err, errUnknownHashFormat) || errors.Is(err, errMalformedHash) {
+			return nil, fmt.Errorf("user %q: %w", u.Name, err)
+		}
+		s.users[u.Name] = u
+	}
+
+	if s.dummy, err = newDummyHash(users); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newDummyHash makes the hash authenticate compares against when the username
+// doesn't exist, so a miss costs roughly the same as a wrong password and
+// usernames can't be probed by timing. It uses the algorithm most of users'
+// hashes do: argon2id with HashPassword's parameters, or bcrypt at the cost
+// of the users' bcrypt hashes.
+func newDummyHash(users []*user) (string, error) {
+	password, err := generateSession()
+	if err != nil {
+		return "", err
+	}
+
+	bcrypts, cost := 0, bcrypt.DefaultCost
+	for _, u := range users {
+		if c, err := bcrypt.Cost([]byte(u.PasswordHash)); err == nil {
+			bcrypts, cost = bcrypts+1, c
+		}
+	}
+	if bcrypts*2 <= len(users) {
+		return HashPassword(password)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+// reload re-reads the users file, replacing the accounts. On error the
+// current accounts are kept.
+func (s *userStore) reload() (int, error) {
+	fresh, err := loadUserStore(s.file)
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users, s.dummy = fresh.users, fresh.dummy
+	return len(s.users), nil
+}
+
+// authenticate checks the password for the named user. It always performs a
+// hash comparison, even for unknown users.
+func (s *userStore) authenticate(name, password string) (*user, bool) {
+	s.lock.Lock()
+	u, hash := s.users[name], s.dummy
+	s.lock.Unlock()
+
+	if u != nil {
+		hash = u.PasswordHash
+	}
+
+	ok, err := checkPasswordHash(hash, password)
+	if err != nil || !ok || u == nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// exists reports whether the named user is still present in the store.
+func (s *userStore) exists(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.users[name]
+	return ok
+}
+
+// hasTOTP reports whether the user has enrolled an authenticator.
+func (s *userStore) hasTOTP(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u := s.users[name]
+	return u != nil && u.TOTPSecret != ""
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. Used TOTP steps and recovery codes are recorded in the users file so
+// they can't be replayed, including across restarts.
+func (s *userStore) verifySecondFactor(name, code string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u := s.users[name]
+	if u == nil || u.TOTPSecret == "" {
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTP(u.TOTPSecret, code, now, u.TOTPLastStep); ok {
+		u.TOTPLastStep = step
+		return true, s.saveLocked()
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, rc := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(hashed)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true, s.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// enrollTOTP stores a newly confirmed authenticator secret and replaces the
+// user's recovery codes. It fails with errTOTPEnrolled if the user enrolled
+// since the challenge began, so a stale or concurrent enrollment can't replace
+// an authenticator already in use.
+func (s *userStore) enrollTOTP(name, secret string, step int64, recoveryHashes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u := s.users[name]
+	if u == nil {
+		return fmt.Errorf("unknown user %q", name)
+	}
+	if u.TOTPSecret != "" {
+		return errTOTPEnrolled
+	}
+	u.TOTPSecret = secret
+	u.TOTPLastStep = step
+	u.RecoveryCodes = recoveryHashes
+	return s.saveLocked()
+}
+
+// saveLocked rewrites the users file atomically (temp file + rename), the same
+// way saveGranted commits the persist file. Caller must hold s.lock.
+func (s *userStore) saveLocked() error {
+	if s.file == "" {
+		return nil
+	}
+
+	users := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// checkPasswordHash verifies password against a bcrypt or argon2id hash.
+func checkPasswordHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", errMalformedHash, err)
+		}
+		return true, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(hash, password)
+	default:
+		return false, errUnknownHashFormat
+	}
+}
+
+// Limits on the argon2id parameters checkArgon2id accepts. argon2.IDKey
+// panics on zero time or threads, and memory is allocated up front, so a
+// hash outside these is rejected rather than run.
+const (
+	maxArgon2Memory  = 1024 * 1024 // KiB
+	maxArgon2Time    = 64
+	minArgon2SaltLen = 8
+	maxArgon2SaltLen = 64
+	minArgon2KeyLen  = 16
+	maxArgon2KeyLen  = 64
+)
+
+// checkArgon2id verifies a PHC formatted argon2id hash:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func checkArgon2id(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformedHash
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errMalformedHash
+	}
+	if iterations < 1 || iterations > maxArgon2Time || threads < 1 ||
+		memory < 8*uint32(threads) || memory > maxArgon2Memory {
+		return false, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < minArgon2SaltLen || len(salt) > maxArgon2SaltLen {
+		return false, errMalformedHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) < minArgon2KeyLen || len(want) > maxArgon2KeyLen {
+		return false, errMalformedHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
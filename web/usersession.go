@@ -0,0 +1,93 @@
+package web
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	userCookie     = "gateway_user"
+	userSessionTTL = 12 * time.Hour
+)
+
+// userSessions say which user a browser unlocked as. Grant sessions can't:
+// a grant belongs to an IP, and its cookie can reach anyone behind it. A user
+// session is only ever issued to the browser that passed every factor, so it
+// is what passkey registration and ADMIN_USERS dashboard access go by.
+type userSessions struct {
+	lock     sync.Mutex
+	sessions map[string]userSession // hashSession(token) -> session
+}
+
+type userSession struct {
+	user    string
+	expires time.Time
+}
+
+// startUserSession issues a user session cookie after user unlocked. It is
+// host-only, unlike the grant cookie, since only the gateway's own pages read
+// it.
+func (h *Handlers) startUserSession(g *gin.Context, user string) {
+	token, err := generateSession()
+	if err != nil {
+		slog.Error("Failed to create user session", "user", user, "err", err)
+		return
+	}
+
+	h.userSessions.lock.Lock()
+	if h.userSessions.sessions == nil {
+		h.userSessions.sessions = make(map[string]userSession)
+	}
+	h.userSessions.sessions[hashSession(token)] = userSession{user: user, expires: time.Now().Add(userSessionTTL)}
+	h.userSessions.lock.Unlock()
+
+	g.SetSameSite(http.SameSiteStrictMode)
+	g.SetCookie(userCookie, token, int(userSessionTTL.Seconds()), "/", "", true, true)
+}
+
+// currentUser returns the user behind the request's user session cookie, or
+// "" if there is no valid one or the user has since been removed.
+func (h *Handlers) currentUser(g *gin.Context) string {
+	token, err := g.Cookie(userCookie)
+	if err != nil || token == "" {
+		return ""
+	}
+
+	h.userSessions.lock.Lock()
+	s, ok := h.userSessions.sessions[hashSession(token)]
+	h.userSessions.lock.Unlock()
+
+	if !ok || time.Now().After(s.expires) || h.userRevoked(s.user) {
+		return ""
+	}
+	return s.user
+}
+
+// endUserSessions drops every session of user, e.g. when their grants are
+// revoked.
+func (h *Handlers) endUserSessions(user string) {
+	h.userSessions.lock.Lock()
+	defer h.userSessions.lock.Unlock()
+
+	for hash, s := range h.userSessions.sessions {
+		if s.user == user {
+			delete(h.userSessions.sessions, hash)
+		}
+	}
+}
+
+// pruneUserSessions drops expired user sessions.
+func (h *Handlers) pruneUserSessions(now time.Time) {
+	h.userSessions.lock.Lock()
+	defer h.userSessions.lock.Unlock()
+
+	for hash, s := range h.userSessions.sessions {
+		if now.After(s.expires) {
+			delete(h.userSessions.sessions, hash)
+		}
+	}
+}
@@ -2,134 +2,272 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"crypto/rand"
-	"crypto/subtle"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type Handlers struct {
-	Templates    *template.Template
-	unlockPasswd string
-
-	grantedLock    sync.Mutex // Not concerned for performance
-	granted        map[string]*authed
-	saveLock       sync.Mutex // serializes persist-file writes (atomic save)
+	Templates *template.Template
+	users     *userStore // optional per-user accounts (USERS_FILE); nil = shared password
+
+	settingsLock sync.RWMutex
+	settings     liveSettings // guarded by settingsLock; read through live()
+
+	totpEnabled   bool // require a TOTP code after the password (users file only)
+	totpIssuer    string
+	challengeLock sync.Mutex
+	challenges    map[string]*totpChallenge
+
+	webAuthn     *webauthn.WebAuthn // nil unless WEBAUTHN_RP_ID is set (users file only)
+	passkeys     *passkeyStore
+	ceremonyLock sync.Mutex
+	ceremonies   map[string]*webauthnCeremony
+
+	oidc *oidcLogin // nil unless OIDC_ISSUER is set
+
+	forwardAuth *forwardAuth // nil unless FORWARD_AUTH is set
+
+	admin        adminSessions // dashboard logins made with ADMIN_TOKEN
+	userSessions userSessions  // who a browser unlocked as; see currentUser
+	csrfKey      []byte        // per-process key for dashboard CSRF tokens
+	events       *eventLog     // recent security events shown on the dashboard
+	audit        *auditLog     // append-only, hash-chained audit file (AUDIT_LOG); nil = off
+
+	metrics *metrics // Prometheus collectors; nil in tests
+
+	grantedLock    sync.Mutex                    // guards granted; readers use grants instead
+	granted        map[string]*authed            // by grantKey
+	grants         atomic.Pointer[grantSnapshot] // copy of granted for the read path; see publishGrantsLocked
+	changedGrants  map[string]bool               // keys of grants that changed since the last publish
+	saveLock       sync.Mutex                    // serializes persist-file writes (atomic save)
+	writer         *persistWriter                // batches writes to local stores; nil = write inline
+	storeLock      sync.Mutex
+	store          grantStore // STORAGE_BACKEND; see storage()
 	persistFile    string
 	expirationDays int
 	cookieDomain   string
 	cookieName     string
 	clientIPHeader string
 
-	loginLock        sync.Mutex
-	loginAttempts    map[string]*loginAttempt
-	maxLoginFailures int
-	lockoutDuration  time.Duration
+	loginLock     sync.Mutex
+	loginAttempts map[string]*loginAttempt
 
-	slackWebhook string // optional Incoming Webhook URL (from SLACK_WEBHOOK_URL; "" = silent no-op)
+	stopBackground context.CancelFunc // stops cleanupExpiredIPs; nil in tests
+	background     sync.WaitGroup     // cleanup loop and in-flight notifications, drained by Close
+	closeLock      sync.Mutex
+	closed         bool // set by Close; guarded by closeLock, see goBackground
 }
 
 type authed struct {
 	IP         string    `json:"ip"`
 	AuthedTime time.Time `json:"authed_time"`
-	Session    string    `json:"session"`
+	// Session is the raw cookie value. Only its hash is stored, so for grants
+	// loaded from storage it is "" and the cookie can't be handed out again
+	// until an unlock rotates in a new one; clients that already hold it are
+	// matched on SessionHash.
+	Session     string `json:"-"`
+	SessionHash string `json:"session_hash"`
+	User        string `json:"user,omitempty"` // who unlocked; "" for the shared password
+	// Generation identifies the shared password the grant was made with (see
+	// passwordGeneration); "" for other unlocks and grants from before
+	// generations were recorded.
+	Generation string `json:"generation,omitempty"`
 
 	recordEditLock sync.Mutex `json:"-"`
 }
 
 type persistedAuthed struct {
-	IP         string    `json:"ip"`
-	AuthedTime time.Time `json:"authed_time"`
-	Session    string    `json:"session"`
+	IP          string    `json:"ip"`
+	AuthedTime  time.Time `json:"authed_time"`
+	SessionHash string    `json:"session_hash"`
+	User        string    `json:"user,omitempty"`
+	Generation  string    `json:"generation,omitempty"`
 }
 
 var errMissingIP = errors.New("missing IP")
 
-func SetupHandlers() *Handlers {
+// grantKey identifies a grant. Each user holds their own grant on an IP, so
+// several people behind one NAT address can unlock (and be revoked) without
+// affecting each other; the shared password and local bypass grant is keyed by
+// the bare IP. IPs never contain "/", so the key splits back unambiguously.
+func grantKey(ip, user string) string {
+	if user == "" {
+		return ip
+	}
+	return ip + "/" + user
+}
+
+// splitGrantKey undoes grantKey.
+func splitGrantKey(key string) (ip, user string) {
+	ip, user, _ = strings.Cut(key, "/")
+	return ip, user
+}
+
+func (a *authed) key() string {
+	return grantKey(a.IP, a.User)
+}
+
+func (p persistedAuthed) key() string {
+	return grantKey(p.IP, p.User)
+}
+
+// SetupHandlers builds the handlers from a loaded, validated config.
+func SetupHandlers(cfg *Config) *Handlers {
 	templates, err := template.ParseGlob("web/src/*.html")
 	if err != nil {
-		log.Fatalf("%s\n", err)
+		fatal("Failed to parse templates", "err", err)
 		return &Handlers{}
 	}
 
-	unlockPasswd := os.Getenv("GATEWAY_PASSWORD")
-	persistFile := os.Getenv("PERSIST_FILE")
-	if persistFile == "" {
-		persistFile = "granted_ips.json"
-	}
-	cookieDomain := os.Getenv("COOKIE_DOMAIN")
-	cookieName := os.Getenv("COOKIE_NAME")
-	if cookieName == "" {
-		cookieName = "gateway_session"
-	}
-	clientIPHeader := os.Getenv("CLIENT_IP_HEADER")
-	if clientIPHeader == "" {
-		clientIPHeader = "X-Gateway-Client-IP"
-	}
-
-	expirationDays := 30 // default
-	if expStr := os.Getenv("IP_EXPIRATION_DAYS"); expStr != "" {
-		if days, err := strconv.Atoi(expStr); err == nil && days > 0 {
-			expirationDays = days
-		} else {
-			log.Printf("Invalid IP_EXPIRATION_DAYS value '%s', using default of 30 days", expStr)
+	var users *userStore
+	if usersFile := cfg.Auth.UsersFile; usersFile != "" {
+		users, err = loadUserStore(usersFile)
+		if err != nil {
+			fatal("Error loading users file", "file", usersFile, "err", err)
+		}
+		slog.Info("Loaded users", "event", "users_loaded", "count", len(users.users), "file", usersFile)
+		if cfg.Auth.Password != "" {
+			slog.Warn("USERS_FILE is set, ignoring GATEWAY_PASSWORD")
 		}
 	}
 
-	maxLoginFailures := 5 // lock the IP out after this many failed unlocks
-	if v := os.Getenv("MAX_LOGIN_FAILURES"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			maxLoginFailures = n
-		} else {
-			log.Printf("Invalid MAX_LOGIN_FAILURES value '%s', using default of 5", v)
-		}
+	var webAuthn *webauthn.WebAuthn
+	var passkeys *passkeyStore
+	if cfg.WebAuthn.RPID != "" {
+		webAuthn, passkeys = setupWebAuthn(&cfg.WebAuthn)
 	}
 
-	lockoutMinutes := 15 // how long a locked-out IP stays locked
-	if v := os.Getenv("LOCKOUT_MINUTES"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			lockoutMinutes = n
-		} else {
-			log.Printf("Invalid LOCKOUT_MINUTES value '%s', using default of 15", v)
-		}
+	expiration := time.Duration(cfg.Auth.ExpirationDays) * 24 * time.Hour
+	store, err := openStore(&cfg.Storage, expiration)
+	if err != nil {
+		fatal("Error opening grant storage", "err", err)
 	}
 
-	slackWebhook := os.Getenv("SLACK_WEBHOOK_URL")
+	csrfKey := make([]byte, 32)
+	if _, err := rand.Read(csrfKey); err != nil {
+		fatal("Failed to generate CSRF key", "err", err)
+	}
 
 	h := Handlers{
-		Templates:        templates,
-		unlockPasswd:     unlockPasswd,
-		persistFile:      persistFile,
-		expirationDays:   expirationDays,
-		cookieDomain:     cookieDomain,
-		cookieName:       cookieName,
-		clientIPHeader:   clientIPHeader,
-		granted:          make(map[string]*authed),
-		loginAttempts:    make(map[string]*loginAttempt),
-		maxLoginFailures: maxLoginFailures,
-		lockoutDuration:  time.Duration(lockoutMinutes) * time.Minute,
-		slackWebhook:     slackWebhook,
-	}
-
-	// Load persisted IPs on startup
+		Templates:      templates,
+		users:          users,
+		settings:       newLiveSettings(cfg, users != nil),
+		totpEnabled:    cfg.Auth.TOTPEnabled,
+		totpIssuer:     cfg.Auth.TOTPIssuer,
+		challenges:     make(map[string]*totpChallenge),
+		webAuthn:       webAuthn,
+		passkeys:       passkeys,
+		ceremonies:     make(map[string]*webauthnCeremony),
+		oidc:           setupOIDC(&cfg.OIDC),
+		forwardAuth:    newForwardAuth(&cfg.ForwardAuth, cfg.Cookie.Domain),
+		admin:          adminSessions{sessions: make(map[string]time.Time)},
+		csrfKey:        csrfKey,
+		events:         newEventLog(defaultEventLogSize),
+		audit:          setupAuditLog(&cfg.Audit),
+		persistFile:    cfg.Storage.PersistFile,
+		store:          store,
+		expirationDays: cfg.Auth.ExpirationDays,
+		cookieDomain:   cfg.Cookie.Domain,
+		cookieName:     cfg.Cookie.Name,
+		clientIPHeader: cfg.Server.ClientIPHeader,
+		granted:        make(map[string]*authed),
+		loginAttempts:  make(map[string]*loginAttempt),
+	}
+	h.metrics = newMetrics(&h)
+
+	// Load persisted IPs and lockouts on startup
 	h.loadGranted()
+	h.loadLockouts()
+
+	// Shared stores are written inline; other replicas read them straight away.
+	if _, shared := store.(sharedStore); !shared {
+		h.writer = newPersistWriter(&h, time.Duration(cfg.Storage.DebounceMS)*time.Millisecond)
+	}
+	h.revokeRetiredGrants(time.Now())
 
 	// Start background cleanup goroutine
-	go h.cleanupExpiredIPs()
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stopBackground = cancel
+	h.background.Go(func() { h.cleanupExpiredIPs(ctx) })
 
 	return &h
 }
 
+// Close stops the cleanup loop, waits for in-flight notifications, flushes the
+// persist writer and saves every grant one last time before closing the store.
+// Call it once, after the server has stopped taking requests. Handlers still
+// running past a shutdown timeout can't start notifications or store writes
+// once it has begun; see closing.
+func (h *Handlers) Close() error {
+	h.closeLock.Lock()
+	h.closed = true
+	h.closeLock.Unlock()
+
+	if h.stopBackground != nil {
+		h.stopBackground()
+	}
+	h.background.Wait()
+	h.writer.close()
+
+	// A shared store is written inline and may hold newer grants from other
+	// replicas, so only local stores get the final rewrite.
+	var err error
+	if h.shared() == nil {
+		err = h.saveGranted()
+	}
+	return errors.Join(err, h.storage().close())
+}
+
+// setupWebAuthn builds the relying party config. Origins default to https on
+// the RP ID itself and passkeys are stored next to the persist file; see
+// Config.fillDerived.
+func setupWebAuthn(c *WebAuthnConfig) (*webauthn.WebAuthn, *passkeyStore) {
+	// Passkeys replace both the password and any TOTP step, so the
+	// authenticator must verify the user (PIN / biometric) itself.
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          c.RPID,
+		RPDisplayName: c.RPName,
+		RPOrigins:     c.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: challengeTTL, TimeoutUVD: challengeTTL},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: challengeTTL, TimeoutUVD: challengeTTL},
+		},
+	})
+	if err != nil {
+		fatal("Invalid WebAuthn configuration", "err", err)
+	}
+
+	passkeys, err := loadPasskeyStore(c.CredentialsFile)
+	if err != nil {
+		fatal("Error loading passkey file", "file", c.CredentialsFile, "err", err)
+	}
+
+	return w, passkeys
+}
+
 // Input validation functions
 func validatePassword(password string) (string, bool) {
 	// Check for null bytes and control characters that could cause issues
@@ -158,37 +296,46 @@ func validatePassword(password string) (string, bool) {
 	return password, true
 }
 
-func newAuthed(ip string, authedAt time.Time) (*authed, error) {
+func validateUsername(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 128 || !utf8.ValidString(name) {
+		return "", false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func newAuthed(ip, user string, authedAt time.Time) (*authed, error) {
 	session, err := generateSession()
 	if err != nil {
 		return nil, err
 	}
 
 	return &authed{
-		IP:         ip,
-		AuthedTime: authedAt,
-		Session:    session,
+		IP:          ip,
+		AuthedTime:  authedAt,
+		Session:     session,
+		SessionHash: hashSession(session),
+		User:        user,
 	}, nil
 }
 
 // loadGranted reads persisted IPs from file on startup
 func (h *Handlers) loadGranted() {
-	data, err := os.ReadFile(h.persistFile)
+	persisted, err := h.storage().loadGrants()
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Printf("No persist file found at %s, starting fresh", h.persistFile)
+			slog.Info("No persist file found, starting fresh", "file", h.persistFile)
 		} else {
-			log.Printf("Error reading persist file: %v", err)
+			slog.Error("Error reading persist file", "event", "persist_load_failed", "file", h.persistFile, "err", err)
 		}
 		return
 	}
 
-	var persisted []persistedAuthed
-	if err := json.Unmarshal(data, &persisted); err != nil {
-		log.Printf("Error unmarshaling persist file: %v", err)
-		return
-	}
-
 	now := time.Now()
 	expirationDuration := h.expirationDuration()
 	loaded := make([]*authed, 0, len(persisted))
@@ -196,24 +343,32 @@ func (h *Handlers) loadGranted() {
 	duplicateCount := 0
 	repairedCount := 0
 	invalidCount := 0
+	revokedCount := 0
 
 	h.grantedLock.Lock()
 	for _, p := range persisted {
 		if now.Sub(p.AuthedTime) > expirationDuration {
-			log.Printf("Skipping expired IP %s (authed %v)", p.IP, p.AuthedTime)
+			slog.Debug("Skipping expired grant", "event", "grant_skipped", "ip", p.IP, "reason", "expired", "authed_at", p.AuthedTime)
 			expiredCount++
 			continue
 		}
 
+		if h.userRevoked(p.User) {
+			slog.Info("Skipping grant of removed user", "event", "grant_skipped", "ip", p.IP, "user", p.User, "reason", "user_removed")
+			revokedCount++
+			continue
+		}
+
 		a, repaired, err := authedFromPersisted(p)
 		if err != nil {
-			log.Printf("Skipping persisted IP %s: %v", p.IP, err)
+			slog.Warn("Skipping invalid grant", "event", "grant_skipped", "ip", p.IP, "reason", "invalid", "err", err)
 			invalidCount++
 			continue
 		}
 
-		if existing := h.granted[a.IP]; existing != nil {
+		if existing := h.granted[a.key()]; existing != nil {
 			mergeAuthRecords(existing, a)
+			h.markGrantLocked(a.key())
 			duplicateCount++
 			continue
 		}
@@ -221,51 +376,108 @@ func (h *Handlers) loadGranted() {
 		if repaired {
 			repairedCount++
 		}
-		h.granted[a.IP] = a
+		h.putGrantedLocked(a)
 		loaded = append(loaded, a)
 	}
+	h.publishGrantsLocked()
 	h.grantedLock.Unlock()
 
 	for _, a := range loaded {
-		log.Printf("Restored IP %s from persist file (authed %v)", a.IP, a.AuthedTime)
+		slog.Debug("Restored grant", "event", "grant_restored", "ip", a.IP, "user", a.User, "authed_at", a.AuthedTime)
 	}
 
-	log.Printf("Loaded %d IP(s) from persist file", len(loaded))
+	slog.Info("Loaded persist file", "event", "persist_loaded", "count", len(loaded), "file", h.persistFile)
 
-	if expiredCount > 0 || duplicateCount > 0 || repairedCount > 0 || invalidCount > 0 {
-		log.Printf("Cleaned persist data: removed %d expired, merged %d duplicate, repaired %d missing session, skipped %d invalid record(s)", expiredCount, duplicateCount, repairedCount, invalidCount)
+	if expiredCount > 0 || duplicateCount > 0 || repairedCount > 0 || invalidCount > 0 || revokedCount > 0 {
+		slog.Info("Cleaned persist data", "event", "persist_cleaned", "expired", expiredCount, "duplicates", duplicateCount, "repaired", repairedCount, "invalid", invalidCount, "removed_users", revokedCount)
 		h.saveGranted()
 	}
 }
 
+// readPersisted parses a persist file, decrypting it with aead if it is
+// sealed. A file written by an older build is migrated in place (keeping a
+// backup), and a plaintext one is sealed if aead is set. A missing file returns
+// an error satisfying os.IsNotExist.
+func readPersisted(path string, aead cipher.AEAD) ([]persistedAuthed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, sealed, err := openPersisted(aead, data)
+	if err != nil {
+		return nil, err
+	}
+	migrated, from, err := migratePersisted(plain)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling persist file: %w", err)
+	}
+	if from != persistSchemaVersion || (aead != nil && !sealed) {
+		if err := migratePersistFile(path, plain, migrated, from, aead); err != nil {
+			return nil, err
+		}
+	}
+
+	var envelope persistEnvelope
+	if err := json.Unmarshal(migrated, &envelope); err != nil {
+		return nil, fmt.Errorf("unmarshaling persist file: %w", err)
+	}
+	return envelope.Grants, nil
+}
+
 func authedFromPersisted(p persistedAuthed) (*authed, bool, error) {
 	if strings.TrimSpace(p.IP) == "" {
 		return nil, false, errMissingIP
 	}
 
-	repaired := false
-	session := p.Session
-	if session == "" {
-		var err error
-		session, err = generateSession()
-		if err != nil {
-			return nil, false, err
+	if p.SessionHash == "" {
+		a, err := newAuthed(p.IP, p.User, p.AuthedTime)
+		if a != nil {
+			a.Generation = p.Generation
 		}
-		repaired = true
+		return a, true, err
 	}
 
 	return &authed{
-		IP:         p.IP,
-		AuthedTime: p.AuthedTime,
-		Session:    session,
-	}, repaired, nil
+		IP:          p.IP,
+		AuthedTime:  p.AuthedTime,
+		SessionHash: p.SessionHash,
+		User:        p.User,
+		Generation:  p.Generation,
+	}, false, nil
+}
+
+// userRevoked reports whether a grant belongs to a user that has since been
+// removed from the users file. Shared password grants (user ""), OIDC grants
+// and grants made while running without a users file are never considered
+// revoked.
+func (h *Handlers) userRevoked(user string) bool {
+	if h.users == nil || user == "" || strings.HasPrefix(user, oidcUserPrefix) {
+		return false
+	}
+	return !h.users.exists(user)
 }
 
 // saveGranted writes current granted IPs to file. Writes are serialized behind
 // saveLock and committed atomically (temp file + rename) so concurrent grants
 // can't interleave and a crash mid-write can't truncate the file -- a truncated
 // file fails to parse on startup and drops every authorized IP.
-func (h *Handlers) saveGranted() {
+func (h *Handlers) saveGranted() error {
+	start := time.Now()
+	n, err := h.writeGranted()
+	h.metrics.persistSaved(time.Since(start), err)
+	if err != nil {
+		slog.Error("Error saving persist file", "event", "persist_save_failed", "file", h.persistFile, "err", err)
+		return err
+	}
+
+	slog.Debug("Saved persist file", "event", "persist_saved", "count", n)
+	return nil
+}
+
+// writeGranted does the work of saveGranted and returns the number of records
+// written, for callers that need to know whether the save succeeded.
+func (h *Handlers) writeGranted() (int, error) {
 	h.saveLock.Lock()
 	defer h.saveLock.Unlock()
 
@@ -276,55 +488,56 @@ func (h *Handlers) saveGranted() {
 	}
 	h.grantedLock.Unlock()
 
-	data, err := json.Marshal(persisted)
-	if err != nil {
-		log.Printf("Error marshaling granted IPs: %v", err)
-		return
-	}
-
-	tmp := h.persistFile + ".tmp"
-	if err := os.WriteFile(tmp, data, 0600); err != nil {
-		log.Printf("Error writing persist file: %v", err)
-		return
+	if err := h.storage().replaceGrants(persisted); err != nil {
+		return 0, err
 	}
-
-	if err := os.Rename(tmp, h.persistFile); err != nil {
-		log.Printf("Error replacing persist file: %v", err)
-		_ = os.Remove(tmp)
-		return
-	}
-
-	log.Printf("Saved %d IP(s) to persist file", len(persisted))
+	return len(persisted), nil
 }
 
-// cleanupExpiredIPs runs in background to remove expired IPs
-func (h *Handlers) cleanupExpiredIPs() {
+// cleanupExpiredIPs runs in background to remove expired IPs, until ctx is
+// done.
+func (h *Handlers) cleanupExpiredIPs(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		now := time.Now()
 
 		h.grantedLock.Lock()
-		removed, merged := h.compactGrantedLocked(now)
+		expired := h.compactGrantedLocked(now)
+		h.publishGrantsLocked()
 		h.grantedLock.Unlock()
+		h.recordExpired(expired)
 
 		h.pruneLoginAttempts(now)
-
-		if removed > 0 || merged > 0 {
-			log.Printf("Cleanup: removed %d expired and merged %d duplicate IP record(s)", removed, merged)
-			h.saveGranted()
+		h.pruneChallenges(now)
+		h.pruneCeremonies(now)
+		if h.oidc != nil {
+			h.oidc.prune(now)
+		}
+		h.pruneAdminSessions(now)
+		h.pruneUserSessions(now)
+		h.revokeRetiredGrants(now)
+
+		if len(expired) > 0 {
+			slog.Info("Cleanup", "event", "grants_cleaned", "expired", len(expired))
+			// A shared store expires grants itself, and rewriting this
+			// replica's copy could bring back grants revoked elsewhere.
+			if h.shared() == nil {
+				h.queueSave()
+			}
 		}
 	}
 }
 
-// isExpired checks if an IP has expired
-func (h *Handlers) isExpired(a *authed) bool {
-	a.recordEditLock.Lock()
-	authedTime := a.AuthedTime
-	a.recordEditLock.Unlock()
-
-	return time.Since(authedTime) > h.expirationDuration()
+// isExpired checks if a grant has expired
+func (h *Handlers) isExpired(v *grantView) bool {
+	return time.Since(v.AuthedTime) > h.expirationDuration()
 }
 
 func (h *Handlers) cookieMaxAgeSeconds() int {
@@ -344,62 +557,91 @@ func generateSession() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(sessionBytes), nil
 }
 
-func (h *Handlers) findGrantedBySession(session string) *authed {
+// hashSession is how session tokens are stored and matched, so a copy of the
+// grants can't be replayed as cookies.
+func hashSession(session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return hex.EncodeToString(sum[:])
+}
+
+// findGrantedBySession looks the cookie up in the snapshot's session index.
+// The key is a SHA-256 of the token, so lookup timing says nothing useful
+// about it.
+func (h *Handlers) findGrantedBySession(session string) *grantView {
 	if session == "" {
 		return nil
 	}
+	return h.grantSnapshot().bySession[hashSession(session)]
+}
 
-	h.grantedLock.Lock()
-	// Snapshot the values under lock (map iteration is safe to snapshot pointers)
-	copied := make([]*authed, 0, len(h.granted))
-	for _, a := range h.granted {
-		copied = append(copied, a)
-	}
-	h.grantedLock.Unlock()
-
-	for _, authRecord := range copied {
-		authRecord.recordEditLock.Lock()
-		matches := subtle.ConstantTimeCompare([]byte(authRecord.Session), []byte(session)) == 1
-		authRecord.recordEditLock.Unlock()
-		if matches {
-			return authRecord
-		}
-	}
+// putGrantedLocked stores a under its grantKey, replacing any previous grant
+// for the same IP and user. Callers hold grantedLock and publish the change
+// with publishGrantsLocked.
+func (h *Handlers) putGrantedLocked(a *authed) {
+	h.granted[a.key()] = a
+	h.markGrantLocked(a.key())
+}
 
-	return nil
+// deleteGrantedLocked removes the grant under key. Callers hold grantedLock and
+// publish the change with publishGrantsLocked.
+func (h *Handlers) deleteGrantedLocked(key string) {
+	delete(h.granted, key)
+	h.markGrantLocked(key)
 }
 
-func (h *Handlers) reuseGrantedIPLocked(ip string, now time.Time) *authed {
-	removed, merged := h.compactGrantedLocked(now)
-	if removed > 0 || merged > 0 {
-		log.Printf("Cleaned auth list: removed %d expired and merged %d duplicate IP record(s)", removed, merged)
+// reuseGrantLocked renews user's grant on ip for another unlock, or returns
+// nil if they have none; grants of other users on the IP are left alone, so
+// each session token only ever goes to the user it names. A grant loaded from
+// storage or another replica only has its session's hash, so it gets a new
+// session that can be handed out.
+func (h *Handlers) reuseGrantLocked(ip, user, generation string, now time.Time) (*authed, error) {
+	record := h.granted[grantKey(ip, user)]
+	if record == nil {
+		return nil, nil
 	}
 
-	if record := h.granted[ip]; record != nil {
-		refreshAuthRecord(record, now)
-		return record
+	var session string
+	if record.view().Session == "" {
+		var err error
+		if session, err = generateSession(); err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	refreshAuthRecord(record, now)
+	record.recordEditLock.Lock()
+	// The grant now stands on this unlock, so it belongs to the password
+	// just used.
+	record.Generation = generation
+	if session != "" {
+		record.Session = session
+		record.SessionHash = hashSession(session)
+	}
+	record.recordEditLock.Unlock()
+	h.markGrantLocked(record.key())
+	return record, nil
 }
 
-func (h *Handlers) compactGrantedLocked(now time.Time) (int, int) {
-	removed := 0
-	merged := 0
-
-	for ip, record := range h.granted {
+// compactGrantedLocked removes expired grants and returns them, for the
+// caller to pass to recordExpired once it has released grantedLock.
+func (h *Handlers) compactGrantedLocked(now time.Time) []persistedAuthed {
+	var expired []persistedAuthed
+	for key, record := range h.granted {
 		if h.recordExpiredAt(record, now) {
-			record.recordEditLock.Lock()
-			log.Printf("Removing expired IP %s (authed %v)", record.IP, record.AuthedTime)
-			record.recordEditLock.Unlock()
-			delete(h.granted, ip)
-			removed++
-			continue
+			expired = append(expired, snapshotPersisted(record))
+			h.deleteGrantedLocked(key)
 		}
-		// No duplicate merging needed in map representation (keys unique by design)
 	}
+	return expired
+}
 
-	return removed, merged
+// recordExpired logs and audits the grants compactGrantedLocked removed. The
+// audit log writes to disk, so it runs without grantedLock held.
+func (h *Handlers) recordExpired(expired []persistedAuthed) {
+	for _, p := range expired {
+		slog.Info("Removing expired grant", "event", "grant_expired", "ip", p.IP, "user", p.User, "authed_at", p.AuthedTime)
+		h.audit.add("grant_expired", p.IP, p.User, sessionFingerprintOfHash(p.SessionHash), "")
+	}
 }
 
 func (h *Handlers) recordExpiredAt(record *authed, now time.Time) bool {
@@ -410,6 +652,8 @@ func (h *Handlers) recordExpiredAt(record *authed, now time.Time) bool {
 	return now.Sub(authedTime) > h.expirationDuration()
 }
 
+// refreshAuthRecord bumps the grant time. The user it is attributed to never
+// changes.
 func refreshAuthRecord(record *authed, authedAt time.Time) {
 	record.recordEditLock.Lock()
 	defer record.recordEditLock.Unlock()
@@ -429,6 +673,7 @@ func mergeAuthRecords(keep, drop *authed) {
 
 	if dropSnapshot.AuthedTime.After(keep.AuthedTime) {
 		keep.AuthedTime = dropSnapshot.AuthedTime
+		keep.Generation = dropSnapshot.Generation
 	}
 }
 
@@ -437,39 +682,74 @@ func snapshotPersisted(record *authed) persistedAuthed {
 	defer record.recordEditLock.Unlock()
 
 	return persistedAuthed{
-		IP:         record.IP,
-		AuthedTime: record.AuthedTime,
-		Session:    record.Session,
+		IP:          record.IP,
+		AuthedTime:  record.AuthedTime,
+		SessionHash: record.SessionHash,
+		User:        record.User,
+		Generation:  record.Generation,
 	}
 }
 
+// notifyAsync sends notify in the background; Close waits for it.
+func (h *Handlers) notifyAsync(ip, user string, unlocked bool) {
+	h.goBackground(func() { h.notify(ip, user, unlocked) })
+}
+
+// goBackground runs f on the background group unless Close has begun. The
+// check and the Add happen under closeLock, so Close's Wait never races a
+// late Add.
+func (h *Handlers) goBackground(f func()) {
+	h.closeLock.Lock()
+	defer h.closeLock.Unlock()
+
+	if h.closed {
+		slog.Debug("Dropping background work after shutdown")
+		return
+	}
+	h.background.Go(f)
+}
+
+// closing reports whether Close has begun. Store writes asked for after that
+// are dropped: the persist writer is being flushed and the store closed.
+func (h *Handlers) closing() bool {
+	h.closeLock.Lock()
+	defer h.closeLock.Unlock()
+	return h.closed
+}
+
 // notify sends a Slack notification (if configured) for successful unlock or incorrect password attempt.
-func (h *Handlers) notify(ip string, unlocked bool) {
-	if h.slackWebhook == "" {
+func (h *Handlers) notify(ip, user string, unlocked bool) {
+	webhook := h.live().slackWebhook
+	if webhook == "" {
 		return
 	}
 
-	text := ip + " incorrect password"
+	who := ip
+	if user != "" {
+		who = user + " (" + ip + ")"
+	}
+
+	text := who + " incorrect password"
 	if unlocked {
-		text = ip + " unlocked"
+		text = who + " unlocked"
 	}
 
 	payload := map[string]string{"text": text}
 	data, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to marshal Slack payload: %v", err)
+		slog.Error("Failed to marshal Slack payload", "err", err)
 		return
 	}
 
 	// Per-call *http.Client (with timeout) inside goroutine for minimal diff and
 	// to avoid introducing shared mutable state in Handlers.
 	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Post(h.slackWebhook, "application/json", bytes.NewReader(data))
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(data))
 	if resp != nil {
 		resp.Body.Close()
 	}
 	if err != nil {
-		log.Printf("Failed to send Slack notification: %v", err)
+		slog.Warn("Failed to send Slack notification", "event", "notify_failed", "err", err)
 		return
 	}
 }
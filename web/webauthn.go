@@ -0,0 +1,384 @@
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// maxWebAuthnBody bounds the attestation/assertion JSON accepted from clients.
+const maxWebAuthnBody = 64 << 10
+
+// passkeyStore persists registered WebAuthn credentials per username. It lives
+// in its own file next to the persist file so grants can be wiped without
+// losing everyone's passkeys.
+type passkeyStore struct {
+	lock  sync.Mutex
+	file  string
+	users map[string]*passkeyUser
+}
+
+type passkeyUser struct {
+	Handle      []byte                `json:"handle"` // random WebAuthn user handle, never the username
+	Credentials []webauthn.Credential `json:"credentials"`
+}
+
+// passkeyAccount adapts a stored user to the webauthn.User interface.
+type passkeyAccount struct {
+	name string
+	*passkeyUser
+}
+
+func (a passkeyAccount) WebAuthnID() []byte                         { return a.Handle }
+func (a passkeyAccount) WebAuthnName() string                       { return a.name }
+func (a passkeyAccount) WebAuthnDisplayName() string                { return a.name }
+func (a passkeyAccount) WebAuthnCredentials() []webauthn.Credential { return a.Credentials }
+
+// webauthnCeremony is the server side half of an in-flight registration or
+// login, keyed by a random token handed to the browser.
+type webauthnCeremony struct {
+	session webauthn.SessionData
+	ip      string
+	user    string // registering user; "" for a login
+}
+
+var errUnknownPasskey = errors.New("unknown passkey")
+
+func loadPasskeyStore(path string) (*passkeyStore, error) {
+	s := &passkeyStore{file: path, users: make(map[string]*passkeyUser)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("parse passkey file: %w", err)
+	}
+	return s, nil
+}
+
+// account returns the passkey account for name, creating an empty one with a
+// fresh user handle if needed. The new account isn't saved until a credential
+// is added.
+func (s *passkeyStore) account(name string) (passkeyAccount, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if u := s.users[name]; u != nil {
+		return u.snapshot(name), nil
+	}
+
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return passkeyAccount{}, err
+	}
+	return passkeyAccount{name: name, passkeyUser: &passkeyUser{Handle: handle}}, nil
+}
+
+// byHandle finds the account owning a WebAuthn user handle.
+func (s *passkeyStore) byHandle(handle []byte) (passkeyAccount, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, u := range s.users {
+		if bytes.Equal(u.Handle, handle) {
+			return u.snapshot(name), nil
+		}
+	}
+	return passkeyAccount{}, errUnknownPasskey
+}
+
+// snapshot copies the credential list so callers can use it without holding
+// the store lock. Caller must hold the lock.
+func (u *passkeyUser) snapshot(name string) passkeyAccount {
+	return passkeyAccount{name: name, passkeyUser: &passkeyUser{
+		Handle:      u.Handle,
+		Credentials: append([]webauthn.Credential(nil), u.Credentials...),
+	}}
+}
+
+// putCredential adds a credential, or replaces the stored copy with the same
+// ID (to record the new signature counter), and saves the file.
+func (s *passkeyStore) putCredential(account passkeyAccount, cred webauthn.Credential) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u := s.users[account.name]
+	if u == nil {
+		u = &passkeyUser{Handle: account.Handle}
+		s.users[account.name] = u
+	}
+
+	replaced := false
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].ID, cred.ID) {
+			u.Credentials[i] = cred
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		u.Credentials = append(u.Credentials, cred)
+	}
+
+	return s.saveLocked()
+}
+
+// saveLocked commits the file atomically (temp file + rename). Caller must
+// hold s.lock.
+func (s *passkeyStore) saveLocked() error {
+	data, err := json.Marshal(s.users)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (h *Handlers) putCeremony(c *webauthnCeremony) (string, error) {
+	token, err := generateSession()
+	if err != nil {
+		return "", err
+	}
+
+	h.ceremonyLock.Lock()
+	defer h.ceremonyLock.Unlock()
+
+	if h.ceremonies == nil {
+		h.ceremonies = make(map[string]*webauthnCeremony)
+	}
+	h.ceremonies[token] = c
+	return token, nil
+}
+
+// takeCeremony removes and returns the ceremony for token. Ceremonies are
+// single use and bound to the IP that started them.
+func (h *Handlers) takeCeremony(token, ip string) *webauthnCeremony {
+	h.ceremonyLock.Lock()
+	defer h.ceremonyLock.Unlock()
+
+	c := h.ceremonies[token]
+	if c == nil {
+		return nil
+	}
+	delete(h.ceremonies, token)
+
+	if c.ip != ip || time.Now().After(c.session.Expires) {
+		return nil
+	}
+	return c
+}
+
+// pruneCeremonies removes abandoned WebAuthn ceremonies.
+func (h *Handlers) pruneCeremonies(now time.Time) {
+	h.ceremonyLock.Lock()
+	defer h.ceremonyLock.Unlock()
+
+	for token, c := range h.ceremonies {
+		if now.After(c.session.Expires) {
+			delete(h.ceremonies, token)
+		}
+	}
+}
+
+// WebAuthnBegin starts a passkey login. Discoverable credentials are used so
+// the browser can offer the user's passkey without a username.
+func (h *Handlers) WebAuthnBegin(g *gin.Context) {
+	if h.webAuthn == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	if h.rejectLockedOut(g, ip) {
+		return
+	}
+
+	assertion, session, err := h.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		slog.Error("Failed to begin passkey login", "ip", ip, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.putCeremony(&webauthnCeremony{session: *session, ip: ip})
+	if err != nil {
+		slog.Error("Failed to store passkey ceremony", "ip", ip, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	g.JSON(http.StatusOK, gin.H{"token": token, "options": assertion})
+}
+
+// WebAuthnFinish verifies a passkey assertion and grants the client IP the
+// same way a correct password does.
+func (h *Handlers) WebAuthnFinish(g *gin.Context) {
+	if h.webAuthn == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	if h.rejectLockedOut(g, ip) {
+		return
+	}
+
+	ceremony := h.takeCeremony(g.Query("token"), ip)
+	if ceremony == nil || ceremony.user != "" {
+		slog.Info("Unknown or expired passkey login", "event", "unlock", "ip", ip, "decision", "deny", "reason", "challenge_expired")
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(http.MaxBytesReader(g.Writer, g.Request.Body, maxWebAuthnBody))
+	if err != nil {
+		slog.Info("Invalid passkey assertion", "event", "unlock", "ip", ip, "decision", "deny", "reason", "invalid_format", "err", err)
+		g.Status(http.StatusBadRequest)
+		return
+	}
+
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		account, err := h.passkeys.byHandle(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		if !h.users.exists(account.name) {
+			return nil, fmt.Errorf("user %q was removed", account.name)
+		}
+		return account, nil
+	}
+
+	user, cred, err := h.webAuthn.ValidatePasskeyLogin(lookup, ceremony.session, parsed)
+	if err == nil && cred.Authenticator.CloneWarning {
+		err = errors.New("signature counter went backwards, authenticator may be cloned")
+	}
+	if err != nil {
+		h.registerFailedLogin(ip, "")
+		slog.Info("Failed passkey login", "event", "unlock", "ip", ip, "decision", "deny", "reason", "bad_credentials", "err", err)
+		h.notifyAsync(ip, "", false)
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	account := user.(passkeyAccount)
+	if err := h.passkeys.putCredential(account, *cred); err != nil {
+		slog.Error("Failed to update passkey counter", "user", account.name, "err", err)
+	}
+
+	if !h.completeUnlock(g, ip, account.name, "") {
+		return
+	}
+	g.JSON(http.StatusOK, gin.H{"user": account.name})
+}
+
+// WebAuthnRegisterBegin starts registering a passkey. Only a browser holding
+// a user session (see userSessions) may register, and the passkey is attached
+// to that user.
+func (h *Handlers) WebAuthnRegisterBegin(g *gin.Context) {
+	if h.webAuthn == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	name := h.currentUser(g)
+	if name == "" {
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	account, err := h.passkeys.account(name)
+	if err != nil {
+		slog.Error("Failed to load passkeys", "user", name, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	creation, session, err := h.webAuthn.BeginRegistration(account,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(account.Credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		slog.Error("Failed to begin passkey registration", "user", name, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.putCeremony(&webauthnCeremony{session: *session, ip: ip, user: name})
+	if err != nil {
+		slog.Error("Failed to store passkey ceremony", "ip", ip, "user", name, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	g.JSON(http.StatusOK, gin.H{"token": token, "options": creation})
+}
+
+// WebAuthnRegisterFinish verifies the new credential and stores it.
+func (h *Handlers) WebAuthnRegisterFinish(g *gin.Context) {
+	if h.webAuthn == nil {
+		g.Status(http.StatusNotFound)
+		return
+	}
+
+	ip := h.clientIP(g)
+	name := h.currentUser(g)
+	ceremony := h.takeCeremony(g.Query("token"), ip)
+	if name == "" || ceremony == nil || ceremony.user != name {
+		g.Status(http.StatusUnauthorized)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(http.MaxBytesReader(g.Writer, g.Request.Body, maxWebAuthnBody))
+	if err != nil {
+		slog.Info("Invalid passkey registration", "event", "passkey_registration", "ip", ip, "user", name, "decision", "deny", "reason", "invalid_format", "err", err)
+		g.Status(http.StatusBadRequest)
+		return
+	}
+
+	account, err := h.passkeys.account(name)
+	if err != nil {
+		slog.Error("Failed to load passkeys", "user", name, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	cred, err := h.webAuthn.CreateCredential(account, ceremony.session, parsed)
+	if err != nil {
+		slog.Info("Rejected passkey registration", "event", "passkey_registration", "ip", ip, "user", name, "decision", "deny", "reason", "bad_credential", "err", err)
+		g.Status(http.StatusBadRequest)
+		return
+	}
+
+	if err := h.passkeys.putCredential(account, *cred); err != nil {
+		slog.Error("Failed to save passkey", "user", name, "err", err)
+		g.Status(http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Registered passkey", "event", "passkey_registration", "ip", ip, "user", name, "decision", "allow")
+	g.Status(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func newTestWebAuthnHandlers(t *testing.T) *Handlers {
+	t.Helper()
+
+	h := newTestHandlers()
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass"})
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          "example.com",
+		RPDisplayName: "Gateway",
+		RPOrigins:     []string{"https://example.com"},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: time.Minute, TimeoutUVD: time.Minute},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: time.Minute, TimeoutUVD: time.Minute},
+		},
+	})
+	if err != nil {
+		t.Fatalf("webauthn config: %v", err)
+	}
+	h.webAuthn = w
+	h.passkeys = &passkeyStore{file: filepath.Join(t.TempDir(), "passkeys.json"), users: make(map[string]*passkeyUser)}
+	return &h
+}
+
+func putTestUserSession(h *Handlers, token, user string) {
+	h.userSessions.lock.Lock()
+	defer h.userSessions.lock.Unlock()
+	if h.userSessions.sessions == nil {
+		h.userSessions.sessions = make(map[string]userSession)
+	}
+	h.userSessions.sessions[hashSession(token)] = userSession{user: user, expires: time.Now().Add(userSessionTTL)}
+}
+
+func postWebAuthn(handler gin.HandlerFunc, path, ip string, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+	c.Request.Header.Set("X-Gateway-Client-IP", ip)
+	if cookie != nil {
+		c.Request.AddCookie(cookie)
+	}
+	handler(c)
+	return c.Writer.Status(), w
+}
+
+func TestWebAuthnRegisterRequiresUserSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestWebAuthnHandlers(t)
+	putTestGrant(h, &authed{IP: "203.0.113.7", AuthedTime: time.Now(), Session: "shared-session", SessionHash: hashSession("shared-session")})
+	putTestGrant(h, &authed{IP: "203.0.113.8", AuthedTime: time.Now(), Session: "alice-session", SessionHash: hashSession("alice-session"), User: "alice"})
+
+	putTestUserSession(h, "alice-login", "alice")
+
+	if status, _ := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.7", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", status)
+	}
+	sharedCookie := &http.Cookie{Name: "gateway_session", Value: "shared-session"}
+	if status, _ := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.7", sharedCookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a shared password session, got %d", status)
+	}
+	// A grant cookie can reach anyone behind the grant's IP, so it doesn't
+	// identify alice.
+	grantCookie := &http.Cookie{Name: "gateway_session", Value: "alice-session"}
+	if status, _ := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.8", grantCookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for alice's grant cookie, got %d", status)
+	}
+
+	aliceCookie := &http.Cookie{Name: userCookie, Value: "alice-login"}
+	status, w := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.8", aliceCookie)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for alice's session, got %d", status)
+	}
+	var resp struct {
+		Token   string `json:"token"`
+		Options struct {
+			PublicKey struct {
+				User struct {
+					Name string `json:"name"`
+				} `json:"user"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode registration options: %v", err)
+	}
+	if resp.Token == "" || resp.Options.PublicKey.User.Name != "alice" {
+		t.Fatalf("expected a ceremony token and options for alice, got %s", w.Body.String())
+	}
+
+	// The ceremony is bound to the IP that started it and is single use.
+	if c := h.takeCeremony(resp.Token, "203.0.113.9"); c != nil {
+		t.Fatal("expected ceremony to be refused from another IP")
+	}
+	if c := h.takeCeremony(resp.Token, "203.0.113.8"); c != nil {
+		t.Fatal("expected ceremony to be consumed by the failed attempt")
+	}
+}
+
+func TestUnlockIssuesUserSessionOnlyToUnlockingBrowser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestWebAuthnHandlers(t)
+	h.users = newTestUserStore(t, map[string]string{"alice": "alice-pass", "bob": "bob-pass"})
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+
+	_, w := postUnlockForm(h, "203.0.113.7", url.Values{"user": {"alice"}, "pass": {"alice-pass"}})
+	login := sessionCookie(w, userCookie)
+	if login == "" {
+		t.Fatal("expected a user session cookie after unlocking")
+	}
+	if status, _ := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.7", &http.Cookie{Name: userCookie, Value: login}); status != http.StatusOK {
+		t.Fatalf("expected alice's user session to start registration, got %d", status)
+	}
+
+	// Someone else behind the same IP gets in, but not as alice.
+	wa := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(wa)
+	c.Request = httptest.NewRequest(http.MethodGet, "/access", nil)
+	c.Request.Header.Set("X-Gateway-Client-IP", "203.0.113.7")
+	h.AccessPage(c)
+	if sessionCookie(wa, userCookie) != "" {
+		t.Fatal("expected no user session from an IP grant")
+	}
+
+	// Revoking alice ends her user session too.
+	h.endUserSessions("alice")
+	if status, _ := postWebAuthn(h.WebAuthnRegisterBegin, "/unlock/webauthn/register/begin", "203.0.113.7", &http.Cookie{Name: userCookie, Value: login}); status != http.StatusUnauthorized {
+		t.Fatalf("expected an ended user session to be refused, got %d", status)
+	}
+
+	// Allow async saveGranted goroutine(s) to finish before TempDir cleanup.
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestWebAuthnFinishRejectsUnknownCeremony(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestWebAuthnHandlers(t)
+
+	status, w := postWebAuthn(h.WebAuthnBegin, "/unlock/webauthn/begin", "203.0.113.7", nil)
+	if status != http.StatusOK || !strings.Contains(w.Body.String(), `"challenge"`) {
+		t.Fatalf("expected login options, got %d %s", status, w.Body.String())
+	}
+
+	if status, _ := postWebAuthn(h.WebAuthnFinish, "/unlock/webauthn/finish?token=bogus", "203.0.113.7", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown ceremony, got %d", status)
+	}
+	if findTestGrant(h, "203.0.113.7") != nil {
+		t.Fatal("expected no grant without a verified passkey")
+	}
+}
+
+func TestWebAuthnDisabledReturnsNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := newTestHandlers()
+	if status, _ := postWebAuthn(h.WebAuthnBegin, "/unlock/webauthn/begin", "203.0.113.7", nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404 when WebAuthn isn't configured, got %d", status)
+	}
+}
+
+func TestPasskeyStorePersistsCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passkeys.json")
+	s, err := loadPasskeyStore(path)
+	if err != nil {
+		t.Fatalf("load empty passkey store: %v", err)
+	}
+
+	account, err := s.account("alice")
+	if err != nil {
+		t.Fatalf("new account: %v", err)
+	}
+	cred := webauthn.Credential{ID: []byte("cred-1"), PublicKey: []byte("key")}
+	if err := s.putCredential(account, cred); err != nil {
+		t.Fatalf("put credential: %v", err)
+	}
+	cred.Authenticator.SignCount = 7
+	if err := s.putCredential(account, cred); err != nil {
+		t.Fatalf("update credential: %v", err)
+	}
+
+	reloaded, err := loadPasskeyStore(path)
+	if err != nil {
+		t.Fatalf("reload passkey store: %v", err)
+	}
+	got, err := reloaded.byHandle(account.Handle)
+	if err != nil {
+		t.Fatalf("lookup by handle: %v", err)
+	}
+	if got.name != "alice" || len(got.Credentials) != 1 || got.Credentials[0].Authenticator.SignCount != 7 {
+		t.Fatalf("expected alice's single updated credential, got %#v", got)
+	}
+}
@@ -0,0 +1,206 @@
+package web
+
+import (
+	"sync"
+	"time"
+)
+
+// persistRetryDelay is the least time between attempts while the store is
+// failing, so a debounce of 0 doesn't spin.
+const persistRetryDelay = time.Second
+
+// persistWriter is the single background writer for local stores. Changes
+// mark a grant or lockout dirty; the first mark opens a window (the debounce)
+// in which further marks coalesce, then one flush writes everything dirty. A
+// burst of unlocks or local-bypass grants costs one rewrite of the persist
+// file rather than one per request. Failed writes stay dirty and are retried.
+type persistWriter struct {
+	h      *Handlers
+	window time.Duration
+
+	lock     sync.Mutex
+	all      bool            // rewrite every grant (cleanup)
+	grants   map[string]bool // keys of grants that changed
+	lockouts map[string]bool // IPs whose lockout state changed
+	closed   bool            // after close, mark reports false
+
+	kick     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newPersistWriter(h *Handlers, window time.Duration) *persistWriter {
+	w := &persistWriter{
+		h:        h,
+		window:   window,
+		grants:   make(map[string]bool),
+		lockouts: make(map[string]bool),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// queueGrant writes the grant under key through the persist writer, or inline
+// without one. After Close has begun it does nothing.
+func (h *Handlers) queueGrant(key string) {
+	if h.closing() {
+		return
+	}
+	if !h.writer.mark(func(w *persistWriter) { w.grants[key] = true }) {
+		h.syncGrant(key)
+	}
+}
+
+// queueLockout is queueGrant for lockout state.
+func (h *Handlers) queueLockout(ip string) {
+	if h.closing() {
+		return
+	}
+	if !h.writer.mark(func(w *persistWriter) { w.lockouts[ip] = true }) {
+		h.syncLockout(ip)
+	}
+}
+
+// queueSave rewrites every grant, for bulk changes.
+func (h *Handlers) queueSave() {
+	if h.closing() {
+		return
+	}
+	if !h.writer.mark(func(w *persistWriter) { w.all = true }) {
+		h.saveGranted()
+	}
+}
+
+// mark records a change for the next flush. It reports false if there is no
+// running writer, in which case the caller writes the change itself.
+func (w *persistWriter) mark(change func(*persistWriter)) bool {
+	if w == nil {
+		return false
+	}
+
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return false
+	}
+	change(w)
+	w.lock.Unlock()
+
+	w.signal()
+	return true
+}
+
+func (w *persistWriter) signal() {
+	select {
+	case w.kick <- struct{}{}:
+	default: // a flush is already due
+	}
+}
+
+// pending returns the number of changes waiting to be written.
+func (w *persistWriter) pending() int {
+	if w == nil {
+		return 0
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n := len(w.grants) + len(w.lockouts)
+	if w.all {
+		n++
+	}
+	return n
+}
+
+func (w *persistWriter) run() {
+	defer close(w.stopped)
+
+	wait := w.window
+	for {
+		select {
+		case <-w.stop:
+			w.flush()
+			return
+		case <-w.kick:
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-w.stop:
+			timer.Stop()
+			w.flush()
+			return
+		case <-timer.C:
+		}
+
+		wait = w.window
+		if !w.flush() {
+			wait = max(w.window, persistRetryDelay)
+			w.signal()
+		}
+	}
+}
+
+// flush writes everything marked so far and reports whether it all succeeded.
+// Whatever failed is marked again.
+func (w *persistWriter) flush() bool {
+	w.lock.Lock()
+	all, grants, lockouts := w.all, w.grants, w.lockouts
+	w.all, w.grants, w.lockouts = false, make(map[string]bool), make(map[string]bool)
+	w.lock.Unlock()
+
+	var failedAll bool
+	var failedGrants, failedLockouts []string
+	if all {
+		// Rewriting every grant covers the single ones too.
+		failedAll = w.h.saveGranted() != nil
+	} else if len(grants) > 0 {
+		keys := make([]string, 0, len(grants))
+		for key := range grants {
+			keys = append(keys, key)
+		}
+		if w.h.syncGrants(keys) != nil {
+			failedGrants = keys
+		}
+	}
+	for ip := range lockouts {
+		if w.h.writeLockout(ip) != nil {
+			failedLockouts = append(failedLockouts, ip)
+		}
+	}
+
+	if !failedAll && len(failedGrants) == 0 && len(failedLockouts) == 0 {
+		return true
+	}
+
+	w.lock.Lock()
+	w.all = w.all || failedAll
+	for _, key := range failedGrants {
+		w.grants[key] = true
+	}
+	for _, ip := range failedLockouts {
+		w.lockouts[ip] = true
+	}
+	w.lock.Unlock()
+	return false
+}
+
+// close writes anything pending and stops the writer. Handlers.Close stops
+// queueing changes before calling it.
+func (w *persistWriter) close() {
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	w.closed = true
+	w.lock.Unlock()
+
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.stopped
+}
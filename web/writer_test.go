@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts batched grant writes and can fail the first few.
+type countingStore struct {
+	*jsonStore
+
+	lock    sync.Mutex
+	batches int
+	failing int
+}
+
+func (s *countingStore) applyGrants(puts []persistedAuthed, deletes []string) error {
+	s.lock.Lock()
+	s.batches++
+	if s.failing > 0 {
+		s.failing--
+		s.lock.Unlock()
+		return errors.New("disk full")
+	}
+	s.lock.Unlock()
+	return s.jsonStore.applyGrants(puts, deletes)
+}
+
+func (s *countingStore) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.batches
+}
+
+func newTestWriterHandlers(t *testing.T, window time.Duration) (*Handlers, *countingStore) {
+	t.Helper()
+
+	h := newTestHandlers()
+	h.persistFile = filepath.Join(t.TempDir(), "granted.json")
+	store := &countingStore{jsonStore: newJSONStore(h.persistFile, "")}
+	h.store = store
+	h.metrics = newMetrics(&h)
+	h.writer = newPersistWriter(&h, window)
+	return &h, store
+}
+
+func TestPersistWriterCoalescesBurst(t *testing.T) {
+	h, store := newTestWriterHandlers(t, time.Hour)
+
+	for i := 0; i < 50; i++ {
+		if _, err := h.addGranted(fmt.Sprintf("203.0.113.%d", i), "", ""); err != nil {
+			t.Fatalf("grant: %v", err)
+		}
+	}
+	if store.count() != 0 {
+		t.Fatalf("expected no writes inside the window, got %d", store.count())
+	}
+	if n := h.writer.pending(); n != 50 {
+		t.Fatalf("expected 50 pending writes, got %d", n)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if store.count() != 1 {
+		t.Fatalf("expected the burst in one write, got %d", store.count())
+	}
+	grants, err := readPersisted(h.persistFile, nil)
+	if err != nil || len(grants) != 50 {
+		t.Fatalf("expected 50 grants on disk after close, got %d (%v)", len(grants), err)
+	}
+
+}
+
+func TestPersistWriterRetriesFailedWrites(t *testing.T) {
+	h, store := newTestWriterHandlers(t, 0)
+	store.failing = 1
+
+	if _, err := h.addGranted("203.0.113.1", "", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for store.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	body := scrapeTestMetrics(t, h, "").Body.String()
+	for _, want := range []string{
+		`gateway_persist_save_errors_total 1`,
+		`gateway_persist_pending_writes 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics output, got:\n%s", want, body)
+		}
+	}
+
+	// Closing flushes again, without waiting out the retry delay.
+	if err := h.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if grants, err := readPersisted(h.persistFile, nil); err != nil || len(grants) != 1 {
+		t.Fatalf("expected the grant written on retry, got %#v (%v)", grants, err)
+	}
+	if n := h.writer.pending(); n != 0 {
+		t.Fatalf("expected nothing pending after close, got %d", n)
+	}
+}
+
+func TestCloseDrainsNotificationsAndSaves(t *testing.T) {
+	var sent atomic.Int32
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		sent.Add(1)
+	}))
+	defer slack.Close()
+
+	h, _ := newTestWriterHandlers(t, time.Hour)
+	h.settings.slackWebhook = slack.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stopBackground = cancel
+	h.background.Go(func() { h.cleanupExpiredIPs(ctx) })
+
+	if _, err := h.addGranted("203.0.113.1", "alice", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if sent.Load() != 1 {
+		t.Fatalf("expected the unlock notification sent before close returned, got %d", sent.Load())
+	}
+	if ctx.Err() == nil {
+		t.Fatal("expected close to stop the cleanup loop")
+	}
+	if grants, err := readPersisted(h.persistFile, nil); err != nil || len(grants) != 1 || grants[0].User != "alice" {
+		t.Fatalf("expected the grant saved on close, got %#v (%v)", grants, err)
+	}
+	// A handler still running past the shutdown timeout can't start work
+	// Close no longer waits for.
+	if _, err := h.addGranted("203.0.113.2", "bob", ""); err != nil {
+		t.Fatalf("late grant: %v", err)
+	}
+	if sent.Load() != 1 {
+		t.Fatalf("expected no notification after close, got %d", sent.Load())
+	}
+	if grants, _ := readPersisted(h.persistFile, nil); len(grants) != 1 {
+		t.Fatalf("expected no store write after close, got %#v", grants)
+	}
+}